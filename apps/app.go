@@ -1,8 +1,15 @@
 package apps
 
+import (
+	"time"
+)
+
 type App interface {
 	Start(string) // start or provide extra data
 	Running() bool
 	Quit()
 	FriendlyName() string // return a human-readable name
+	StartTime() time.Time // when the app was last started, zero if never
+	Pause()               // pause playback, if anything is playing
+	Play()                // resume playback, if paused
 }
@@ -1,18 +1,43 @@
 package mp
 
 import (
+	"flag"
+	"sort"
+	"strings"
 	"time"
 )
 
+var flagBackend = flag.String("backend", "mpv", "media player backend, or a comma-separated list of backends to try in order: "+backendNames())
+
+// All available backends, by name.
+var backends = map[string]func() Backend{
+	"mpv":  func() Backend { return &MPV{} },
+	"null": func() Backend { return &Null{} },
+}
+
+// backendNames returns the names of all backends, for use in messages.
+func backendNames() string {
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
 type Backend interface {
-	initialize() (chan State, int)
+	initialize() (chan State, int, error)
 	quit()
-	play(string, time.Duration, int)
+	play(string, time.Duration, time.Duration, int) error
 	pause()
 	resume()
 	getDuration() (time.Duration, error)
 	getPosition() (time.Duration, error)
+	getState() (State, error)
+	getBufferingProgress() (int, error)
 	setPosition(time.Duration)
 	setVolume(int)
+	getAudioTracks() ([]AudioTrack, error)
+	setAudioTrack(int)
 	stop()
 }
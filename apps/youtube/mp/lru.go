@@ -0,0 +1,49 @@
+package mp
+
+import (
+	"container/list"
+)
+
+// lruList keeps track of the order in which keys of a cache are used, to
+// evict the least recently used entry when the cache is full. It is not safe
+// for concurrent use: it must be protected by the mutex of the cache.
+type lruList struct {
+	order    *list.List // least recently used first
+	elements map[string]*list.Element
+}
+
+func newLRUList() *lruList {
+	return &lruList{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// touch marks key as the most recently used key, adding it if needed.
+func (l *lruList) touch(key string) {
+	if element, ok := l.elements[key]; ok {
+		l.order.MoveToBack(element)
+		return
+	}
+	l.elements[key] = l.order.PushBack(key)
+}
+
+// remove removes key, if it exists.
+func (l *lruList) remove(key string) {
+	if element, ok := l.elements[key]; ok {
+		l.order.Remove(element)
+		delete(l.elements, key)
+	}
+}
+
+// oldest returns the least recently used key for which keep returns false, or
+// false if there is no such key.
+func (l *lruList) oldest(keep func(key string) bool) (string, bool) {
+	for element := l.order.Front(); element != nil; element = element.Next() {
+		key := element.Value.(string)
+		if keep == nil || !keep(key) {
+			return key, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,52 @@
+package mp
+
+import (
+	"testing"
+)
+
+func TestLRUList(t *testing.T) {
+	l := newLRUList()
+	if key, ok := l.oldest(nil); ok {
+		t.Errorf("empty list: got oldest %q", key)
+	}
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		l.touch(key)
+	}
+	l.touch("a") // now most recently used
+	l.remove("c")
+	l.remove("x") // doesn't exist
+
+	var order []string
+	for {
+		key, ok := l.oldest(nil)
+		if !ok {
+			break
+		}
+		order = append(order, key)
+		l.remove(key)
+	}
+	if !equalStrings(order, []string{"b", "d", "a"}) {
+		t.Errorf("got order %q, want [b d a]", order)
+	}
+}
+
+func TestLRUListKeep(t *testing.T) {
+	l := newLRUList()
+	for _, key := range []string{"a", "b", "c"} {
+		l.touch(key)
+	}
+
+	keep := func(key string) bool {
+		return key == "a" || key == "b"
+	}
+	if key, ok := l.oldest(keep); !ok || key != "c" {
+		t.Errorf("got %q %v, want c", key, ok)
+	}
+	keepAll := func(key string) bool {
+		return true
+	}
+	if key, ok := l.oldest(keepAll); ok {
+		t.Errorf("all keys are kept, got %q", key)
+	}
+}
@@ -5,14 +5,106 @@ package mp
 import (
 	"errors"
 	"flag"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/aykevl/plaincast/config"
 	"github.com/aykevl/plaincast/log"
 )
 
 var logger = log.New("player", "log media player messages")
 
 var cacheDir = flag.String("cachedir", "", "Cache directory")
+var flagVideo = flag.Bool("video", false, "play video as well, for when a display is connected")
+var flagEOFGrace = flag.Duration("eof-grace", 10*time.Second, "resume a video that ends longer than this before its end, as it was probably a network error (0 disables)")
+var flagReplay = flag.String("replay", REPLAY_PLAYLIST, "what play does after the whole playlist has played: 'playlist' starts at the first video, 'video' replays the last video")
+var flagVolumeCurve = flag.String("volume-curve", VOLUME_CURVE_LINEAR, "how the volume of the remote maps to the volume of the player: 'linear', or 'log' for a perceptual curve")
+var flagNoAutoadvance = flag.Bool("no-autoadvance", false, "stop at the end of each video instead of playing the next video in the playlist")
+var flagPrefetch = flag.Int("prefetch", 1, "number of upcoming videos to fetch the stream of in advance (0 disables, at most 5)")
+
+// Values for -replay.
+const (
+	REPLAY_PLAYLIST = "playlist"
+	REPLAY_VIDEO    = "video"
+)
+
+// Values for -volume-curve.
+const (
+	VOLUME_CURVE_LINEAR = "linear"
+	VOLUME_CURVE_LOG    = "log"
+)
+
+// Range of the logarithmic volume curve: volume 1 is this much quieter than
+// volume 100.
+const VOLUME_CURVE_RANGE_DB = 40
+
+// Upper limit for -prefetch, so a huge queue doesn't keep the grabber busy.
+const MAX_PREFETCH = 5
+
+// How long the player may be buffering or seeking before asking the backend
+// whether it is really still doing that.
+const STUCK_TIMEOUT = 15 * time.Second
+
+// How often to check for a stuck player and to remember the position (for
+// -eof-grace).
+const CHECK_INTERVAL = 5 * time.Second
+
+// The metadata of videos in the playlist is fetched one at a time (there is
+// only one grabber), with this delay in between to not hog the grabber.
+const METADATA_FETCH_DELAY = time.Second
+const MAX_METADATA_FETCH = 200
+
+// How often to report the buffering progress to the remote while buffering.
+const BUFFERING_PROGRESS_INTERVAL = time.Second
+
+// The title of a playlist is fetched after this delay, so the grabber fetches
+// the stream of the first video first.
+const LIST_TITLE_FETCH_DELAY = 10 * time.Second
+
+// How often the streams of the current and upcoming videos are checked for
+// expiry. Streams that expire within STREAM_EXPIRY_MARGIN are fetched again,
+// so a video that has been paused for a long time can still be resumed.
+const STREAM_REFRESH_INTERVAL = 15 * time.Minute
+
+// How often a single video may be resumed after ending early.
+const MAX_EOF_RESUMES = 3
+
+// A stream that stops within this time after it started playing has probably
+// failed to load (e.g. an expired URL). After fetching the stream again didn't
+// help, the video is skipped after SKIP_DELAY, so a broken playlist isn't
+// skipped through in a second.
+const INSTANT_EOF_TIMEOUT = time.Second
+const SKIP_DELAY = 2 * time.Second
+
+// When playing a mix (auto-generated playlist, such as radio), more videos are
+// fetched when no more than this number of videos follow the current video, so
+// that the mix plays endlessly.
+const MIX_CONTINUE_THRESHOLD = 3
+
+// Base URL of the HTTP proxy for streams, see SetProxyURL.
+var proxyURL = "http://localhost:8008/proxy/"
+var proxyURLMutex sync.Mutex
+
+// SetProxyURL sets the base URL of the stream proxy, which the backend uses to
+// play streams. The stream URL without https:// is appended to it.
+func SetProxyURL(url string) {
+	proxyURLMutex.Lock()
+	defer proxyURLMutex.Unlock()
+
+	proxyURL = url
+}
+
+// getProxyURL returns the URL to play the given https:// stream through the
+// proxy.
+func getProxyURL(stream string) string {
+	proxyURLMutex.Lock()
+	defer proxyURLMutex.Unlock()
+
+	return proxyURL + strings.TrimPrefix(stream, "https://")
+}
 
 // these are defined by the YouTube API
 type State int
@@ -35,11 +127,31 @@ type PlayState struct {
 	Index             int
 	State             State
 	ListId            string
+	ListTitle         string // title of the ListId playlist, empty until known
 	Volume            int
+	Live              bool          // true if the current video is a live stream
+	End               time.Duration // position to stop playing endVideo, 0 if unset
+	endVideo          string        // video to which End applies
 	bufferingPosition time.Duration
-	newVolume         bool  // true if the Volume property must be reapplied to the player
-	previousState     State // state before current state
-	nextState         State // state after buffering
+	metadataDuration  time.Duration // duration according to the grabber, 0 if unknown
+	lastDuration      time.Duration // last duration reported by the player, 0 if unknown
+	stoppedPosition   time.Duration // position while stopped: at the end after the last video ended
+	lastPosition      time.Duration // last known position while playing, for -eof-grace
+	eofResumes        int           // how often the current video has been resumed after ending early
+	playStart         time.Time     // when the current stream started playing
+	reloaded          bool          // true if the stream of the current video has been fetched again after failing
+	newVolume         bool          // true if the Volume property must be reapplied to the player
+	ducked            bool          // true if the volume is temporarily lowered to duckVolume, see Duck
+	duckVolume        int           // volume (0-100) set by Duck, used instead of Volume while ducked if it is lower
+	streamLoaded      bool          // true if the backend has been given the stream of the current video
+	streamExpires     time.Time     // estimated expiry time of the stream given to the backend
+	stateChanged      time.Time     // when State was last set by setPlayState
+	bufferingProgress int           // buffering progress last sent in a StateChange, -1 if none
+	mixPending        bool          // true while more videos of the mix are being fetched
+	finished          bool          // true when stopped after the last video of the playlist ended
+	autoPaused        bool          // true when paused by AutoPause and the state hasn't changed since
+	previousState     State         // state before current state
+	nextState         State         // state after buffering
 }
 
 // Video returns the current video, or an empty string if there is no current
@@ -51,6 +163,36 @@ func (ps *PlayState) Video() string {
 	return ps.Playlist[ps.Index]
 }
 
+// playerVolume returns the volume the player should use: Volume, unless the
+// volume is lowered with Duck, mapped with -volume-curve.
+func (ps *PlayState) playerVolume() int {
+	if ps.ducked && ps.duckVolume < ps.Volume {
+		return curvedVolume(ps.duckVolume)
+	}
+	return curvedVolume(ps.Volume)
+}
+
+// curvedVolume maps a volume as shown to the user (0-100) to the volume of the
+// player (0-100), according to -volume-curve and limited to the
+// MAX_VOLUME_KEY config value. The log curve changes the volume by the same
+// number of decibels for each step, which sounds more even than a linear
+// curve.
+func curvedVolume(volume int) int {
+	if limit := int(atomic.LoadInt32(&maxVolume)); volume > limit {
+		volume = limit
+	}
+	if *flagVolumeCurve != VOLUME_CURVE_LOG || volume <= 0 || volume >= 100 {
+		return volume
+	}
+	db := float64(100-volume) / 99 * -VOLUME_CURVE_RANGE_DB
+	curved := int(math.Pow(10, db/20)*100 + 0.5)
+	if curved < 1 {
+		// Don't mute at the lowest volume.
+		curved = 1
+	}
+	return curved
+}
+
 // NextVideo returns the next video in the playlist, or an empty string if there
 // is no next video.
 func (ps *PlayState) NextVideo() string {
@@ -62,21 +204,170 @@ func (ps *PlayState) NextVideo() string {
 	return ps.Playlist[ps.Index+1]
 }
 
+// NextVideos returns up to n videos following the current video.
+func (ps *PlayState) NextVideos(n int) []string {
+	start := ps.Index + 1
+	if start < 0 || start >= len(ps.Playlist) {
+		return nil
+	}
+	end := start + n
+	if end > len(ps.Playlist) {
+		end = len(ps.Playlist)
+	}
+	return ps.Playlist[start:end]
+}
+
+// IsMix returns true if the playlist is a mix (auto-generated playlist, e.g.
+// radio), which can be continued endlessly.
+func (ps *PlayState) IsMix() bool {
+	return IsMix(ps.ListId)
+}
+
+// IsMix returns true if the list ID is the ID of a mix.
+func IsMix(listId string) bool {
+	return strings.HasPrefix(listId, "RD")
+}
+
+// AudioTrack is a single audio track (usually a language) of the current video.
+type AudioTrack struct {
+	Id       int    `json:"id"`
+	Lang     string `json:"lang,omitempty"`
+	Title    string `json:"title,omitempty"`
+	Selected bool   `json:"selected"`
+}
+
+// QueueItem is a single video in the playlist, with metadata if it is known.
+type QueueItem struct {
+	VideoId  string  `json:"videoId"`
+	Title    string  `json:"title,omitempty"`
+	Duration float64 `json:"duration,omitempty"` // in seconds
+	Current  bool    `json:"current,omitempty"`
+}
+
+// Playback is the state of the current video, so another instance can follow
+// this one (see Follow).
+type Playback struct {
+	State     State   `json:"state"`
+	Index     int     `json:"index"`    // index of the current video in the queue
+	Position  float64 `json:"position"` // in seconds
+	ListId    string  `json:"listId,omitempty"`
+	ListTitle string  `json:"listTitle,omitempty"`
+}
+
+// DebugState is a snapshot of the internal state of the MediaPlayer, for
+// troubleshooting.
+type DebugState struct {
+	Playlist      []string      `json:"playlist"`
+	Index         int           `json:"index"`
+	State         State         `json:"state"`
+	ListId        string        `json:"listId"`
+	ListTitle     string        `json:"listTitle"`
+	Volume        int           `json:"volume"`
+	Ducked        bool          `json:"ducked"`
+	Live          bool          `json:"live"`
+	Position      float64       `json:"position"` // in seconds
+	Duration      float64       `json:"duration"` // in seconds
+	StreamLoaded  bool          `json:"streamLoaded"`
+	EOFResumes    int           `json:"eofResumes"`
+	Reloaded      bool          `json:"reloaded"`
+	Finished      bool          `json:"finished"`
+	StateChanged  time.Time     `json:"stateChanged"`
+	GrabberUp     bool          `json:"grabberRunning"`
+	CachedStreams []StreamState `json:"cachedStreams"`
+}
+
+// StreamState describes a stream in the cache of the VideoGrabber.
+type StreamState struct {
+	VideoId string    `json:"videoId"`
+	Quality string    `json:"quality"`
+	Pending bool      `json:"pending"` // waiting for the grabber
+	Expires time.Time `json:"expires"`
+}
+
 type PlaylistState struct {
-	Playlist []string
-	Index    int
-	Position time.Duration
-	Duration time.Duration
-	State    State
-	ListId   string
+	Playlist  []string
+	Index     int
+	Position  time.Duration
+	Duration  time.Duration
+	State     State
+	ListId    string
+	ListTitle string
+	Live      bool
 }
 
 type StateChange struct {
 	State    State
 	Position time.Duration // current position in file
 	Duration time.Duration // total duration of file
+	Live     bool          // whether this is a live stream
+	VideoId  string        // current video, empty if there is none
+	Progress int           // buffering progress in percent, -1 if this isn't a progress update
 }
 
 const INITIAL_VOLUME = 80
 
+// savedVolume returns the volume the backend should start with: the volume
+// last set by the user, or INITIAL_VOLUME. The remote shows this volume, so it
+// is kept within the range every backend accepts.
+func savedVolume() (int, error) {
+	volume, err := config.Get().GetInt("player.volume", func() (int, error) {
+		return INITIAL_VOLUME, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if volume < 0 {
+		volume = 0
+	} else if volume > 100 {
+		volume = 100
+	}
+	return volume, nil
+}
+
+// Config key of the highest volume the player may use (0-100), e.g. to protect
+// small speakers. It can be changed while running, see config.OnReload.
+const MAX_VOLUME_KEY = "player.maxVolume"
+
+// The MAX_VOLUME_KEY config value, must be accessed atomically.
+var maxVolume int32 = 100
+
+// Players to apply a changed maximum volume to, see reloadMaxVolume.
+var players = make(map[*MediaPlayer]struct{})
+var playersMutex sync.Mutex
+var maxVolumeOnce sync.Once
+
+// loadMaxVolume reads the maximum volume from the config file.
+func loadMaxVolume() {
+	volume, err := config.Get().GetInt(MAX_VOLUME_KEY, func() (int, error) {
+		return 100, nil
+	})
+	if err != nil {
+		logger.Warnln("invalid "+MAX_VOLUME_KEY+" in config:", err)
+		volume = 100
+	}
+	if volume < 0 {
+		volume = 0
+	} else if volume > 100 {
+		volume = 100
+	}
+	atomic.StoreInt32(&maxVolume, int32(volume))
+}
+
+// reloadMaxVolume reads the maximum volume again after the config file has
+// been reloaded, and applies it to the running players.
+func reloadMaxVolume() {
+	loadMaxVolume()
+
+	playersMutex.Lock()
+	running := make([]*MediaPlayer, 0, len(players))
+	for p := range players {
+		running = append(running, p)
+	}
+	playersMutex.Unlock()
+
+	for _, p := range running {
+		p.getPlayState(p.applyPlayerVolume)
+	}
+}
+
 var PROPERTY_UNAVAILABLE = errors.New("media player: property unavailable")
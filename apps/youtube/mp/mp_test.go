@@ -0,0 +1,237 @@
+package mp
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Duration of every video in the fake grabber and the test backend.
+const FAKE_DURATION = 3 * time.Minute
+
+func TestMain(m *testing.M) {
+	switch os.Getenv("PLAINCAST_FAKE_GRABBER") {
+	case "":
+	case "fail":
+		// A grabber that exits right away, e.g. because it crashed.
+		os.Exit(1)
+	default:
+		fakeGrabber()
+		os.Exit(0)
+	}
+
+	grabberCommand = fakeGrabberCommand
+	os.Exit(m.Run())
+}
+
+// fakeGrabberCommand is a grabberCommand that runs the test binary as a fake
+// grabber, see fakeGrabber.
+func fakeGrabberCommand(formats, cacheDir string) *exec.Cmd {
+	return fakeGrabberMode("ok")
+}
+
+// failingGrabberCommand is a grabberCommand for a grabber that exits right
+// away.
+func failingGrabberCommand(formats, cacheDir string) *exec.Cmd {
+	return fakeGrabberMode("fail")
+}
+
+func fakeGrabberMode(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0])
+	// Don't let the race detector delay the exit of every grabber.
+	cmd.Env = append(os.Environ(), "PLAINCAST_FAKE_GRABBER="+mode, "GORACE=atexit_sleep_ms=0")
+	return cmd
+}
+
+// fakeGrabber speaks the protocol of the python grabber on stdin and stdout,
+// without touching the network. Every video exists.
+func fakeGrabber() {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		os.Exit(0)
+	}()
+
+	scanner := bufio.NewScanner(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for scanner.Scan() {
+		var request grabberRequest
+		if err := json.Unmarshal(scanner.Bytes(), &request); err != nil {
+			encoder.Encode(grabberResponse{Error: "unavailable"})
+			continue
+		}
+		videoId := ""
+		if u, err := url.Parse(request.URL); err == nil {
+			videoId = u.Query().Get("v")
+		}
+
+		response := grabberResponse{
+			Duration: FAKE_DURATION.Seconds(),
+			Title:    "Video " + videoId,
+		}
+		if request.Metadata {
+			response.Metadata = true
+		} else {
+			expire := time.Now().Add(6 * time.Hour).Unix()
+			response.URL = "https://example.com/videoplayback?id=" + url.QueryEscape(videoId) + "&expire=" + strconv.FormatInt(expire, 10)
+		}
+		encoder.Encode(response)
+	}
+}
+
+// waitFor polls until cond returns true, or fails the test after a second.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout waiting for", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testBackend is a Backend that doesn't play anything, for tests. It starts
+// playing right away, and the position only changes when seeking.
+type testBackend struct {
+	mutex    sync.Mutex
+	events   chan State
+	state    State
+	position time.Duration
+	volume   int
+	// Volume given to the last play call. Like options given to loadfile in
+	// mpv, it only applies to that video.
+	playVolume int
+	// When set, play starts at the keyframe before the requested position,
+	// like mpv does for most streams.
+	keyframeInterval time.Duration
+}
+
+func (b *testBackend) initialize() (chan State, int, error) {
+	// Buffered, as events are sent while the MediaPlayer holds the PlayState.
+	b.events = make(chan State, 100)
+	return b.events, INITIAL_VOLUME, nil
+}
+
+func (b *testBackend) quit() {
+	close(b.events)
+}
+
+func (b *testBackend) play(stream string, position, end time.Duration, volume int) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if volume != -1 {
+		b.volume = volume
+	}
+	b.playVolume = volume
+	b.state = STATE_PLAYING
+	b.position = position
+	if b.keyframeInterval != 0 {
+		b.position -= position % b.keyframeInterval
+	}
+	b.events <- STATE_PLAYING
+	return nil
+}
+
+func (b *testBackend) pause() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == STATE_PLAYING {
+		b.state = STATE_PAUSED
+		b.events <- STATE_PAUSED
+	}
+}
+
+func (b *testBackend) resume() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == STATE_PAUSED {
+		b.state = STATE_PLAYING
+		b.events <- STATE_PLAYING
+	}
+}
+
+func (b *testBackend) getState() (State, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.state, nil
+}
+
+// end lets the video reach its end, like mpv does when it has played the whole
+// file.
+func (b *testBackend) end() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.state = STATE_STOPPED
+	b.position = FAKE_DURATION
+	b.events <- STATE_STOPPED
+}
+
+func (b *testBackend) getDuration() (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == STATE_STOPPED {
+		return 0, PROPERTY_UNAVAILABLE
+	}
+	return FAKE_DURATION, nil
+}
+
+func (b *testBackend) getPosition() (time.Duration, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.state == STATE_STOPPED {
+		return 0, PROPERTY_UNAVAILABLE
+	}
+	return b.position, nil
+}
+
+func (b *testBackend) getBufferingProgress() (int, error) {
+	// Playback starts right away, nothing is buffered.
+	return 0, PROPERTY_UNAVAILABLE
+}
+
+func (b *testBackend) setPosition(position time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.position = position
+	// Like mpv, report that playback has restarted after seeking.
+	b.events <- STATE_PLAYING
+}
+
+func (b *testBackend) setVolume(volume int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.volume = volume
+}
+
+func (b *testBackend) getAudioTracks() ([]AudioTrack, error) {
+	return nil, nil
+}
+
+func (b *testBackend) setAudioTrack(id int) {
+}
+
+func (b *testBackend) stop() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	// Like mpv, don't report a stop that was requested.
+	b.state = STATE_STOPPED
+}
@@ -18,79 +18,105 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/aykevl/plaincast/config"
 	"github.com/aykevl/plaincast/log"
 )
 
 var MPV_PROPERTY_UNAVAILABLE = errors.New("mpv: property unavailable")
 
+// IDs of observed properties, passed as reply_userdata. They must not clash
+// with the reply_userdata of async calls (1).
+const (
+	OBSERVE_PAUSE       = 10 + iota // the 'pause' property, set by pause/resume
+	OBSERVE_CORE_IDLE               // true when not actually playing: paused, buffering or seeking
+	OBSERVE_IDLE_ACTIVE             // true when no file is loaded
+)
+
 // MPV is an implementation of Backend, using libmpv.
 type MPV struct {
 	handle       *C.mpv_handle
 	running      bool
 	runningMutex sync.Mutex
 	mainloopExit chan struct{}
+	logFile      *os.File
 }
 
 var mpvLogger = log.New("mpv", "log MPV wrapper output")
 var logLibMPV = flag.Bool("log-libmpv", false, "log output of libmpv")
+var flagNormalize = flag.Bool("normalize", false, "normalize loudness, so all videos play at about the same volume")
+var flagMPVLogfile = flag.String("mpv-logfile", "", "write the log of libmpv to this file")
+var flagCachePause = flag.Bool("cache-pause", true, "pause to buffer when the cache runs empty, instead of stuttering")
+var flagCachePauseWait = flag.Duration("cache-pause-wait", 2*time.Second, "how much audio to buffer before resuming after pausing to buffer")
+var flagAOPCM = flag.String("ao-pcm", "", "write the audio as raw PCM to this file (e.g. a named pipe) instead of playing it")
+var flagPCMSampleRate = flag.Int("pcm-samplerate", 48000, "sample rate in Hz of the audio written with -ao-pcm")
+var flagPCMChannels = flag.Int("pcm-channels", 2, "number of channels of the audio written with -ao-pcm")
+var flagPCMFormat = flag.String("pcm-format", "s16", "sample format of the audio written with -ao-pcm, as accepted by the audio-format option of mpv (e.g. s16, s32, float)")
 
 // New creates a new MPV instance and initializes the libmpv player
-func (mpv *MPV) initialize() (chan State, int) {
+func (mpv *MPV) initialize() (chan State, int, error) {
 	if mpv.handle != nil || mpv.running {
 		panic("already initialized")
 	}
 
-	mpv.mainloopExit = make(chan struct{})
-	mpv.running = true
+	initialVolume, err := savedVolume()
+	if err != nil {
+		return nil, 0, err
+	}
 
 	mpv.handle = C.mpv_create()
+	if mpv.handle == nil {
+		return nil, 0, errors.New("mpv: could not create player")
+	}
 
-	conf := config.Get()
-	initialVolume, err := conf.GetInt("player.mpv.volume", func() (int, error) {
-		return INITIAL_VOLUME, nil
-	})
+	err = mpv.setOptions(initialVolume)
 	if err != nil {
-		// should not happen
-		panic(err)
+		C.mpv_terminate_destroy(mpv.handle)
+		mpv.handle = nil
+		return nil, 0, err
 	}
 
-	mpv.setOptionFlag("resume-playback", false)
-	//mpv.setOptionString("softvol", "yes")
-	//mpv.setOptionString("ao", "pulse")
-	mpv.setOptionInt("volume", initialVolume)
-
-	// Disable video in three ways.
-	mpv.setOptionFlag("video", false)
-	mpv.setOptionString("vo", "null")
-	mpv.setOptionString("vid", "no")
+	// This fails for example when the audio output can't be opened.
+	if status := C.mpv_initialize(mpv.handle); status < 0 {
+		C.mpv_terminate_destroy(mpv.handle)
+		mpv.handle = nil
+		return nil, 0, errors.New("mpv: could not initialize: " + C.GoString(C.mpv_error_string(status)))
+	}
 
-	// Cache settings assume 128kbps audio stream (16kByte/s).
-	// The default is a cache size of 25MB, these are somewhat more sensible
-	// cache sizes IMO.
-	mpv.setOptionInt("cache-default", 160) // 10 seconds
-	mpv.setOptionInt("cache-seek-min", 16) // 1 second
+	if *flagMPVLogfile != "" {
+		// Log to a file instead of the terminal, so the log doesn't get mixed
+		// with our own output.
+		mpv.logFile, err = os.OpenFile(*flagMPVLogfile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			C.mpv_terminate_destroy(mpv.handle)
+			mpv.handle = nil
+			return nil, 0, err
+		}
+		cLevel := C.CString("v")
+		defer C.free(unsafe.Pointer(cLevel))
+		mpv.checkError(C.mpv_request_log_messages(mpv.handle, cLevel))
+	}
 
-	// Some extra debugging information, but don't read from stdin.
-	// libmpv has a problem with signal handling, though: when `terminal` is
-	// true, Ctrl+C doesn't work correctly anymore and program output is
-	// disabled.
-	mpv.setOptionFlag("terminal", *logLibMPV)
-	mpv.setOptionFlag("input-terminal", false)
-	mpv.setOptionFlag("quiet", true)
+	// Playing and pausing are derived from these properties, see
+	// eventHandler.
+	mpv.observeFlag(OBSERVE_PAUSE, "pause")
+	mpv.observeFlag(OBSERVE_CORE_IDLE, "core-idle")
+	mpv.observeFlag(OBSERVE_IDLE_ACTIVE, "idle-active")
 
-	mpv.checkError(C.mpv_initialize(mpv.handle))
+	mpv.mainloopExit = make(chan struct{})
+	mpv.runningMutex.Lock()
+	mpv.running = true
+	mpv.runningMutex.Unlock()
 
 	eventChan := make(chan State)
 
 	go mpv.eventHandler(eventChan)
 
-	return eventChan, initialVolume
+	return eventChan, initialVolume, nil
 }
 
 // Function quit quits the player.
@@ -117,42 +143,166 @@ func (mpv *MPV) quit() {
 	handle := mpv.handle
 	mpv.handle = nil // make it easier to catch race conditions
 	C.mpv_terminate_destroy(handle)
+
+	if mpv.logFile != nil {
+		mpv.logFile.Close()
+		mpv.logFile = nil
+	}
+}
+
+// setOptions sets the options of the player, before it is initialized. It
+// returns an error for the first option that mpv doesn't accept.
+func (mpv *MPV) setOptions(initialVolume int) error {
+	var err error
+	// set keeps the first error, so the options can be set one after another.
+	set := func(optionErr error) {
+		if err == nil {
+			err = optionErr
+		}
+	}
+
+	set(mpv.trySetOptionFlag("resume-playback", false))
+	// Stay alive when nothing is playing. This is the default for libmpv, but
+	// the event handler relies on it.
+	set(mpv.trySetOptionString("idle", "yes"))
+	//mpv.setOptionString("softvol", "yes")
+	//mpv.setOptionString("ao", "pulse")
+	set(mpv.trySetOptionInt("volume", curvedVolume(initialVolume)))
+
+	if *flagNormalize {
+		// YouTube streams don't have ReplayGain tags, so use a dynamic filter.
+		// The volume is applied after the audio filters, so the volume
+		// control keeps working as usual.
+		set(mpv.trySetOptionString("af", "lavfi=[dynaudnorm]"))
+	}
+
+	if *flagAOPCM != "" {
+		set(mpv.setPCMOutput())
+	}
+
+	if *flagVideo {
+		// Let mpv pick a video output, and fill the screen.
+		set(mpv.trySetOptionFlag("fullscreen", true))
+	} else {
+		// Disable video in three ways.
+		set(mpv.trySetOptionFlag("video", false))
+		set(mpv.trySetOptionString("vo", "null"))
+		set(mpv.trySetOptionString("vid", "no"))
+	}
+
+	// Cache settings assume 128kbps audio stream (16kByte/s).
+	// The default is a cache size of 25MB, these are somewhat more sensible
+	// cache sizes IMO.
+	set(mpv.trySetOptionInt("cache-default", 160)) // 10 seconds
+	set(mpv.trySetOptionInt("cache-seek-min", 16)) // 1 second
+
+	// Pause to buffer when the cache runs empty, and resume when enough has
+	// been buffered. This sounds a lot better than stuttering on slow
+	// connections. Newer versions of mpv take the amount to buffer in
+	// seconds, older versions in kilobytes.
+	set(mpv.trySetOptionFlag("cache-pause", *flagCachePause))
+	if *flagCachePause {
+		wait := strconv.FormatFloat(flagCachePauseWait.Seconds(), 'f', -1, 64)
+		if mpv.trySetOptionString("cache-pause-wait", wait) != nil {
+			kbytes := int(flagCachePauseWait.Seconds()*16 + 0.5)
+			if mpv.trySetOptionString("cache-pause-restart", strconv.Itoa(kbytes)) != nil {
+				mpvLogger.Warnln("this mpv version doesn't support -cache-pause-wait")
+			}
+		}
+	}
+
+	// Some extra debugging information, but don't read from stdin.
+	// libmpv has a problem with signal handling, though: when `terminal` is
+	// true, Ctrl+C doesn't work correctly anymore and program output is
+	// disabled.
+	set(mpv.trySetOptionFlag("terminal", *logLibMPV))
+	set(mpv.trySetOptionFlag("input-terminal", false))
+	set(mpv.trySetOptionFlag("quiet", true))
+
+	return err
 }
 
-// setOptionFlag passes a boolean flag to mpv
-func (mpv *MPV) setOptionFlag(key string, value bool) {
+// trySetOptionFlag passes a boolean flag to mpv.
+func (mpv *MPV) trySetOptionFlag(key string, value bool) error {
 	cValue := C.int(0)
 	if value {
 		cValue = 1
 	}
 
-	mpv.setOption(key, C.MPV_FORMAT_FLAG, unsafe.Pointer(&cValue))
+	return mpv.trySetOption(key, C.MPV_FORMAT_FLAG, unsafe.Pointer(&cValue))
 }
 
-// setOptionInt passes an integer option to mpv
-func (mpv *MPV) setOptionInt(key string, value int) {
+// trySetOptionInt passes an integer option to mpv.
+func (mpv *MPV) trySetOptionInt(key string, value int) error {
 	cValue := C.int64_t(value)
-	mpv.setOption(key, C.MPV_FORMAT_INT64, unsafe.Pointer(&cValue))
+	return mpv.trySetOption(key, C.MPV_FORMAT_INT64, unsafe.Pointer(&cValue))
+}
+
+// setPCMOutput sets the options to write raw PCM audio to the -ao-pcm file, in
+// the format set with the -pcm-* flags.
+func (mpv *MPV) setPCMOutput() error {
+	if *flagPCMSampleRate <= 0 {
+		return fmt.Errorf("mpv: invalid -pcm-samplerate %d", *flagPCMSampleRate)
+	}
+	if *flagPCMChannels <= 0 {
+		return fmt.Errorf("mpv: invalid -pcm-channels %d", *flagPCMChannels)
+	}
+
+	for _, err := range []error{
+		mpv.trySetOptionString("ao", "pcm"),
+		mpv.trySetOptionString("ao-pcm-file", *flagAOPCM),
+		mpv.trySetOptionFlag("ao-pcm-waveheader", false),
+		mpv.trySetOptionInt("audio-samplerate", *flagPCMSampleRate),
+		mpv.trySetOptionString("audio-channels", strconv.Itoa(*flagPCMChannels)),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if mpv.trySetOptionString("audio-format", *flagPCMFormat) != nil {
+		return fmt.Errorf("mpv: unsupported -pcm-format %q", *flagPCMFormat)
+	}
+	return nil
 }
 
-// setOptionString passes a string option to mpv
-func (mpv *MPV) setOptionString(key, value string) {
+// trySetOptionString passes a string option to mpv, which is parsed like an
+// option on the command line.
+func (mpv *MPV) trySetOptionString(key, value string) error {
+	cKey := C.CString(key)
+	defer C.free(unsafe.Pointer(cKey))
 	cValue := C.CString(value)
 	defer C.free(unsafe.Pointer(cValue))
 
-	mpv.setOption(key, C.MPV_FORMAT_STRING, unsafe.Pointer(&cValue))
+	return optionError(key, C.mpv_set_option_string(mpv.handle, cKey, cValue))
 }
 
-// setOption is a generic function to pass options to mpv
-func (mpv *MPV) setOption(key string, format C.mpv_format, value unsafe.Pointer) {
+// trySetOption is a generic function to pass options to mpv. Instead of
+// panicking, it returns an error when mpv doesn't accept the option (e.g.
+// because this version of mpv doesn't know it).
+func (mpv *MPV) trySetOption(key string, format C.mpv_format, value unsafe.Pointer) error {
 	cKey := C.CString(key)
 	defer C.free(unsafe.Pointer(cKey))
 
-	mpv.checkError(C.mpv_set_option(mpv.handle, cKey, format, value))
+	return optionError(key, C.mpv_set_option(mpv.handle, cKey, format, value))
+}
+
+// optionError returns an error for a failed mpv_set_option call, or nil.
+func optionError(key string, status C.int) error {
+	if status < 0 {
+		return fmt.Errorf("mpv: could not set option %s: %s", key, C.GoString(C.mpv_error_string(status)))
+	}
+	return nil
 }
 
 // sendCommand sends a command to the libmpv player
 func (mpv *MPV) sendCommand(command []string) {
+	mpv.checkError(mpv.sendCommandStatus(command))
+}
+
+// sendCommandStatus sends a command without waiting for it to finish. It
+// returns the libmpv status of submitting the command, which is negative when
+// the command is invalid.
+func (mpv *MPV) sendCommandStatus(command []string) C.int {
 	// Print command, but without the stream
 	cmd := make([]string, len(command))
 	copy(cmd, command)
@@ -173,7 +323,16 @@ func (mpv *MPV) sendCommand(command []string) {
 		defer C.free(unsafe.Pointer(cStr))
 	}
 
-	mpv.checkError(C.mpv_command_async(mpv.handle, 0, cArray))
+	return C.mpv_command_async(mpv.handle, 0, cArray)
+}
+
+// observeFlag asks mpv to send MPV_EVENT_PROPERTY_CHANGE events with the given
+// ID when the boolean property changes.
+func (mpv *MPV) observeFlag(id uint64, name string) {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	mpv.checkError(C.mpv_observe_property(mpv.handle, C.uint64_t(id), cName, C.MPV_FORMAT_FLAG))
 }
 
 // getProperty returns the MPV player property as a string
@@ -196,6 +355,45 @@ func (mpv *MPV) getProperty(name string) (float64, error) {
 	return float64(cValue), nil
 }
 
+// getPropertyFlag returns the boolean MPV player property.
+// The same warning as for getProperty applies.
+func (mpv *MPV) getPropertyFlag(name string) (bool, error) {
+	logger.Printf("MPV get property: %s\n", name)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cValue C.int
+	status := C.mpv_get_property(mpv.handle, cName, C.MPV_FORMAT_FLAG, unsafe.Pointer(&cValue))
+	if status == C.MPV_ERROR_PROPERTY_UNAVAILABLE {
+		return false, MPV_PROPERTY_UNAVAILABLE
+	} else if status != 0 {
+		return false, errors.New("mpv: " + C.GoString(C.mpv_error_string(status)))
+	}
+
+	return cValue != 0, nil
+}
+
+// getPropertyString returns the MPV player property as a string.
+// The same warning as for getProperty applies.
+func (mpv *MPV) getPropertyString(name string) (string, error) {
+	logger.Printf("MPV get property: %s\n", name)
+
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	var cValue *C.char
+	status := C.mpv_get_property(mpv.handle, cName, C.MPV_FORMAT_STRING, unsafe.Pointer(&cValue))
+	if status == C.MPV_ERROR_PROPERTY_UNAVAILABLE {
+		return "", MPV_PROPERTY_UNAVAILABLE
+	} else if status != 0 {
+		return "", errors.New("mpv: " + C.GoString(C.mpv_error_string(status)))
+	}
+	defer C.mpv_free(unsafe.Pointer(cValue))
+
+	return C.GoString(cValue), nil
+}
+
 // setProperty sets the MPV player property
 func (mpv *MPV) setProperty(name, value string) {
 	logger.Printf("MPV set property: %s=%s\n", name, value)
@@ -212,13 +410,20 @@ func (mpv *MPV) setProperty(name, value string) {
 	mpv.checkError(C.mpv_set_property_async(mpv.handle, 1, cName, C.MPV_FORMAT_STRING, unsafe.Pointer(&cValue)))
 }
 
-func (mpv *MPV) play(stream string, position time.Duration, volume int) {
+// play loads the stream. It returns an error when the stream could not be
+// loaded at all. Errors while playing (e.g. an expired URL) are reported
+// later, as a stopped event.
+func (mpv *MPV) play(stream string, position, end time.Duration, volume int) error {
 	options := "pause=no"
 
 	if position != 0 {
 		options += fmt.Sprintf(",start=%.3f", position.Seconds())
 	}
 
+	if end != 0 {
+		options += fmt.Sprintf(",end=%.3f", end.Seconds())
+	}
+
 	if volume >= 0 {
 		options += fmt.Sprintf(",volume=%d", volume)
 	}
@@ -228,10 +433,21 @@ func (mpv *MPV) play(stream string, position time.Duration, volume int) {
 	// a better HTTPS implementation, which is used here as a workaround.
 	// This libav/libnettle combination is in use on Debian jessie. FFmpeg
 	// doesn't have a problem with it.
-	if !strings.HasPrefix(stream, "https://") {
-		logger.Panic("Stream does not start with https://...")
+	// Plain HTTP streams don't need the workaround, and are played directly.
+	var streamURL string
+	switch {
+	case strings.HasPrefix(stream, "https://"):
+		streamURL = getProxyURL(stream)
+	case strings.HasPrefix(stream, "http://"):
+		streamURL = stream
+	default:
+		return errors.New("mpv: unsupported URL scheme in stream: " + stream)
+	}
+	status := mpv.sendCommandStatus([]string{"loadfile", streamURL, "replace", options})
+	if status < 0 {
+		return errors.New("mpv: could not load stream: " + C.GoString(C.mpv_error_string(status)))
 	}
-	mpv.sendCommand([]string{"loadfile", "http://localhost:8008/proxy/" + stream[len("https://"):], "replace", options})
+	return nil
 }
 
 func (mpv *MPV) pause() {
@@ -271,6 +487,45 @@ func (mpv *MPV) getPosition() (time.Duration, error) {
 	return time.Duration(position * float64(time.Second)), nil
 }
 
+// getState returns the state mpv is actually in, which may differ from the
+// state derived from events when an event got lost.
+func (mpv *MPV) getState() (State, error) {
+	idle, err := mpv.getPropertyFlag("idle-active")
+	if err != nil {
+		return STATE_STOPPED, err
+	}
+	if idle {
+		return STATE_STOPPED, nil
+	}
+
+	seeking, err := mpv.getPropertyFlag("seeking")
+	if err != nil {
+		return STATE_STOPPED, err
+	}
+	if seeking {
+		return STATE_SEEKING, nil
+	}
+
+	paused, err := mpv.getPropertyFlag("pause")
+	if err != nil {
+		return STATE_STOPPED, err
+	}
+	if paused {
+		return STATE_PAUSED, nil
+	}
+
+	// Not paused, but playback isn't progressing: waiting for the network.
+	coreIdle, err := mpv.getPropertyFlag("core-idle")
+	if err != nil {
+		return STATE_STOPPED, err
+	}
+	if coreIdle {
+		return STATE_BUFFERING, nil
+	}
+
+	return STATE_PLAYING, nil
+}
+
 func (mpv *MPV) setPosition(position time.Duration) {
 	mpv.sendCommand([]string{"seek", fmt.Sprintf("%.3f", position.Seconds()), "absolute"})
 }
@@ -287,7 +542,62 @@ func (mpv *MPV) getVolume() int {
 
 func (mpv *MPV) setVolume(volume int) {
 	mpv.setProperty("volume", strconv.Itoa(volume))
-	config.Get().SetInt("player.mpv.volume", volume)
+}
+
+// getBufferingProgress returns how far the cache has been filled before
+// playback (re)starts, in percent.
+func (mpv *MPV) getBufferingProgress() (int, error) {
+	progress, err := mpv.getProperty("cache-buffering-state")
+	if err == MPV_PROPERTY_UNAVAILABLE {
+		return 0, PROPERTY_UNAVAILABLE
+	} else if err != nil {
+		return 0, err
+	}
+	return int(progress + 0.5), nil
+}
+
+// getAudioTracks returns the audio tracks of the current file, read from the
+// track-list property.
+func (mpv *MPV) getAudioTracks() ([]AudioTrack, error) {
+	count, err := mpv.getProperty("track-list/count")
+	if err == MPV_PROPERTY_UNAVAILABLE {
+		return nil, PROPERTY_UNAVAILABLE
+	} else if err != nil {
+		return nil, err
+	}
+
+	var tracks []AudioTrack
+	for i := 0; i < int(count); i++ {
+		prefix := "track-list/" + strconv.Itoa(i) + "/"
+		trackType, err := mpv.getPropertyString(prefix + "type")
+		if err != nil {
+			return nil, err
+		}
+		if trackType != "audio" {
+			continue
+		}
+
+		track := AudioTrack{}
+		id, err := mpv.getProperty(prefix + "id")
+		if err != nil {
+			return nil, err
+		}
+		track.Id = int(id)
+		track.Selected, err = mpv.getPropertyFlag(prefix + "selected")
+		if err != nil {
+			return nil, err
+		}
+		// lang and title are only available when the file specifies them
+		track.Lang, _ = mpv.getPropertyString(prefix + "lang")
+		track.Title, _ = mpv.getPropertyString(prefix + "title")
+		tracks = append(tracks, track)
+	}
+
+	return tracks, nil
+}
+
+func (mpv *MPV) setAudioTrack(id int) {
+	mpv.setProperty("aid", strconv.Itoa(id))
 }
 
 func (mpv *MPV) stop() {
@@ -296,6 +606,24 @@ func (mpv *MPV) stop() {
 
 // playerEventHandler waits for libmpv player events and sends them on a channel
 func (mpv *MPV) eventHandler(eventChan chan State) {
+	// Whether mpv is idle (no file is loaded). Events like 'playback-restart'
+	// and property changes sometimes arrive after a file has stopped playing
+	// (for example when setting pause=no right before the end of a stream).
+	// They do not make sense while idle, so they are dropped here.
+	idle := true
+
+	// Observed properties. The player is playing when a file is loaded and
+	// core-idle is false, which is more reliable than the (deprecated)
+	// pause/unpause events: those don't tell whether audio is actually
+	// playing or mpv is still buffering.
+	paused := false
+	coreIdle := true
+	idleActive := true
+
+	// The last state derived from the properties, to only send changes.
+	// Reset when a file ends, so the next file starts fresh.
+	var lastState State = STATE_STOPPED
+
 	for {
 		// wait until there is an event (negative timeout means infinite timeout)
 		// The timeout is 1 second to work around libmpv bug #1372 (mpv_wakeup
@@ -305,7 +633,7 @@ func (mpv *MPV) eventHandler(eventChan chan State) {
 		// release. Check for the problematic versions and keep the old behavior
 		// for older MPV versions.
 		event := C.mpv_wait_event(mpv.handle, 1)
-		if event.event_id != C.MPV_EVENT_NONE {
+		if event.event_id != C.MPV_EVENT_NONE && event.event_id != C.MPV_EVENT_LOG_MESSAGE {
 			logger.Printf("MPV event: %s (%d)\n", C.GoString(C.mpv_event_name(event.event_id)), int(event.event_id))
 		}
 
@@ -324,18 +652,83 @@ func (mpv *MPV) eventHandler(eventChan chan State) {
 		}
 
 		switch event.event_id {
+		case C.MPV_EVENT_LOG_MESSAGE:
+			mpv.writeLogMessage((*C.mpv_event_log_message)(event.data))
+		case C.MPV_EVENT_START_FILE:
+			idle = false
+			lastState = STATE_STOPPED
+		case C.MPV_EVENT_IDLE:
+			idle = true
+			lastState = STATE_STOPPED
 		case C.MPV_EVENT_PLAYBACK_RESTART:
+			// Sent after loading a file and after seeking. The player relies
+			// on it to know a seek has finished, so it is always passed on,
+			// even when the derived state doesn't change.
+			if idle {
+				mpvLogger.Println("ignoring playback-restart while idle")
+				break
+			}
+			if !paused {
+				lastState = STATE_PLAYING
+			}
 			eventChan <- STATE_PLAYING
+		case C.MPV_EVENT_PROPERTY_CHANGE:
+			property := (*C.mpv_event_property)(event.data)
+			if property.format != C.MPV_FORMAT_FLAG {
+				// Property unavailable, e.g. while no file is loaded.
+				break
+			}
+			value := *(*C.int)(property.data) != 0
+			switch event.reply_userdata {
+			case OBSERVE_PAUSE:
+				paused = value
+			case OBSERVE_CORE_IDLE:
+				coreIdle = value
+			case OBSERVE_IDLE_ACTIVE:
+				idleActive = value
+			}
+
+			if idle || idleActive {
+				// Nothing is playing, see above.
+				break
+			}
+			state := lastState
+			if paused {
+				state = STATE_PAUSED
+			} else if !coreIdle {
+				state = STATE_PLAYING
+			}
+			// Otherwise, mpv is buffering or seeking: wait until it
+			// actually plays.
+			if state != lastState {
+				lastState = state
+				eventChan <- state
+			}
 		case C.MPV_EVENT_END_FILE:
+			idle = true
+			lastState = STATE_STOPPED
+			endFile := (*C.mpv_event_end_file)(event.data)
+			if endFile.reason == C.MPV_END_FILE_REASON_STOP || endFile.reason == C.MPV_END_FILE_REASON_REDIRECT {
+				// Stopped by us, either with 'stop' or by loading another
+				// file. The player already knows, and it must be able to
+				// tell this apart from a stream that fails to load.
+				mpvLogger.Println("ignoring end-file after stop")
+				break
+			}
 			eventChan <- STATE_STOPPED
-		case C.MPV_EVENT_PAUSE:
-			eventChan <- STATE_PAUSED
-		case C.MPV_EVENT_UNPAUSE:
-			eventChan <- STATE_PLAYING
 		}
 	}
 }
 
+// writeLogMessage writes a libmpv log message to the log file.
+func (mpv *MPV) writeLogMessage(message *C.mpv_event_log_message) {
+	if mpv.logFile == nil {
+		return
+	}
+	// The text already ends in a newline.
+	fmt.Fprintf(mpv.logFile, "%s [%s] %s: %s", time.Now().Format(log.TIME_FORMAT), C.GoString(message.prefix), C.GoString(message.level), C.GoString(message.text))
+}
+
 // checkError checks for libmpv errors and panics if it finds one
 func (mpv *MPV) checkError(status C.int) {
 	if status < 0 {
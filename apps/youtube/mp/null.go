@@ -0,0 +1,258 @@
+package mp
+
+import (
+	"sync"
+	"time"
+)
+
+// Duration of every stream played by the Null backend, as it doesn't load the
+// stream to find out.
+const NULL_DURATION = 3 * time.Minute
+
+// Null is an implementation of Backend that doesn't play anything. It only
+// keeps track of the state and the position, as if it was playing. This is
+// useful for troubleshooting, e.g. on a system without audio output.
+type Null struct {
+	mutex     sync.Mutex
+	events    chan State
+	pending   []State       // events waiting to be sent by deliverEvents
+	wake      chan struct{} // wakes up deliverEvents, 1-buffered
+	quitting  bool          // no more events are queued after quit
+	state     State
+	position  time.Duration // position at startTime
+	startTime time.Time     // when the position was last updated, while playing
+	duration  time.Duration // duration of every stream, NULL_DURATION unless changed in tests
+	end       time.Duration // end position given to play(), 0 if none
+	volume    int
+	endTimer  *time.Timer // stops playback at the end of the stream or the end position given to play()
+}
+
+func (n *Null) initialize() (chan State, int, error) {
+	volume, err := savedVolume()
+	if err != nil {
+		return nil, 0, err
+	}
+	n.volume = volume
+	if n.duration == 0 {
+		n.duration = NULL_DURATION
+	}
+
+	// Events are sent from within calls by the MediaPlayer, which holds the
+	// PlayState the event loop needs. So they're sent from a separate
+	// goroutine, in order, and never while holding the mutex.
+	n.events = make(chan State)
+	n.wake = make(chan struct{}, 1)
+	go n.deliverEvents()
+	return n.events, n.volume, nil
+}
+
+func (n *Null) quit() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.stopTimer()
+	n.quitting = true
+	n.wakeUp()
+}
+
+// queueEvent queues an event to be sent to the MediaPlayer. Events after quit
+// are dropped. It must be called with the mutex held.
+func (n *Null) queueEvent(state State) {
+	if n.quitting {
+		return
+	}
+	n.pending = append(n.pending, state)
+	n.wakeUp()
+}
+
+// wakeUp wakes up deliverEvents, without blocking.
+func (n *Null) wakeUp() {
+	select {
+	case n.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverEvents runs in a goroutine and sends the queued events. After quit,
+// it closes the events channel, which stops the MediaPlayer.
+func (n *Null) deliverEvents() {
+	for range n.wake {
+		for {
+			n.mutex.Lock()
+			if len(n.pending) == 0 {
+				quitting := n.quitting
+				n.mutex.Unlock()
+				if quitting {
+					close(n.events)
+					return
+				}
+				break
+			}
+			state := n.pending[0]
+			n.pending = n.pending[1:]
+			n.mutex.Unlock()
+
+			n.events <- state
+		}
+	}
+}
+
+// currentPosition returns the position. It must be called with the mutex held.
+func (n *Null) currentPosition() time.Duration {
+	if n.state == STATE_PLAYING {
+		return n.position + time.Since(n.startTime)
+	}
+	return n.position
+}
+
+// stopTimer stops the end timer, if any. It must be called with the mutex held.
+func (n *Null) stopTimer() {
+	if n.endTimer != nil {
+		n.endTimer.Stop()
+		n.endTimer = nil
+	}
+}
+
+// startTimer starts the timer that stops playback at end. It must be called
+// with the mutex held, while playing.
+func (n *Null) startTimer(end time.Duration) {
+	n.stopTimer()
+	if end <= 0 || end > n.duration {
+		end = n.duration
+	}
+	remaining := end - n.currentPosition()
+	if remaining < 0 {
+		remaining = 0
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(remaining, func() {
+		n.mutex.Lock()
+		defer n.mutex.Unlock()
+
+		if n.endTimer != timer {
+			// stopped or restarted in the meantime
+			return
+		}
+		n.endTimer = nil
+		n.state = STATE_STOPPED
+		n.position = 0
+		n.queueEvent(STATE_STOPPED)
+	})
+	n.endTimer = timer
+}
+
+func (n *Null) play(stream string, position, end time.Duration, volume int) error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	logger.Println("Null backend: play from", position)
+
+	if volume != -1 {
+		n.volume = volume
+	}
+	n.state = STATE_PLAYING
+	n.position = position
+	n.startTime = time.Now()
+	n.end = end
+	n.startTimer(end)
+	n.queueEvent(STATE_PLAYING)
+	return nil
+}
+
+func (n *Null) pause() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != STATE_PLAYING {
+		return
+	}
+	n.position = n.currentPosition()
+	n.state = STATE_PAUSED
+	n.stopTimer()
+	n.queueEvent(STATE_PAUSED)
+}
+
+func (n *Null) resume() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state != STATE_PAUSED {
+		return
+	}
+	n.state = STATE_PLAYING
+	n.startTime = time.Now()
+	n.startTimer(n.end)
+	n.queueEvent(STATE_PLAYING)
+}
+
+func (n *Null) getDuration() (time.Duration, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state == STATE_STOPPED {
+		return 0, PROPERTY_UNAVAILABLE
+	}
+	return n.duration, nil
+}
+
+func (n *Null) getPosition() (time.Duration, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state == STATE_STOPPED {
+		return 0, PROPERTY_UNAVAILABLE
+	}
+	return n.currentPosition(), nil
+}
+
+func (n *Null) getState() (State, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.state, nil
+}
+
+func (n *Null) getBufferingProgress() (int, error) {
+	// Nothing is ever buffered.
+	return 0, PROPERTY_UNAVAILABLE
+}
+
+func (n *Null) setPosition(position time.Duration) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.state == STATE_STOPPED {
+		return
+	}
+	n.position = position
+	n.startTime = time.Now()
+	if n.state == STATE_PLAYING {
+		n.startTimer(n.end)
+	}
+	// Like mpv, report that playback has restarted after seeking.
+	n.queueEvent(STATE_PLAYING)
+}
+
+func (n *Null) setVolume(volume int) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	n.volume = volume
+}
+
+func (n *Null) getAudioTracks() ([]AudioTrack, error) {
+	return nil, nil
+}
+
+func (n *Null) setAudioTrack(id int) {
+}
+
+func (n *Null) stop() {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	// Like mpv, don't report a stop that was requested.
+	n.stopTimer()
+	n.state = STATE_STOPPED
+	n.position = 0
+}
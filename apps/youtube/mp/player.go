@@ -1,7 +1,14 @@
 package mp
 
 import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/aykevl/plaincast/clock"
+	"github.com/aykevl/plaincast/config"
 )
 
 // A generic YouTube media player using a playlist.
@@ -13,40 +20,134 @@ type MediaPlayer struct {
 	// The pointer to the PlayState is used as an access token.
 	playstateChan chan PlayState
 
+	// Channels for which a RequestPlaylist is waiting to be handled.
+	pendingRequests      map[chan PlaylistState]bool
+	pendingRequestsMutex sync.Mutex
+
 	vg *VideoGrabber
+
+	// Remembered positions for -resume-positions (nil when disabled). Only
+	// used with access to the PlayState.
+	positions *resumePositions
+
+	// Incremented on every playlist change, to stop fetching metadata for
+	// the old playlist. Must be accessed atomically.
+	metadataGeneration uint32
+
+	// All timers and delays use this clock, which is replaced in tests.
+	clock clock.Clock
+}
+
+// New creates a new MediaPlayer with the backend selected with -backend. When
+// a list of backends is given, the first one that initializes is used. It
+// returns an error when no backend could be initialized.
+func New(stateChange chan StateChange) (*MediaPlayer, error) {
+	return newMediaPlayer(stateChange, clock.Real)
 }
 
-func New(stateChange chan StateChange) *MediaPlayer {
+// newMediaPlayer is New with the clock to use, which is a fake clock in tests.
+func newMediaPlayer(stateChange chan StateChange, clk clock.Clock) (*MediaPlayer, error) {
+	if *flagVolumeCurve != VOLUME_CURVE_LINEAR && *flagVolumeCurve != VOLUME_CURVE_LOG {
+		return nil, fmt.Errorf("unknown -volume-curve %q, expected %s or %s", *flagVolumeCurve, VOLUME_CURVE_LINEAR, VOLUME_CURVE_LOG)
+	}
+
+	maxVolumeOnce.Do(func() {
+		loadMaxVolume()
+		config.OnReload(reloadMaxVolume)
+	})
+
 	p := MediaPlayer{}
+	p.clock = clk
 	p.stateChange = stateChange
 	p.playstateChan = make(chan PlayState)
-	p.vg = NewVideoGrabber()
+	p.pendingRequests = make(map[chan PlaylistState]bool)
+
+	var playerEventChan chan State
+	var initialVolume int
+	var err error
+	for _, name := range strings.Split(*flagBackend, ",") {
+		name = strings.TrimSpace(name)
+		newBackend, ok := backends[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown backend %q, available backends: %s", name, backendNames())
+		}
+		p.player = newBackend()
+		playerEventChan, initialVolume, err = p.player.initialize()
+		if err != nil {
+			logger.Warnf("could not initialize backend %s: %s\n", name, err)
+			continue
+		}
+		logger.Println("Using backend:", name)
+		break
+	}
+	if err != nil {
+		return nil, fmt.Errorf("no backend could be initialized (tried %s), last error: %s", *flagBackend, err)
+	}
+
+	p.vg = newVideoGrabber(clk)
+
+	if *flagResumePositions {
+		p.positions = loadResumePositions()
+	}
 
-	p.player = &MPV{}
-	playerEventChan, initialVolume := p.player.initialize()
+	playersMutex.Lock()
+	players[&p] = struct{}{}
+	playersMutex.Unlock()
 
 	// Start the mainloop.
 	go p.run(playerEventChan, initialVolume)
 
-	return &p
+	return &p, nil
+}
+
+// Ready returns true if the player can play videos: the backend has been
+// initialized (see New) and the video grabber is running.
+func (p *MediaPlayer) Ready() bool {
+	return p.vg.Running()
 }
 
 // Quit quits the MediaPlayer.
 // No other method may be called upon this object after this function has been
 // called.
 func (p *MediaPlayer) Quit() {
+	playersMutex.Lock()
+	delete(players, p)
+	playersMutex.Unlock()
+
 	p.getPlayState(func(ps *PlayState) {
 		p.player.quit()
 		p.vg.Quit()
 	})
 }
 
+// tryGetPosition is like getPosition, but doesn't panic when the backend
+// can't tell the position (e.g. right after a stream ended). It then returns
+// the buffering position, or the last known position. It is meant for
+// diagnostics and control that shouldn't crash the player.
+func (p *MediaPlayer) tryGetPosition(ps *PlayState) time.Duration {
+	if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+		return p.getPosition(ps)
+	}
+	position, err := p.player.getPosition()
+	if err != nil {
+		logger.Warnln("could not get position:", err)
+		if ps.bufferingPosition >= 0 {
+			return ps.bufferingPosition
+		}
+		return ps.lastPosition
+	}
+	if position < 0 {
+		return 0
+	}
+	return position
+}
+
 func (p *MediaPlayer) getPosition(ps *PlayState) time.Duration {
 	var position time.Duration
 
 	switch ps.State {
 	case STATE_STOPPED:
-		position = 0
+		position = ps.stoppedPosition
 	case STATE_BUFFERING, STATE_SEEKING:
 		position = ps.bufferingPosition
 	case STATE_PLAYING, STATE_PAUSED:
@@ -74,11 +175,27 @@ func (p *MediaPlayer) getPosition(ps *PlayState) time.Duration {
 }
 
 
-func (p *MediaPlayer) getDuration() time.Duration {
+func (p *MediaPlayer) getDuration(ps *PlayState) time.Duration {
+	if ps.State == STATE_BUFFERING && !ps.streamLoaded {
+		// The backend may still have the previous video loaded, and asking
+		// it would only delay reporting that the new video is buffering.
+		return ps.metadataDuration
+	}
+
 	duration, err := p.player.getDuration()
 	if err != nil {
+		if ps.metadataDuration != 0 {
+			// The player doesn't know the duration yet (e.g. while
+			// buffering), but the grabber did.
+			return ps.metadataDuration
+		}
+		if ps.lastDuration != 0 {
+			// The video has just ended.
+			return ps.lastDuration
+		}
 		logger.Errln("cannot get duration:", err)
 	}
+	ps.lastDuration = duration
 	return duration // 0 if error
 }
 
@@ -91,14 +208,21 @@ func (p *MediaPlayer) getPlayState(callback func(*PlayState)) {
 		// The player has already stopped. Ignore all function calls.
 		return
 	}
+	// Give back access even when the callback panics, so that the player
+	// can still be stopped after recovering from the panic.
+	defer func() {
+		p.playstateChan <- ps
+	}()
 	callback(&ps)
-	p.playstateChan <- ps
 }
 
 // SetPlaystate changes the play state to the specified arguments
 // This function doesn't block, but changes may not be immediately applied.
 func (p *MediaPlayer) SetPlaystate(playlist []string, index int, position time.Duration, listId string) {
 	p.getPlayState(func(ps *PlayState) {
+		if index < len(playlist) {
+			position = p.resumePosition(playlist[index], position)
+		}
 		if ps.State == STATE_BUFFERING && ps.bufferingPosition == position && ps.Index < len(ps.Playlist) && playlist[index] == ps.Playlist[ps.Index] {
 			// just in case something else has changed, update the playlist
 			p.updatePlaylist(ps, playlist)
@@ -106,7 +230,8 @@ func (p *MediaPlayer) SetPlaystate(playlist []string, index int, position time.D
 		}
 		ps.Playlist = playlist
 		ps.Index = index
-		ps.ListId = listId
+		p.setListId(ps, listId)
+		p.startFetchingMetadata(ps.Playlist)
 
 		if len(ps.Playlist) > 0 {
 			p.startPlaying(ps, position)
@@ -116,6 +241,48 @@ func (p *MediaPlayer) SetPlaystate(playlist []string, index int, position time.D
 	})
 }
 
+// setListId sets the ID of the playlist that is playing, and fetches its title
+// in the background when it changes.
+func (p *MediaPlayer) setListId(ps *PlayState, listId string) {
+	if listId == ps.ListId {
+		return
+	}
+	ps.ListId = listId
+	ps.ListTitle = ""
+	if listId == "" {
+		return
+	}
+
+	videoId := ps.Video()
+	go func() {
+		ps = nil
+
+		p.clock.Sleep(LIST_TITLE_FETCH_DELAY)
+		title, err := p.vg.GetPlaylistTitle(listId, videoId)
+		if err != nil {
+			logger.Warnf("could not get title of playlist %s: %s\n", listId, err)
+			return
+		}
+
+		p.getPlayState(func(ps *PlayState) {
+			if ps.ListId == listId {
+				logger.Printf("Playing playlist %s: %s\n", listId, title)
+				ps.ListTitle = title
+			}
+		})
+	}()
+}
+
+// SetClipEnd sets the position at which playback of videoId should end, to
+// play only a part of a video. It applies until another end position is set.
+// This must be called before the video starts playing.
+func (p *MediaPlayer) SetClipEnd(videoId string, end time.Duration) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.endVideo = videoId
+		ps.End = end
+	})
+}
+
 func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 	if ps.State == STATE_PLAYING {
 		// Pause the currently playing track.
@@ -128,9 +295,30 @@ func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 		//     playing video.
 		p.player.stop()
 	}
-	p.setPlayState(ps, STATE_BUFFERING, position)
-
+	if p.positions != nil {
+		// Store the position of the previous video.
+		p.positions.save()
+	}
 	videoId := ps.Playlist[ps.Index]
+	// Keep the streams of this and the upcoming videos in the cache.
+	p.vg.SetActive(append([]string{videoId, ps.NextVideo()}, prefetchList(ps)...))
+
+	ps.Live = false
+	ps.metadataDuration = 0
+	if metadata, ok := p.vg.GetMetadata(videoId); ok {
+		// Known from prefetching, so the remote can show it right away.
+		ps.metadataDuration = metadata.Duration
+	}
+	ps.lastDuration = 0
+	ps.lastPosition = position
+	ps.eofResumes = 0
+	ps.reloaded = false
+	ps.streamLoaded = false
+	ps.finished = false
+	ps.nextState = -1
+	// Report buffering right away, before the stream has been fetched (which
+	// may take a few seconds), so the remote shows that something happens.
+	p.setPlayState(ps, STATE_BUFFERING, position)
 
 	go func() {
 		// Do not use the playstate inside the goroutine to prevent race conditions.
@@ -138,7 +326,8 @@ func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 		// rule here.
 		ps = nil
 
-		streamUrl := p.vg.GetStream(videoId)
+		stream := p.vg.GetVideoURL(videoId)
+		streamUrl := stream.GetURL()
 
 		// again acquire PlayState access
 		p.getPlayState(func(ps *PlayState) {
@@ -153,24 +342,112 @@ func (p *MediaPlayer) startPlaying(ps *PlayState, position time.Duration) {
 			if streamUrl == "" {
 				// Failed to get a stream.
 				// Try to play the next.
-				logger.Warnln("empty stream URL (error?)")
+				logger.Warnf("cannot play video %s: %s, skipping\n", videoId, stream.Err())
 				p.nextVideo(ps)
 				return
 			}
 
-			volume := -1
-			if ps.newVolume {
-				ps.newVolume = false
-				volume = ps.Volume
+			ps.Live = stream.IsLive()
+			ps.metadataDuration = stream.Duration()
+
+			// Always pass the volume: mpv resets options given to loadfile
+			// when the file ends, so the volume may otherwise jump back to
+			// the volume the player started with.
+			ps.newVolume = false
+			volume := ps.playerVolume()
+
+			// Use the buffering position instead of the initial position: the
+			// user may have seeked while the stream was being fetched.
+			if ps.State == STATE_BUFFERING {
+				position = ps.bufferingPosition
+			}
+
+			end := time.Duration(0)
+			if ps.endVideo == videoId {
+				end = ps.End
+			}
+
+			err := p.player.play(streamUrl, position, end, volume)
+			if err != nil {
+				// Fetch the stream again, or skip the video, without
+				// waiting for a stopped event that may never come.
+				logger.Warnf("could not play video %s: %s\n", videoId, err)
+				p.loadFailed(ps)
+				return
 			}
+			ps.streamLoaded = true
+			ps.streamExpires = stream.Expires()
 
-			p.player.play(streamUrl, position, volume)
+			if next := prefetchList(ps); len(next) > 0 {
+				// Not for single videos or the last video in the playlist.
+				go p.prefetchVideoStreams(next)
+			}
 
-			go p.prefetchVideoStream(ps.NextVideo())
+			p.continueMix(ps)
 		})
 	}()
 }
 
+// continueMix fetches more videos of the mix in the background when the end
+// of the playlist is near, and appends them to the playlist.
+func (p *MediaPlayer) continueMix(ps *PlayState) {
+	if !ps.IsMix() || ps.mixPending || len(ps.Playlist)-ps.Index-1 > MIX_CONTINUE_THRESHOLD {
+		return
+	}
+	ps.mixPending = true
+	listId := ps.ListId
+	lastVideo := ps.Playlist[len(ps.Playlist)-1]
+
+	go func() {
+		ps = nil
+
+		entries, err := p.vg.GetMix(listId, lastVideo)
+
+		p.getPlayState(func(ps *PlayState) {
+			ps.mixPending = false
+			if err != nil {
+				logger.Warnf("could not continue mix %s: %s\n", listId, err)
+				return
+			}
+			if ps.ListId != listId {
+				// Another playlist is playing now.
+				return
+			}
+
+			known := make(map[string]bool, len(ps.Playlist))
+			for _, videoId := range ps.Playlist {
+				known[videoId] = true
+			}
+			playlist := append([]string(nil), ps.Playlist...)
+			for _, videoId := range entries {
+				if !known[videoId] {
+					known[videoId] = true
+					playlist = append(playlist, videoId)
+				}
+			}
+			if len(playlist) == len(ps.Playlist) {
+				logger.Println("No new videos in mix", listId)
+				return
+			}
+
+			logger.Printf("Adding %d videos of mix %s\n", len(playlist)-len(ps.Playlist), listId)
+			p.updatePlaylist(ps, playlist)
+		})
+	}()
+}
+
+// videoEnded is called when the current video has played until the end. It
+// plays the next video, unless -no-autoadvance is set.
+func (p *MediaPlayer) videoEnded(ps *PlayState) {
+	if *flagNoAutoadvance && ps.Index+1 < len(ps.Playlist) {
+		// Stop at the end, like at the end of the playlist. Play() replays
+		// this video, the remote can select the next one.
+		p.setPlayState(ps, STATE_STOPPED, p.getDuration(ps))
+		return
+	}
+	p.nextVideo(ps)
+}
+
 func (p *MediaPlayer) nextVideo(ps *PlayState) {
 	if ps.Index+1 < len(ps.Playlist) {
 		// there are more videos, play the next
@@ -183,45 +460,82 @@ func (p *MediaPlayer) nextVideo(ps *PlayState) {
 		ps.State = STATE_STOPPED
 		p.startPlaying(ps, 0)
 	} else {
-		// signal that the video has stopped playing
-		// this resets the position but keeps the playlist
-		// TODO keep the position at the end, not the beginning
-		p.setPlayState(ps, STATE_STOPPED, 0)
+		// Signal that the video has stopped playing. This keeps the
+		// playlist (which may be a single video) and puts the position at
+		// the end, like YouTube does. Play() restarts the video.
+		p.setPlayState(ps, STATE_STOPPED, p.getDuration(ps))
+		ps.finished = true
 	}
 }
 
-// Prefetch the next video after the current video has played for a
+// prefetchList returns the videos that should be prefetched, as configured
+// with -prefetch.
+func prefetchList(ps *PlayState) []string {
+	n := *flagPrefetch
+	if n > MAX_PREFETCH {
+		n = MAX_PREFETCH
+	}
+	if n <= 0 {
+		return nil
+	}
+	// Copy, as the playlist may be modified in the meantime.
+	return append([]string(nil), ps.NextVideos(n)...)
+}
+
+// Prefetch the next videos after the current video has played for a
 // short while.
 //
 // Warning: start this function in a new goroutine!
-func (p *MediaPlayer) prefetchVideoStream(videoId string) {
-	if videoId == "" {
+func (p *MediaPlayer) prefetchVideoStreams(videoIds []string) {
+	if len(videoIds) == 0 {
 		return
 	}
 
-	time.Sleep(10 * time.Second)
+	p.clock.Sleep(10 * time.Second)
 
 	p.getPlayState(func(ps *PlayState) {
-		next := ps.NextVideo()
-
-		if next == "" || next != videoId {
-			// The playlist has changed in the meantime
-			return
+		upcoming := prefetchList(ps)
+
+		for _, videoId := range videoIds {
+			// Only fetch videos that are still coming up: the playlist may
+			// have changed in the meantime.
+			for _, next := range upcoming {
+				if next == videoId {
+					// Starts fetching in the background, unless the stream
+					// is already cached.
+					p.vg.GetVideoURL(videoId)
+					break
+				}
+			}
 		}
-
-		go p.vg.GetStream(next)
 	})
 }
 
 // setPlayState updates the PlayState and sends events.
 // position may be -1: in that case it will be updated.
 func (p *MediaPlayer) setPlayState(ps *PlayState, state State, position time.Duration) {
-	if ps.State == STATE_BUFFERING || ps.State == STATE_SEEKING {
+	if (ps.State == STATE_BUFFERING || ps.State == STATE_SEEKING) && state != STATE_STOPPED {
 		position = ps.bufferingPosition
+		if state == STATE_PLAYING || state == STATE_PAUSED {
+			// The player may have started at a slightly different position
+			// (e.g. a keyframe) than requested. Report where it really is, so
+			// the scrubber of the remote doesn't jump when the next position
+			// is reported.
+			if fresh, err := p.player.getPosition(); err == nil {
+				position = fresh
+			} else if err != PROPERTY_UNAVAILABLE {
+				logger.Warnln("could not get position after buffering:", err)
+			}
+		}
 	}
 
 	ps.previousState = ps.State
 	ps.State = state
+	ps.stateChanged = p.clock.Now()
+	if state != STATE_PAUSED {
+		// The user has taken over, see AutoPause.
+		ps.autoPaused = false
+	}
 
 	if state == STATE_BUFFERING || state == STATE_SEEKING {
 		ps.bufferingPosition = position
@@ -233,18 +547,29 @@ func (p *MediaPlayer) setPlayState(ps *PlayState, state State, position time.Dur
 		position = p.getPosition(ps)
 	}
 
-	p.stateChange <- StateChange{state, position, p.getDuration()}
+	if state == STATE_PLAYING && ps.previousState == STATE_BUFFERING {
+		ps.playStart = p.clock.Now()
+	}
+
+	if state == STATE_STOPPED {
+		ps.stoppedPosition = position
+	} else {
+		ps.lastPosition = position
+	}
+
+	ps.bufferingProgress = -1
+	p.stateChange <- StateChange{state, position, p.getDuration(ps), ps.Live, ps.Video(), -1}
 }
 
 func (p *MediaPlayer) UpdatePlaylist(playlist []string, listId string) {
 	p.getPlayState(func(ps *PlayState) {
-		ps.ListId = listId
 		p.updatePlaylist(ps, playlist)
+		p.setListId(ps, listId)
 	})
 }
 
 func (p *MediaPlayer) updatePlaylist(ps *PlayState, playlist []string) {
-	nextVideo := ps.NextVideo()
+	nextVideos := prefetchList(ps)
 
 	if len(ps.Playlist) == 0 {
 
@@ -258,38 +583,79 @@ func (p *MediaPlayer) updatePlaylist(ps *PlayState, playlist []string) {
 			// this appears to be the normal behavior of YouTube
 			ps.Index = len(playlist) - 1
 		}
+		if ps.Index < 0 {
+			ps.Index = 0
+		}
+
+	} else if len(playlist) == 0 {
+		// All videos have been removed.
+		p.stop(ps)
 
 	} else {
+		if len(playlist) > len(ps.Playlist) {
+			// There is something new to play, so Play shouldn't start the
+			// playlist over.
+			ps.finished = false
+		}
 		videoId := ps.Video()
 		ps.Playlist = playlist
 		p.setPlaylistIndex(ps, videoId, ps.Index)
 		if ps.Video() != videoId && ps.State != STATE_STOPPED {
+			// The current video has been removed. The backend doesn't report
+			// stopping on request, so set the state here.
+			if ps.State == STATE_BUFFERING {
+				p.vg.Cancel(videoId)
+			}
 			p.player.stop()
+			p.setPlayState(ps, STATE_STOPPED, 0)
 		}
 	}
 
-	if ps.NextVideo() != nextVideo {
-		go p.prefetchVideoStream(ps.NextVideo())
+	p.startFetchingMetadata(ps.Playlist)
+
+	if newVideos := prefetchList(ps); !equalStrings(newVideos, nextVideos) {
+		go p.prefetchVideoStreams(newVideos)
 	}
 }
 
 func (p *MediaPlayer) SetVideo(videoId string, position time.Duration) {
 	p.getPlayState(func(ps *PlayState) {
 		p.setPlaylistIndex(ps, videoId, ps.Index)
-		p.startPlaying(ps, position)
+		p.startPlaying(ps, p.resumePosition(videoId, position))
 	})
 }
 
+// SwapIndex returns the current index and playlist, and at the same time jumps
+// to index if the current index is still expected. This way a remote doesn't
+// jump to the wrong video when the current video ends in the meantime. An
+// expected index below zero skips the check, and an index below zero doesn't
+// jump. It returns whether it jumped.
+func (p *MediaPlayer) SwapIndex(expected, index int) (int, []string, bool) {
+	var current int
+	var playlist []string
+	swapped := false
+	p.getPlayState(func(ps *PlayState) {
+		current = ps.Index
+		playlist = append([]string(nil), ps.Playlist...)
+		if index < 0 || index >= len(ps.Playlist) || (expected >= 0 && expected != ps.Index) {
+			return
+		}
+		ps.Index = index
+		p.startPlaying(ps, p.resumePosition(ps.Video(), 0))
+		swapped = true
+	})
+	return current, playlist, swapped
+}
+
+// setPlaylistIndex sets the index to the position of videoId in the playlist.
+// A video may be in the playlist multiple times (e.g. [A, B, A]), in which case
+// the entry closest to backupIndex is used, so that the current entry stays
+// current when the playlist is updated.
 func (p *MediaPlayer) setPlaylistIndex(ps *PlayState, videoId string, backupIndex int) {
 	newIndex := -1
 	for i, v := range ps.Playlist {
-		if v == videoId {
-			if newIndex >= 0 {
-				logger.Warnln("videoId exists twice in playlist")
-				break
-			}
+		if v == videoId && (newIndex < 0 || abs(i-backupIndex) < abs(newIndex-backupIndex)) {
 			newIndex = i
-			// no 'break' so duplicate video entries can be checked
 		}
 	}
 
@@ -300,19 +666,44 @@ func (p *MediaPlayer) setPlaylistIndex(ps *PlayState, videoId string, backupInde
 		if newIndex >= len(ps.Playlist) {
 			newIndex = len(ps.Playlist) - 1
 		}
+		if newIndex < 0 {
+			newIndex = 0
+		}
 	}
 
 	ps.Index = newIndex
 }
 
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
 // RequestPlaylist asynchronously gets the playlist state and sends it over the
 // channel.
 // To make asynchronous requests work, it expects a 1-buffered channel. Before a
 // new PlaylistState is sent over the channel, the previous is read if it's
 // there. It ensures that only one goroutine does that at one time, so this
 // trick should not be used elsewhere on the same channel.
+// Requests are coalesced: when there already is a request waiting for the same
+// channel, no new request is made as the waiting request will send the latest
+// state anyway. This avoids piling up position queries to the player.
 func (p *MediaPlayer) RequestPlaylist(playlistChan chan PlaylistState) {
+	p.pendingRequestsMutex.Lock()
+	if p.pendingRequests[playlistChan] {
+		p.pendingRequestsMutex.Unlock()
+		return
+	}
+	p.pendingRequests[playlistChan] = true
+	p.pendingRequestsMutex.Unlock()
+
 	go p.getPlayState(func(ps *PlayState) {
+		p.pendingRequestsMutex.Lock()
+		delete(p.pendingRequests, playlistChan)
+		p.pendingRequestsMutex.Unlock()
+
 		playlist := make([]string, len(ps.Playlist))
 		copy(playlist, ps.Playlist)
 
@@ -325,63 +716,175 @@ func (p *MediaPlayer) RequestPlaylist(playlistChan chan PlaylistState) {
 		case <-playlistChan:
 		default:
 		}
-		playlistChan <- PlaylistState{playlist, ps.Index, p.getPosition(ps), p.getDuration(), ps.State, ps.ListId}
+		playlistChan <- PlaylistState{playlist, ps.Index, p.getPosition(ps), p.getDuration(ps), ps.State, ps.ListId, ps.ListTitle, ps.Live}
 	})
 }
 
 // Pause pauses the currently playing video
 func (p *MediaPlayer) Pause() {
-	p.getPlayState(func(ps *PlayState) {
-		if ps.State == STATE_SEEKING {
-			ps.nextState = STATE_PAUSED
-		} else if ps.State != STATE_PLAYING {
-			// This is a Printf and not a Warnf because this occurs often in
-			// practice when seeking and is harmless in that case.
-			logger.Printf("pause while in state %d - ignoring\n", ps.State)
-		} else {
-			p.player.pause()
-		}
-	})
+	p.getPlayState(p.pause)
+}
+
+func (p *MediaPlayer) pause(ps *PlayState) {
+	if ps.State == STATE_SEEKING {
+		ps.nextState = STATE_PAUSED
+	} else if ps.State != STATE_PLAYING {
+		// This is a Printf and not a Warnf because this occurs often in
+		// practice when seeking and is harmless in that case.
+		logger.Printf("pause while in state %d - ignoring\n", ps.State)
+	} else {
+		p.player.pause()
+	}
 }
 
 // Play resumes playback when it was paused
 func (p *MediaPlayer) Play() {
-	p.getPlayState(func(ps *PlayState) {
-		if ps.State == STATE_STOPPED {
-			// Restart from the beginning.
-			if ps.Index >= len(ps.Playlist) {
-				logger.Warnln("invalid index or empty playlist")
-				return
-			}
-			p.startPlaying(ps, 0)
+	p.getPlayState(p.play)
+}
 
-		} else if ps.State == STATE_SEEKING {
-			ps.nextState = STATE_PLAYING
+func (p *MediaPlayer) play(ps *PlayState) {
+	if ps.State == STATE_STOPPED {
+		// Restart from the beginning.
+		if ps.Index >= len(ps.Playlist) {
+			logger.Warnln("invalid index or empty playlist")
+			return
+		}
+		if ps.finished && *flagReplay != REPLAY_VIDEO {
+			// The whole playlist has played, play it again.
+			ps.Index = 0
+		}
+		p.startPlaying(ps, 0)
 
+	} else if ps.State == STATE_SEEKING {
+		ps.nextState = STATE_PLAYING
+
+	} else {
+		if ps.State != STATE_PAUSED {
+			logger.Warnf("resume while in state %d - ignoring\n", ps.State)
+		} else if !ps.Live && !ps.streamExpires.IsZero() && p.clock.Now().After(ps.streamExpires) {
+			// Paused for so long that the stream doesn't work anymore.
+			// Load the (probably already refreshed) stream again.
+			logger.Println("Stream has expired while paused, reloading", ps.Video())
+			p.startPlaying(ps, p.tryGetPosition(ps))
 		} else {
-			if ps.State != STATE_PAUSED {
-				logger.Warnf("resume while in state %d - ignoring\n", ps.State)
+			p.player.resume()
+		}
+	}
+}
+
+// AutoPause pauses playback when it is playing, e.g. when nobody seems to be
+// listening. It returns whether it paused.
+func (p *MediaPlayer) AutoPause() bool {
+	paused := false
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State == STATE_PLAYING {
+			p.pause(ps)
+			ps.autoPaused = true
+			paused = true
+		}
+	})
+	return paused
+}
+
+// AutoResume resumes playback when it has been paused with AutoPause and the
+// state hasn't changed since, so a pause or stop by the user is respected. It
+// returns whether it resumed.
+func (p *MediaPlayer) AutoResume() bool {
+	resumed := false
+	p.getPlayState(func(ps *PlayState) {
+		if ps.autoPaused && ps.State == STATE_PAUSED {
+			p.play(ps)
+			resumed = true
+		}
+		ps.autoPaused = false
+	})
+	return resumed
+}
+
+// TogglePlayPause pauses playback when playing, and plays otherwise. This is
+// useful for controls with a single button. While seeking or buffering, the
+// state to go to afterwards is toggled.
+func (p *MediaPlayer) TogglePlayPause() {
+	p.getPlayState(func(ps *PlayState) {
+		switch ps.State {
+		case STATE_PLAYING:
+			p.pause(ps)
+		case STATE_SEEKING:
+			next := ps.nextState
+			if next == -1 {
+				next = ps.previousState
+			}
+			if next == STATE_PLAYING {
+				ps.nextState = STATE_PAUSED
+			} else {
+				ps.nextState = STATE_PLAYING
+			}
+		case STATE_BUFFERING:
+			// Start paused when the stream has loaded (see run).
+			if ps.nextState == STATE_PAUSED {
+				ps.nextState = -1
 			} else {
-				p.player.resume()
+				ps.nextState = STATE_PAUSED
 			}
+		default:
+			p.play(ps)
+		}
+	})
+}
+
+// Next plays the next video in the playlist, if there is one.
+func (p *MediaPlayer) Next() {
+	p.getPlayState(func(ps *PlayState) {
+		if ps.Index+1 >= len(ps.Playlist) {
+			return
+		}
+		ps.Index++
+		p.startPlaying(ps, p.resumePosition(ps.Video(), 0))
+	})
+}
+
+// Previous plays the previous video in the playlist, if there is one.
+func (p *MediaPlayer) Previous() {
+	p.getPlayState(func(ps *PlayState) {
+		if ps.Index <= 0 || ps.Index > len(ps.Playlist) {
+			return
 		}
+		ps.Index--
+		p.startPlaying(ps, p.resumePosition(ps.Video(), 0))
 	})
 }
 
 // Seek jumps to the specified position
 func (p *MediaPlayer) Seek(position time.Duration) {
 	p.getPlayState(func(ps *PlayState) {
-		if ps.State == STATE_STOPPED {
-			p.startPlaying(ps, position)
-		} else if ps.State == STATE_PAUSED || ps.State == STATE_PLAYING {
-			p.setPlayState(ps, STATE_SEEKING, position)
-			p.player.setPosition(position)
-		} else {
-			logger.Warnf("state is not paused or playing while seeking (state: %d) - ignoring\n", ps.State)
-		}
+		p.seek(ps, position)
 	})
 }
 
+func (p *MediaPlayer) seek(ps *PlayState, position time.Duration) {
+	if ps.Live && ps.State != STATE_STOPPED {
+		// Live streams can only be played at the live edge.
+		logger.Println("cannot seek in a live stream - ignoring")
+	} else if ps.State == STATE_STOPPED {
+		p.startPlaying(ps, position)
+	} else if ps.State == STATE_PAUSED || ps.State == STATE_PLAYING {
+		p.setPlayState(ps, STATE_SEEKING, position)
+		p.player.setPosition(position)
+	} else if ps.State == STATE_BUFFERING {
+		// The stream is still being fetched. Remember the new position,
+		// it will be used as start position when the stream is loaded.
+		ps.bufferingPosition = position
+		p.setPlayState(ps, STATE_BUFFERING, position)
+	} else if ps.State == STATE_SEEKING {
+		// Seek again, the last seek wins. Don't use setPlayState here as
+		// that would overwrite the state to return to after seeking.
+		ps.bufferingPosition = position
+		p.player.setPosition(position)
+	} else {
+		logger.Warnf("state is not paused or playing while seeking (state: %d) - ignoring\n", ps.State)
+	}
+}
+
 // SetVolume sets the volume of the player to the specified value (0-100).
 func (p *MediaPlayer) SetVolume(volume int, volumeChan chan int) {
 	p.getPlayState(func(ps *PlayState) {
@@ -408,12 +911,41 @@ func (p *MediaPlayer) ChangeVolume(delta int, volumeChan chan int) {
 }
 
 func (p *MediaPlayer) applyVolume(ps *PlayState, volumeChan chan int) {
+	p.applyPlayerVolume(ps)
+	config.Get().SetInt("player.volume", ps.Volume)
+	volumeChan <- ps.Volume
+}
+
+// applyPlayerVolume sets the volume of the player, or schedules it to be set
+// when nothing is playing.
+func (p *MediaPlayer) applyPlayerVolume(ps *PlayState) {
 	if ps.State == STATE_PLAYING || ps.State == STATE_PAUSED {
-		p.player.setVolume(ps.Volume)
+		p.player.setVolume(ps.playerVolume())
 	} else {
 		ps.newVolume = true
 	}
-	volumeChan <- ps.Volume
+}
+
+// Duck temporarily lowers the volume to the given level (0-100), e.g. to talk
+// over the music, until Unduck is called. Volume changes in the meantime are
+// applied after Unduck.
+func (p *MediaPlayer) Duck(volume int) {
+	p.getPlayState(func(ps *PlayState) {
+		ps.ducked = true
+		ps.duckVolume = volume
+		p.applyPlayerVolume(ps)
+	})
+}
+
+// Unduck restores the volume after Duck.
+func (p *MediaPlayer) Unduck() {
+	p.getPlayState(func(ps *PlayState) {
+		if !ps.ducked {
+			return
+		}
+		ps.ducked = false
+		p.applyPlayerVolume(ps)
+	})
 }
 
 // RequestVolume asynchronously gets the volume and sends it over the channel
@@ -429,14 +961,62 @@ func (p *MediaPlayer) RequestVolume(volumeChan chan int) {
 	})
 }
 
+// ListAudioTracks returns the audio tracks of the current video, or nil if no
+// video is playing.
+func (p *MediaPlayer) ListAudioTracks() []AudioTrack {
+	var tracks []AudioTrack
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+			return
+		}
+
+		var err error
+		tracks, err = p.player.getAudioTracks()
+		if err != nil {
+			logger.Warnln("could not get audio tracks:", err)
+		}
+	})
+	return tracks
+}
+
+// SetAudioTrack switches to the audio track with the given ID, as returned by
+// ListAudioTracks. The first audio track is used by default.
+func (p *MediaPlayer) SetAudioTrack(id int) {
+	p.getPlayState(func(ps *PlayState) {
+		if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+			logger.Printf("set audio track while in state %d - ignoring\n", ps.State)
+			return
+		}
+
+		p.player.setAudioTrack(id)
+	})
+}
+
 func (p *MediaPlayer) stop(ps *PlayState) {
+	if ps.State == STATE_BUFFERING {
+		// The stream for this video won't be needed anymore.
+		p.vg.Cancel(ps.Video())
+	}
+
+	if p.positions != nil {
+		p.positions.save()
+	}
+
 	ps.Playlist = []string{}
+	ps.stoppedPosition = 0
+	ps.lastDuration = 0
+	ps.finished = false
 	// Do not set ps.Index to 0, it may be needed for UpdatePlaylist:
 	// Stop is called before UpdatePlaylist when removing the currently
 	// playing video from the playlist.
-	// TODO this is a race condition: it looks like the player is playing with
-	// an empty playlist now.
 	p.player.stop()
+
+	if ps.State != STATE_STOPPED {
+		// Don't wait for the player to report that it has stopped: it won't
+		// report anything while buffering as nothing is playing yet. When it
+		// was playing, the 'stopped' event that follows is ignored in run().
+		p.setPlayState(ps, STATE_STOPPED, 0)
+	}
 }
 
 // Stop stops the currently playing sound and clears the playlist.
@@ -451,6 +1031,13 @@ func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
 	ps.Volume = initialVolume
 	ps.nextState = -1
 
+	ticker := p.clock.NewTicker(CHECK_INTERVAL)
+	defer ticker.Stop()
+	progressTicker := p.clock.NewTicker(BUFFERING_PROGRESS_INTERVAL)
+	defer progressTicker.Stop()
+	refreshTicker := p.clock.NewTicker(STREAM_REFRESH_INTERVAL)
+	defer refreshTicker.Stop()
+
 	for {
 		select {
 		case p.playstateChan <- ps:
@@ -470,7 +1057,7 @@ func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
 			case STATE_PLAYING:
 				if ps.newVolume {
 					ps.newVolume = false
-					p.player.setVolume(ps.Volume)
+					p.player.setVolume(ps.playerVolume())
 				}
 
 				if ps.State == STATE_SEEKING {
@@ -497,13 +1084,20 @@ func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
 				if ps.State == STATE_STOPPED {
 					// MPV sometimes sends an 'unpause' event after it has been
 					// stopped, when setting pause=no right before it finishes
-					// the stream.
+					// the stream. The MPV backend drops these while idle, but
+					// it doesn't hurt to check here as well.
 					// Ignore this event to prevent a panic (property
 					// unavailable while trying to get the position).
 					break
 				}
 
+				buffering := ps.State == STATE_BUFFERING
 				p.setPlayState(&ps, STATE_PLAYING, -1)
+				if buffering && ps.nextState == STATE_PAUSED {
+					// Toggled to paused while buffering.
+					ps.nextState = -1
+					p.player.pause()
+				}
 
 			case STATE_PAUSED:
 				if ps.State == STATE_BUFFERING {
@@ -516,14 +1110,393 @@ func (p *MediaPlayer) run(playerEventChan chan State, initialVolume int) {
 
 			case STATE_STOPPED:
 				if ps.State == STATE_BUFFERING {
-					// The previous video has stopped on a 'loadfile' command in
-					// MPV. This is expected and should be ignored.
+					if ps.streamLoaded {
+						// The backend doesn't report videos it was told to
+						// stop (including by loading another video), so this
+						// is the new stream that failed to load.
+						p.loadFailed(&ps)
+					}
+					// Otherwise, the previous video ended while the stream
+					// for the next video was being fetched.
 					break
 				}
 
+				if ps.State == STATE_STOPPED {
+					// The player was stopped with Stop(), which has already
+					// updated the state.
+					break
+				}
+
+				if ps.State == STATE_PLAYING && !ps.Live && p.clock.Since(ps.playStart) < INSTANT_EOF_TIMEOUT {
+					p.loadFailed(&ps)
+					break
+				}
+
+				if p.resumeAfterEOF(&ps) {
+					// The stream ended early, probably a network error.
+					break
+				}
+
+				if p.positions != nil {
+					// Start at the beginning the next time.
+					p.positions.forget(ps.Video())
+				}
+
 				// There may be more videos.
-				p.nextVideo(&ps)
+				p.videoEnded(&ps)
+			}
+
+		case <-ticker.C():
+			p.checkStuck(&ps)
+			p.updateLastPosition(&ps)
+
+		case <-progressTicker.C():
+			p.updateBufferingProgress(&ps)
+
+		case <-refreshTicker.C():
+			p.refreshStreams(&ps)
+		}
+	}
+}
+
+// updateBufferingProgress sends the buffering progress while the backend is
+// loading the stream, if the backend knows it and it has changed.
+func (p *MediaPlayer) updateBufferingProgress(ps *PlayState) {
+	if ps.State != STATE_BUFFERING || !ps.streamLoaded {
+		return
+	}
+
+	progress, err := p.player.getBufferingProgress()
+	if err != nil {
+		// not supported, or not known yet
+		return
+	}
+	if progress == ps.bufferingProgress {
+		return
+	}
+	ps.bufferingProgress = progress
+
+	p.stateChange <- StateChange{ps.State, ps.bufferingPosition, p.getDuration(ps), ps.Live, ps.Video(), progress}
+}
+
+// refreshStreams fetches the streams of the current and upcoming videos again
+// when they are about to expire. Other cached streams are left alone, they are
+// fetched again when they are needed.
+func (p *MediaPlayer) refreshStreams(ps *PlayState) {
+	if ps.State == STATE_STOPPED || ps.Index >= len(ps.Playlist) {
+		return
+	}
+	videoIds := append([]string{ps.Video()}, prefetchList(ps)...)
+	for _, videoId := range videoIds {
+		// GetVideoURL starts fetching the stream again when it will expire
+		// within STREAM_EXPIRY_MARGIN, and returns the cached stream
+		// otherwise.
+		p.vg.GetVideoURL(videoId)
+	}
+}
+
+// checkStuck asks the backend for its state when the player has been buffering
+// or seeking for a long time. An event may have been missed, in which case the
+// player would otherwise stay in that state forever.
+func (p *MediaPlayer) checkStuck(ps *PlayState) {
+	if ps.State != STATE_BUFFERING && ps.State != STATE_SEEKING {
+		return
+	}
+	if ps.State == STATE_BUFFERING && !ps.streamLoaded {
+		// Still waiting for the stream URL.
+		return
+	}
+	if p.clock.Since(ps.stateChanged) < STUCK_TIMEOUT {
+		return
+	}
+
+	state, err := p.player.getState()
+	if err != nil {
+		logger.Warnln("could not get player state:", err)
+		return
+	}
+
+	switch state {
+	case STATE_PLAYING, STATE_PAUSED:
+		logger.Warnf("player was stuck in state %d, but is in state %d\n", ps.State, state)
+		ps.nextState = -1
+		p.setPlayState(ps, state, -1)
+	case STATE_STOPPED:
+		logger.Warnf("player was stuck in state %d, but has stopped\n", ps.State)
+		p.nextVideo(ps)
+	default:
+		// Still buffering or seeking, e.g. on a slow network.
+	}
+}
+
+// equalStrings returns true if both slices contain the same strings in the
+// same order.
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// updateLastPosition remembers the current position, so resumeAfterEOF knows
+// where the stream ended.
+func (p *MediaPlayer) updateLastPosition(ps *PlayState) {
+	if ps.State != STATE_PLAYING {
+		return
+	}
+
+	position, err := p.player.getPosition()
+	if err != nil {
+		// May happen right at the end of a stream.
+		return
+	}
+	ps.lastPosition = position
+
+	if p.positions != nil && !ps.Live {
+		p.positions.update(ps.Video(), position, p.getDuration(ps))
+	}
+}
+
+// resumePosition returns the remembered position of videoId when position is
+// 0 (no start time was given) and -resume-positions is enabled. Otherwise, it
+// returns position.
+func (p *MediaPlayer) resumePosition(videoId string, position time.Duration) time.Duration {
+	if p.positions == nil || position != 0 {
+		return position
+	}
+	if saved, ok := p.positions.get(videoId); ok {
+		logger.Printf("Resuming video %s at %s\n", videoId, saved)
+		return saved
+	}
+	return position
+}
+
+// resumeAfterEOF restarts the current video at the last known position when it
+// ended well before its duration, which happens when the connection is
+// interrupted. It returns true if the video is resumed.
+func (p *MediaPlayer) resumeAfterEOF(ps *PlayState) bool {
+	if *flagEOFGrace <= 0 || ps.State != STATE_PLAYING || ps.Live {
+		return false
+	}
+	if ps.End != 0 && ps.endVideo == ps.Video() {
+		// Stopped at the requested end of the clip.
+		return false
+	}
+
+	duration := p.getDuration(ps)
+	if duration == 0 || ps.lastPosition+*flagEOFGrace >= duration {
+		// Unknown duration, or the video ended (nearly) at the end.
+		return false
+	}
+
+	if ps.eofResumes >= MAX_EOF_RESUMES {
+		logger.Warnf("video %s keeps ending early, skipping\n", ps.Video())
+		return false
+	}
+
+	logger.Warnf("video %s ended at %s of %s, resuming\n", ps.Video(), ps.lastPosition, duration)
+	resumes := ps.eofResumes + 1
+	// See nextVideo: startPlaying shouldn't stop the player.
+	ps.State = STATE_STOPPED
+	p.startPlaying(ps, ps.lastPosition)
+	ps.eofResumes = resumes
+	return true
+}
+
+// loadFailed is called when the current stream stopped (almost) immediately,
+// which usually means the stream URL doesn't work anymore. The stream is
+// fetched again once. If that doesn't help, the video is skipped after a short
+// delay.
+func (p *MediaPlayer) loadFailed(ps *PlayState) {
+	videoId := ps.Video()
+	p.vg.Forget(videoId)
+
+	position := ps.lastPosition
+	if ps.State == STATE_BUFFERING {
+		position = ps.bufferingPosition
+	}
+
+	if !ps.reloaded {
+		logger.Warnf("stream for video %s stopped immediately, fetching it again\n", videoId)
+		// See nextVideo: startPlaying shouldn't stop the player.
+		ps.State = STATE_STOPPED
+		p.startPlaying(ps, position)
+		ps.reloaded = true
+		return
+	}
+
+	logger.Errf("cannot play video %s: stream stopped immediately, skipping\n", videoId)
+	index := ps.Index
+	p.setPlayState(ps, STATE_STOPPED, position)
+
+	go func() {
+		p.clock.Sleep(SKIP_DELAY)
+		p.getPlayState(func(ps *PlayState) {
+			if ps.State != STATE_STOPPED || ps.Index != index || ps.Video() != videoId {
+				// Something else has been started in the meantime.
+				return
 			}
+			p.nextVideo(ps)
+		})
+	}()
+}
+
+// startFetchingMetadata starts fetching the metadata (title, duration) of all
+// videos in the playlist in the background, so the whole queue can be shown.
+// It stops fetching for the previous playlist.
+func (p *MediaPlayer) startFetchingMetadata(playlist []string) {
+	generation := atomic.AddUint32(&p.metadataGeneration, 1)
+	if len(playlist) > MAX_METADATA_FETCH {
+		playlist = playlist[:MAX_METADATA_FETCH]
+	}
+	// Copy, as the playlist may be modified in the meantime.
+	playlist = append([]string(nil), playlist...)
+	go p.fetchMetadata(playlist, generation)
+}
+
+// fetchMetadata fetches the metadata of the given videos one by one, until
+// the playlist changes.
+//
+// Warning: start this function in a new goroutine!
+func (p *MediaPlayer) fetchMetadata(playlist []string, generation uint32) {
+	for _, videoId := range playlist {
+		if atomic.LoadUint32(&p.metadataGeneration) != generation {
+			// The playlist has changed in the meantime.
+			return
+		}
+		if _, ok := p.vg.GetMetadata(videoId); ok {
+			continue
+		}
+
+		// Wait until it has been fetched. Only the metadata is fetched, so
+		// the streams of the current and upcoming videos stay cached.
+		err := p.vg.FetchMetadata(videoId)
+		if err != nil {
+			logger.Warnf("could not get metadata for %s: %s\n", videoId, err)
 		}
+		p.clock.Sleep(METADATA_FETCH_DELAY)
 	}
 }
+
+// Subtitles returns the current video and the language codes of its
+// subtitles, if they are known. Subtitles aren't shown, but remotes may want
+// to know about them.
+func (p *MediaPlayer) Subtitles() (string, []string) {
+	var videoId string
+	var languages []string
+	p.getPlayState(func(ps *PlayState) {
+		videoId = ps.Video()
+		if metadata, ok := p.vg.GetMetadata(videoId); ok {
+			languages = metadata.Subtitles
+		}
+	})
+	return videoId, languages
+}
+
+// DebugState returns a snapshot of the internal state, for troubleshooting.
+func (p *MediaPlayer) DebugState() DebugState {
+	var state DebugState
+	p.getPlayState(func(ps *PlayState) {
+		state = DebugState{
+			Playlist:     append([]string(nil), ps.Playlist...),
+			Index:        ps.Index,
+			State:        ps.State,
+			ListId:       ps.ListId,
+			ListTitle:    ps.ListTitle,
+			Volume:       ps.Volume,
+			Ducked:       ps.ducked,
+			Live:         ps.Live,
+			Position:     p.tryGetPosition(ps).Seconds(),
+			Duration:     p.getDuration(ps).Seconds(),
+			StreamLoaded: ps.streamLoaded,
+			EOFResumes:   ps.eofResumes,
+			Reloaded:     ps.reloaded,
+			Finished:     ps.finished,
+			StateChanged: ps.stateChanged,
+		}
+	})
+	state.GrabberUp = p.vg.Running()
+	state.CachedStreams = p.vg.cachedStreams()
+	return state
+}
+
+// Playback returns the state and position of the current video.
+func (p *MediaPlayer) Playback() Playback {
+	var playback Playback
+	p.getPlayState(func(ps *PlayState) {
+		playback = Playback{
+			State:     ps.State,
+			Index:     ps.Index,
+			Position:  p.tryGetPosition(ps).Seconds(),
+			ListId:    ps.ListId,
+			ListTitle: ps.ListTitle,
+		}
+	})
+	return playback
+}
+
+// Follow plays the same video as another instance, at roughly the same
+// position: it seeks when the position differs more than tolerance. It is
+// called periodically, with the state of the other instance (see Playback).
+func (p *MediaPlayer) Follow(playlist []string, index int, state State, position, tolerance time.Duration) {
+	p.getPlayState(func(ps *PlayState) {
+		if state == STATE_STOPPED || index < 0 || index >= len(playlist) {
+			if ps.State != STATE_STOPPED {
+				p.stop(ps)
+			}
+			return
+		}
+
+		if !equalStrings(ps.Playlist, playlist) || ps.Index != index || ps.State == STATE_STOPPED {
+			logger.Printf("Following: playing video %s at %s\n", playlist[index], position)
+			if !equalStrings(ps.Playlist, playlist) {
+				ps.Playlist = append([]string(nil), playlist...)
+				p.startFetchingMetadata(ps.Playlist)
+			}
+			ps.Index = index
+			p.startPlaying(ps, position)
+			return
+		}
+
+		if ps.State != STATE_PLAYING && ps.State != STATE_PAUSED {
+			// Buffering or seeking, check again later.
+			return
+		}
+
+		if state == STATE_PAUSED && ps.State == STATE_PLAYING {
+			p.pause(ps)
+			return
+		} else if state == STATE_PLAYING && ps.State == STATE_PAUSED {
+			// Fix the position next time, after resuming.
+			p.play(ps)
+			return
+		}
+
+		if offset := p.tryGetPosition(ps) - position; !ps.Live && (offset > tolerance || offset < -tolerance) {
+			logger.Printf("Following: %s off, seeking to %s\n", offset, position)
+			p.seek(ps, position)
+		}
+	})
+}
+
+// Queue returns the current playlist, with the metadata that is known.
+func (p *MediaPlayer) Queue() []QueueItem {
+	var queue []QueueItem
+	p.getPlayState(func(ps *PlayState) {
+		queue = make([]QueueItem, len(ps.Playlist))
+		for i, videoId := range ps.Playlist {
+			queue[i].VideoId = videoId
+			queue[i].Current = i == ps.Index
+			if metadata, ok := p.vg.GetMetadata(videoId); ok {
+				queue[i].Title = metadata.Title
+				queue[i].Duration = metadata.Duration.Seconds()
+			}
+		}
+	})
+	return queue
+}
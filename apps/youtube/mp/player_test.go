@@ -0,0 +1,369 @@
+package mp
+
+import (
+	"flag"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aykevl/plaincast/clock"
+)
+
+// Video IDs used in the tests. The fake grabber accepts any ID.
+const (
+	videoA = "aaaaaaaaaaa"
+	videoB = "bbbbbbbbbbb"
+	videoC = "ccccccccccc"
+)
+
+// testPlayer is a MediaPlayer with the test backend, the fake grabber and a
+// fake clock.
+type testPlayer struct {
+	*MediaPlayer
+	backend *testBackend
+	clock   *clock.Fake
+	states  chan StateChange // all state changes, in order
+}
+
+func newTestPlayer(t *testing.T) *testPlayer {
+	t.Helper()
+
+	backend := &testBackend{}
+	backends["test"] = func() Backend { return backend }
+	flag.Set("backend", "test")
+	c := clock.NewFake(time.Now())
+	stateChange := make(chan StateChange)
+	p, err := newMediaPlayer(stateChange, c)
+	if err != nil {
+		t.Fatal("could not start player:", err)
+	}
+	tp := &testPlayer{p, backend, c, make(chan StateChange, 1000)}
+	go func() {
+		for change := range stateChange {
+			tp.states <- change
+		}
+		close(tp.states)
+	}()
+	t.Cleanup(p.Quit)
+	return tp
+}
+
+// waitState waits until the player reports the given state, and returns that
+// state change.
+func (tp *testPlayer) waitState(t *testing.T, state State) StateChange {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case change, ok := <-tp.states:
+			if !ok {
+				t.Fatalf("player quit while waiting for state %d", state)
+			}
+			if change.State == state {
+				return change
+			}
+		case <-timeout:
+			t.Fatalf("timeout waiting for state %d", state)
+		}
+	}
+}
+
+// hasStream returns whether the stream of the video has been fetched or is
+// being fetched.
+func (tp *testPlayer) hasStream(videoId string) bool {
+	tp.vg.streamsMutex.Lock()
+	defer tp.vg.streamsMutex.Unlock()
+
+	_, ok := tp.vg.streams[videoId]
+	return ok
+}
+
+// skipMetadata makes the player think the metadata of these videos is known,
+// so it doesn't fetch it (and sleep in between) in the background.
+func (tp *testPlayer) skipMetadata(videoIds ...string) {
+	for _, videoId := range videoIds {
+		tp.vg.storeMetadata(videoId, Metadata{Title: "Video " + videoId, Duration: FAKE_DURATION})
+	}
+}
+
+func TestPrefetchDelay(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA, videoB, videoC)
+
+	tp.SetPlaystate([]string{videoA, videoB, videoC}, 0, 0, "")
+	tp.waitState(t, STATE_PLAYING)
+
+	// The three tickers of the mainloop, and the prefetch delay.
+	if !tp.clock.WaitForWaiters(4, time.Second) {
+		t.Fatal("prefetch didn't start waiting")
+	}
+	tp.clock.Advance(10*time.Second - time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if tp.hasStream(videoB) {
+		t.Fatal("next video was prefetched before the delay")
+	}
+
+	tp.clock.Advance(time.Millisecond)
+	waitFor(t, "prefetch of the next video", func() bool {
+		return tp.hasStream(videoB)
+	})
+	// Only one video is prefetched by default.
+	if tp.hasStream(videoC) {
+		t.Error("video after the next video was prefetched")
+	}
+}
+
+// blockGrabber blocks all grabber requests, as if the grabber is slow, until
+// the returned function is called or the test ends.
+func (tp *testPlayer) blockGrabber(t *testing.T) func() {
+	tp.vg.cmdMutex.Lock()
+	var once sync.Once
+	unblock := func() {
+		once.Do(tp.vg.cmdMutex.Unlock)
+	}
+	// Runs before the player is stopped, which needs the grabber.
+	t.Cleanup(unblock)
+	return unblock
+}
+
+func TestSeekWhileLoading(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA)
+
+	unblock := tp.blockGrabber(t)
+	tp.SetPlaystate([]string{videoA}, 0, 30*time.Second, "")
+	if change := tp.waitState(t, STATE_BUFFERING); change.Position != 30*time.Second {
+		t.Errorf("buffering at %s, want 30s", change.Position)
+	}
+
+	// Seek twice while the stream is still being fetched: the last seek wins.
+	tp.Seek(60 * time.Second)
+	tp.Seek(90 * time.Second)
+	unblock()
+
+	if change := tp.waitState(t, STATE_PLAYING); change.Position != 90*time.Second {
+		t.Errorf("playing from %s, want 90s", change.Position)
+	}
+	if position, _ := tp.backend.getPosition(); position != 90*time.Second {
+		t.Errorf("backend plays from %s, want 90s", position)
+	}
+}
+
+func TestPositionAfterBuffering(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA)
+	tp.backend.mutex.Lock()
+	tp.backend.keyframeInterval = 4 * time.Second
+	tp.backend.mutex.Unlock()
+
+	tp.SetPlaystate([]string{videoA}, 0, 30*time.Second, "")
+	if change := tp.waitState(t, STATE_BUFFERING); change.Position != 30*time.Second {
+		t.Errorf("buffering at %s, want 30s", change.Position)
+	}
+	// The backend started at the keyframe at 28s, so that is what the remote
+	// should see.
+	if change := tp.waitState(t, STATE_PLAYING); change.Position != 28*time.Second {
+		t.Errorf("playing from %s, want 28s", change.Position)
+	}
+}
+
+// expectNoState fails the test when the player reports the given state soon.
+func (tp *testPlayer) expectNoState(t *testing.T, state State) {
+	t.Helper()
+	timeout := time.After(50 * time.Millisecond)
+	for {
+		select {
+		case change := <-tp.states:
+			if change.State == state {
+				t.Fatalf("unexpected state %d", state)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestRemoveAllWhileLoading(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA, videoB)
+
+	unblock := tp.blockGrabber(t)
+	tp.SetPlaystate([]string{videoA, videoB}, 0, 0, "")
+	tp.waitState(t, STATE_BUFFERING)
+	waitFor(t, "fetching the stream", func() bool {
+		return tp.hasStream(videoA)
+	})
+
+	tp.UpdatePlaylist(nil, "")
+	tp.waitState(t, STATE_STOPPED)
+	if tp.hasStream(videoA) {
+		t.Error("fetching the stream of the removed video wasn't cancelled")
+	}
+
+	// Finishing the fetch doesn't start playback.
+	unblock()
+	tp.expectNoState(t, STATE_PLAYING)
+	if state, _ := tp.player.getState(); state != STATE_STOPPED {
+		t.Errorf("backend state: got %d, want stopped", state)
+	}
+}
+
+func TestRemoveAllWhilePlaying(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA, videoB)
+
+	tp.SetPlaystate([]string{videoA, videoB}, 0, 0, "")
+	tp.waitState(t, STATE_PLAYING)
+
+	tp.UpdatePlaylist(nil, "")
+	tp.waitState(t, STATE_STOPPED)
+	if state, _ := tp.player.getState(); state != STATE_STOPPED {
+		t.Errorf("backend state: got %d, want stopped", state)
+	}
+	tp.expectNoState(t, STATE_PLAYING)
+}
+
+// playToEnd lets the current video play until the backend reaches its end. It
+// seeks to the end first and pretends the stream has been playing for a while,
+// so the player doesn't think the stream ended early or failed to load.
+func (tp *testPlayer) playToEnd(t *testing.T) {
+	t.Helper()
+	tp.Seek(FAKE_DURATION)
+	tp.waitState(t, STATE_PLAYING)
+	tp.getPlayState(func(ps *PlayState) {
+		ps.playStart = tp.clock.Now().Add(-INSTANT_EOF_TIMEOUT)
+	})
+	tp.backend.end()
+}
+
+func TestSingleVideo(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA)
+
+	tp.SetPlaystate([]string{videoA}, 0, 0, "")
+	if change := tp.waitState(t, STATE_PLAYING); change.Duration != FAKE_DURATION {
+		t.Errorf("playing with duration %s, want %s", change.Duration, FAKE_DURATION)
+	}
+
+	tp.playToEnd(t)
+	change := tp.waitState(t, STATE_STOPPED)
+	if change.Position != FAKE_DURATION || change.Duration != FAKE_DURATION {
+		t.Errorf("stopped at %s of %s, want the end of %s", change.Position, change.Duration, FAKE_DURATION)
+	}
+	tp.expectNoState(t, STATE_BUFFERING)
+}
+
+// playVolume returns the volume given to the backend when the current video was
+// started, or -1 if no volume was given.
+func (tp *testPlayer) playVolume() int {
+	tp.backend.mutex.Lock()
+	defer tp.backend.mutex.Unlock()
+
+	return tp.backend.playVolume
+}
+
+func TestVolumeOnEveryPlay(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA, videoB)
+
+	// The volume reported before playback is the one used on the first play.
+	volumeChan := make(chan int, 1)
+	tp.RequestVolume(volumeChan)
+	initial := <-volumeChan
+	tp.SetPlaystate([]string{videoA, videoB}, 0, 0, "")
+	tp.waitState(t, STATE_PLAYING)
+	if got := tp.playVolume(); got != initial {
+		t.Errorf("first video: played at volume %d, want %d", got, initial)
+	}
+	tp.Stop()
+	tp.waitState(t, STATE_STOPPED)
+
+	// A volume set while stopped is used for the next video, and for the
+	// videos after it.
+	volume := 30
+	if volume == initial {
+		volume = 40
+	}
+	tp.SetVolume(volume, volumeChan)
+	if got := <-volumeChan; got != volume {
+		t.Errorf("SetVolume reported %d, want %d", got, volume)
+	}
+	tp.SetPlaystate([]string{videoA, videoB}, 0, 0, "")
+	tp.waitState(t, STATE_PLAYING)
+	if got := tp.playVolume(); got != volume {
+		t.Errorf("volume set while stopped: played at volume %d, want %d", got, volume)
+	}
+	tp.playToEnd(t)
+	tp.waitState(t, STATE_BUFFERING)
+	tp.waitState(t, STATE_PLAYING)
+	if got := tp.playVolume(); got != volume {
+		t.Errorf("next video: played at volume %d, want %d", got, volume)
+	}
+}
+
+// playlistIndex returns the index of the current video in the playlist.
+func (tp *testPlayer) playlistIndex() int {
+	playlistChan := make(chan PlaylistState, 1)
+	tp.RequestPlaylist(playlistChan)
+	return (<-playlistChan).Index
+}
+
+func TestDuplicateVideo(t *testing.T) {
+	tp := newTestPlayer(t)
+	tp.skipMetadata(videoA, videoB, videoC)
+
+	tp.SetPlaystate([]string{videoA, videoB, videoA}, 2, 0, "")
+	tp.waitState(t, STATE_PLAYING)
+
+	// Adding a video keeps the second occurrence of the video current.
+	tp.UpdatePlaylist([]string{videoA, videoB, videoA, videoC}, "")
+	if index := tp.playlistIndex(); index != 2 {
+		t.Errorf("index after update: got %d, want 2", index)
+	}
+	tp.expectNoState(t, STATE_BUFFERING)
+
+	tp.playToEnd(t)
+	tp.waitState(t, STATE_PLAYING)
+	if index := tp.playlistIndex(); index != 3 {
+		t.Errorf("index after the end of the video: got %d, want 3", index)
+	}
+}
+
+func TestReplayAfterEnd(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		replay string
+		added  bool // a video is added after the playlist has finished
+		index  int
+	}{
+		{"playlist", REPLAY_PLAYLIST, false, 0},
+		{"video", REPLAY_VIDEO, false, 1},
+		{"added", REPLAY_PLAYLIST, true, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			defer flag.Set("replay", *flagReplay)
+			flag.Set("replay", test.replay)
+
+			tp := newTestPlayer(t)
+			tp.skipMetadata(videoA, videoB, videoC)
+
+			tp.SetPlaystate([]string{videoA, videoB}, 0, 0, "")
+			tp.waitState(t, STATE_PLAYING)
+			tp.playToEnd(t)
+			tp.waitState(t, STATE_PLAYING)
+			tp.playToEnd(t)
+			tp.waitState(t, STATE_STOPPED)
+			if test.added {
+				tp.UpdatePlaylist([]string{videoA, videoB, videoC}, "")
+			}
+
+			tp.Play()
+			if change := tp.waitState(t, STATE_PLAYING); change.Position != 0 {
+				t.Errorf("playing at %s, want 0s", change.Position)
+			}
+			if index := tp.playlistIndex(); index != test.index {
+				t.Errorf("playing index %d, want %d", index, test.index)
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package mp
+
+import (
+	"flag"
+	"sync"
+)
+
+var flagGrabberWorkers = flag.Int("grabber-workers", 2, "maximum number of goroutines doing grabber work (streams, metadata, mixes) at the same time, waiting work is queued")
+
+// All grabber work is done in this pool, so a big change to the queue doesn't
+// start a goroutine for every video.
+var grabberPool = &workerPool{}
+
+// workerPool runs tasks in at most -grabber-workers goroutines. Tasks that
+// can't run yet are queued in the order they were submitted. Workers exit when
+// the queue is empty, so an idle pool has no goroutines.
+type workerPool struct {
+	mutex   sync.Mutex
+	queue   []func()
+	workers int
+}
+
+// submit queues the task and returns immediately.
+func (wp *workerPool) submit(task func()) {
+	wp.mutex.Lock()
+	defer wp.mutex.Unlock()
+
+	wp.queue = append(wp.queue, task)
+	if wp.workers < maxWorkers() {
+		wp.workers++
+		go wp.work()
+	}
+}
+
+// run runs the task in the pool and waits until it is done.
+func (wp *workerPool) run(task func()) {
+	done := make(chan struct{})
+	wp.submit(func() {
+		defer close(done)
+		task()
+	})
+	<-done
+}
+
+// work runs tasks from the queue until it is empty.
+func (wp *workerPool) work() {
+	for {
+		wp.mutex.Lock()
+		if len(wp.queue) == 0 {
+			wp.workers--
+			wp.mutex.Unlock()
+			return
+		}
+		task := wp.queue[0]
+		wp.queue[0] = nil
+		wp.queue = wp.queue[1:]
+		wp.mutex.Unlock()
+
+		task()
+	}
+}
+
+// maxWorkers returns the number of workers set with -grabber-workers, at least
+// one.
+func maxWorkers() int {
+	if *flagGrabberWorkers < 1 {
+		return 1
+	}
+	return *flagGrabberWorkers
+}
@@ -0,0 +1,131 @@
+package mp
+
+import (
+	"flag"
+	"time"
+
+	"github.com/aykevl/plaincast/config"
+)
+
+var flagResumePositions = flag.Bool("resume-positions", false, "remember the position in each video, and resume there when it is played again without a start time (for podcasts and audiobooks)")
+
+// Config key of the remembered positions. They are stored as a list of
+// [videoId, seconds] pairs, least recently played first.
+const RESUME_POSITIONS_KEY = "player.positions"
+
+// Maximum number of remembered positions. The least recently played video is
+// forgotten first.
+const MAX_RESUME_POSITIONS = 100
+
+// Positions are written to the config file at most this often while playing.
+const RESUME_SAVE_INTERVAL = 30 * time.Second
+
+// Positions near the start or the end of a video are not remembered: the video
+// has barely been started or it has (nearly) been finished.
+const RESUME_MIN_POSITION = 10 * time.Second
+const RESUME_END_MARGIN = 30 * time.Second
+
+// resumePositions remembers the position in recently played videos. It must
+// only be used with access to the PlayState, which serializes access.
+type resumePositions struct {
+	order     []string // least recently played first
+	positions map[string]time.Duration
+	dirty     bool
+	lastSave  time.Time
+}
+
+// loadResumePositions reads the remembered positions from the config.
+func loadResumePositions() *resumePositions {
+	r := &resumePositions{
+		positions: make(map[string]time.Duration),
+	}
+
+	value, err := config.Get().Get(RESUME_POSITIONS_KEY, func() (interface{}, error) {
+		return []interface{}{}, nil
+	})
+	if err != nil {
+		logger.Warnln("could not load resume positions:", err)
+		return r
+	}
+	list, _ := value.([]interface{})
+	for _, item := range list {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 {
+			continue
+		}
+		videoId, ok1 := pair[0].(string)
+		seconds, ok2 := pair[1].(float64)
+		if !ok1 || !ok2 || videoId == "" {
+			continue
+		}
+		r.set(videoId, time.Duration(seconds*float64(time.Second)))
+	}
+	r.dirty = false
+	return r
+}
+
+// get returns the remembered position of videoId, if there is one.
+func (r *resumePositions) get(videoId string) (time.Duration, bool) {
+	position, ok := r.positions[videoId]
+	return position, ok
+}
+
+// set remembers the position of videoId, and makes it the most recently played
+// video.
+func (r *resumePositions) set(videoId string, position time.Duration) {
+	r.remove(videoId)
+	r.order = append(r.order, videoId)
+	r.positions[videoId] = position
+	if len(r.order) > MAX_RESUME_POSITIONS {
+		delete(r.positions, r.order[0])
+		r.order = r.order[1:]
+	}
+	r.dirty = true
+}
+
+// forget removes the position of videoId.
+func (r *resumePositions) forget(videoId string) {
+	if _, ok := r.positions[videoId]; !ok {
+		return
+	}
+	r.remove(videoId)
+	delete(r.positions, videoId)
+	r.dirty = true
+}
+
+func (r *resumePositions) remove(videoId string) {
+	for i, v := range r.order {
+		if v == videoId {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			return
+		}
+	}
+}
+
+// update remembers the position of videoId while it is playing, or forgets it
+// when it is near the start or end. Changes are saved every
+// RESUME_SAVE_INTERVAL.
+func (r *resumePositions) update(videoId string, position, duration time.Duration) {
+	if position < RESUME_MIN_POSITION || (duration > 0 && position+RESUME_END_MARGIN >= duration) {
+		r.forget(videoId)
+	} else {
+		r.set(videoId, position)
+	}
+	if time.Since(r.lastSave) >= RESUME_SAVE_INTERVAL {
+		r.save()
+	}
+}
+
+// save writes the positions to the config, if they have changed.
+func (r *resumePositions) save() {
+	if !r.dirty {
+		return
+	}
+	list := make([]interface{}, len(r.order))
+	for i, videoId := range r.order {
+		list[i] = []interface{}{videoId, r.positions[videoId].Seconds()}
+	}
+	config.Get().Set(RESUME_POSITIONS_KEY, list)
+	r.dirty = false
+	r.lastSave = time.Now()
+}
@@ -2,24 +2,41 @@ package mp
 
 import (
 	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
 	"io"
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/aykevl/plaincast/clock"
+	"github.com/aykevl/plaincast/config"
 )
 
 const pythonGrabber = `
 try:
+    import json
     import sys
-    from youtube_dl import YoutubeDL
-    from youtube_dl.utils import DownloadError
+
+    try:
+        from youtube_dl import YoutubeDL
+        from youtube_dl.utils import DownloadError
+    except ImportError:
+        # Let the Go side know, so it can give a useful error message.
+        sys.stdout.write(json.dumps({'url': '', 'error': 'not-installed'}) + '\n')
+        sys.stdout.flush()
+        sys.exit(1)
 
     if len(sys.argv) != 3:
-        sys.stderr.write('arguments: <format string> <cache dir>')
-        os.exit(1)
+        sys.stderr.write('arguments: <default format string> <cache dir>')
+        sys.exit(1)
 
     yt = YoutubeDL({
         'geturl': True,
@@ -29,18 +46,56 @@ try:
         'simulate': True})
 
     while True:
-        stream = ''
+        stream = {'url': ''}
         try:
-            url = sys.stdin.readline().strip()
-            stream = yt.extract_info(url, ie_key='Youtube')['url']
+            line = sys.stdin.readline()
+            if not line:
+                break
+            # Every request is a JSON object with the URL and the format to
+            # use, as the preferred quality may change at runtime.
+            request = json.loads(line)
+            if request.get('playlist'):
+                # Only list the videos of the playlist (or mix), without
+                # extracting their streams.
+                yt.params['extract_flat'] = 'in_playlist'
+                try:
+                    info = yt.extract_info(request['url'])
+                finally:
+                    yt.params['extract_flat'] = False
+                stream['entries'] = [entry['id'] for entry in info.get('entries') or [] if entry.get('id')]
+                stream['title'] = info.get('title') or ''
+                continue
+            if request.get('metadata'):
+                # Only get information about the video, without resolving
+                # the stream.
+                info = yt.extract_info(request['url'], ie_key='Youtube', process=False)
+                stream['metadata'] = True
+                stream['is_live'] = bool(info.get('is_live'))
+                stream['duration'] = info.get('duration') or 0
+                stream['title'] = info.get('title') or ''
+                stream['subtitles'] = sorted((info.get('subtitles') or {}).keys())
+                continue
+            yt.params['format'] = request.get('format') or sys.argv[1]
+            info = yt.extract_info(request['url'], ie_key='Youtube')
+            stream['url'] = info.get('url', '')
+            if not stream['url']:
+                stream['error'] = 'no-audio'
+            stream['is_live'] = bool(info.get('is_live'))
+            stream['duration'] = info.get('duration') or 0
+            stream['title'] = info.get('title') or ''
+            stream['subtitles'] = sorted((info.get('subtitles') or {}).keys())
         except (KeyboardInterrupt, EOFError, IOError):
             break
         except DownloadError as why:
             # error message has already been printed
             sys.stderr.write('Could not extract video, try updating youtube-dl.\n')
+            if 'requested format not available' in str(why):
+                stream['error'] = 'no-audio'
+            else:
+                stream['error'] = 'unavailable'
         finally:
             try:
-                sys.stdout.write(stream + '\n')
+                sys.stdout.write(json.dumps(stream) + '\n')
                 sys.stdout.flush()
             except:
                 pass
@@ -61,64 +116,461 @@ except (KeyboardInterrupt, EOFError, IOError):
 //   https://trac.ffmpeg.org/ticket/3842
 const grabberFormats = "171/172/43/22/18"
 
+// Formats for the low and best quality preference, with the same reasoning as
+// above. Low prefers opus audio of about 50-70kbps, best prefers opus of
+// 160kbps.
+const lowGrabberFormats = "249/250/171/43/18"
+const bestGrabberFormats = "251/172/171/43/22/18"
+
+// Formats to use when playing video (-video): video with audio in a single
+// stream. First 720p (MP4), then 360p (WebM and MP4). Low quality prefers
+// 360p.
+const videoGrabberFormats = "22/43/18"
+const lowVideoGrabberFormats = "18/43/22"
+
+// Preferred containers for -container. YouTube uses WebM, which is a subset of
+// Matroska (MKV).
+const (
+	CONTAINER_WEBM = "webm"
+	CONTAINER_MP4  = "mp4"
+)
+
+// The container of every format used above. Formats in the preferred
+// container are moved to the front.
+var formatContainers = map[string]string{
+	"171": CONTAINER_WEBM,
+	"172": CONTAINER_WEBM,
+	"249": CONTAINER_WEBM,
+	"250": CONTAINER_WEBM,
+	"251": CONTAINER_WEBM,
+	"43":  CONTAINER_WEBM,
+	"139": CONTAINER_MP4,
+	"140": CONTAINER_MP4,
+	"141": CONTAINER_MP4,
+	"18":  CONTAINER_MP4,
+	"22":  CONTAINER_MP4,
+}
+
+// AAC audio formats (in the MP4 container), which aren't used unless MP4 is
+// preferred, as they don't seek well in some players (see above).
+var mp4AudioFormats = map[string]string{
+	QUALITY_LOW:    "139/140",
+	QUALITY_NORMAL: "140",
+	QUALITY_BEST:   "141/140",
+}
+
+var flagContainer = flag.String("container", "", "preferred stream container: webm (or mkv) or mp4, for players that seek better in one of them (default: webm for audio)")
+
+// Stream quality preferences, see SetQuality.
+const (
+	QUALITY_LOW    = "low"
+	QUALITY_NORMAL = "normal"
+	QUALITY_BEST   = "best"
+)
+
+// Errors returned when a stream could not be grabbed.
+var (
+	ErrNoAudioStream    = errors.New("no audio stream found")
+	ErrVideoUnavailable = errors.New("video unavailable")
+	ErrInvalidResponse  = errors.New("invalid response from grabber")
+	ErrCancelled        = errors.New("cancelled")
+	ErrNotInstalled     = errors.New("youtube-dl is not installed, install it with: pip install youtube-dl")
+	ErrGrabberStopped   = errors.New("video grabber has stopped")
+	ErrGrabberTimeout   = errors.New("video grabber did not respond in time")
+	ErrInvalidQuality   = errors.New("invalid quality, expected low, normal or best")
+)
+
+// When the grabber process has stopped (or could not be started), it is
+// restarted on the next request, but not sooner than this delay. The delay
+// doubles on every failure, up to the maximum.
+const GRABBER_RESTART_DELAY = time.Second
+const GRABBER_MAX_RESTART_DELAY = 5 * time.Minute
+
+// Streams normally expire in 6 hours, give it a margin of one hour. Streams
+// are fetched again when they expire within STREAM_EXPIRY_MARGIN.
+const STREAM_EXPIRES = 5 * time.Hour
+const STREAM_EXPIRY_MARGIN = time.Hour
+
+// How long to wait for the grabber to exit after SIGINT before killing it.
+const GRABBER_QUIT_TIMEOUT = 5 * time.Second
+
+// grabberRequest is a single line of input to the python grabber.
+type grabberRequest struct {
+	URL      string `json:"url"`
+	Format   string `json:"format"`
+	Playlist bool   `json:"playlist,omitempty"` // list the videos of a playlist instead
+	Metadata bool   `json:"metadata,omitempty"` // only get the metadata, not the stream
+}
+
+// grabberResponse is a single line of output of the python grabber.
+type grabberResponse struct {
+	URL       string   `json:"url"`
+	IsLive    bool     `json:"is_live"`
+	Duration  float64  `json:"duration"` // in seconds, 0 if unknown
+	Title     string   `json:"title"`
+	Error     string   `json:"error"`     // "no-audio", "unavailable", "not-installed" or empty
+	Entries   []string `json:"entries"`   // video IDs, for playlist requests
+	Subtitles []string `json:"subtitles"` // language codes of the subtitles
+	Metadata  bool     `json:"metadata"`  // true for metadata requests, which have no URL
+}
+
+// err returns the error reported by the grabber, or nil if a stream was found.
+func (r *grabberResponse) err() error {
+	switch r.Error {
+	case "":
+		if r.URL == "" && r.Entries == nil && !r.Metadata {
+			return ErrNoAudioStream
+		}
+		return nil
+	case "no-audio":
+		return ErrNoAudioStream
+	case "not-installed":
+		return ErrNotInstalled
+	default:
+		return ErrVideoUnavailable
+	}
+}
+
+// Metadata is information about a video, which stays valid after the stream
+// has expired.
+type Metadata struct {
+	Title     string
+	Duration  time.Duration // 0 if unknown
+	Subtitles []string      // language codes of the available subtitles
+}
+
+// Maximum number of playlist titles to keep. The cache is simply cleared when
+// it gets too big.
+const MAX_PLAYLIST_TITLES = 100
+
+// Maximum number of videos to keep metadata of. The least recently used
+// metadata is removed first.
+const MAX_METADATA = 1000
+
+var flagGrabberTimeout = flag.Duration("grabber-timeout", time.Minute, "restart the video grabber when it doesn't answer a request within this time, e.g. when it hangs on a network problem (0=wait forever)")
+var flagStreamCache = flag.Int("stream-cache", 50, "maximum number of stream URLs to keep, the least recently used are removed first (the current and upcoming videos are always kept)")
+
 type VideoGrabber struct {
-	streams      map[string]*VideoURL // map of video ID to stream gotten from youtube-dl
-	streamsMutex sync.Mutex
-	cmd          *exec.Cmd
-	cmdMutex     sync.Mutex
-	cmdStdin     io.Writer
-	cmdStdout    *bufio.Reader
+	streams       map[string]*VideoURL // map of video ID to stream gotten from youtube-dl
+	streamsLRU    *lruList             // use order of streams, protected by streamsMutex
+	active        map[string]bool      // videos whose streams are never evicted, see SetActive
+	streamsMutex  sync.Mutex
+	metadata      map[string]Metadata // map of video ID to metadata
+	metadataLRU   *lruList            // use order of metadata, protected by metadataMutex
+	listTitles    map[string]string   // map of playlist ID to title, protected by metadataMutex
+	metadataMutex sync.Mutex
+	cmd           *exec.Cmd // nil when the process isn't running
+	running       int32     // 1 while cmd is running, must be accessed atomically
+	cmdMutex      sync.Mutex
+	cmdStdin      io.Writer
+	cmdStdout     *bufio.Reader
+	cmdErr        error         // why the process isn't running
+	restartTime   time.Time     // don't restart the process before this time
+	restartDelay  time.Duration // the current restart delay, 0 after a successful request
+	clock         clock.Clock   // for the restart delay, replaced in tests
+}
+
+// Quality returns the stream quality preference: QUALITY_LOW, QUALITY_NORMAL
+// or QUALITY_BEST.
+func Quality() string {
+	quality, err := config.Get().GetString("player.quality", func() (string, error) {
+		return QUALITY_NORMAL, nil
+	})
+	if err != nil {
+		logger.Warnln("could not get quality:", err)
+		return QUALITY_NORMAL
+	}
+	return quality
+}
+
+// SetQuality changes the stream quality preference. Low quality saves
+// bandwidth on metered connections. The preference is stored in the config
+// file and applies to streams fetched from now on.
+func SetQuality(quality string) error {
+	switch quality {
+	case QUALITY_LOW, QUALITY_NORMAL, QUALITY_BEST:
+	default:
+		return ErrInvalidQuality
+	}
+
+	logger.Println("Setting quality to", quality)
+	config.Get().Set("player.quality", quality)
+	return nil
+}
+
+// grabberFormatsFor returns the youtube-dl format string for the given
+// quality preference.
+func grabberFormatsFor(quality string) string {
+	var formats string
+	switch {
+	case *flagVideo && quality == QUALITY_LOW:
+		formats = lowVideoGrabberFormats
+	case *flagVideo:
+		formats = videoGrabberFormats
+	case quality == QUALITY_LOW:
+		formats = lowGrabberFormats
+	case quality == QUALITY_BEST:
+		formats = bestGrabberFormats
+	default:
+		formats = grabberFormats
+	}
+
+	container := preferredContainer()
+	if container == CONTAINER_MP4 && !*flagVideo {
+		formats = mp4AudioFormats[quality] + "/" + formats
+	}
+	return preferFormats(formats, container)
+}
+
+// preferredContainer returns the container set with -container, or an empty
+// string if there is no preference.
+func preferredContainer() string {
+	switch strings.ToLower(*flagContainer) {
+	case CONTAINER_WEBM, "mkv":
+		return CONTAINER_WEBM
+	case CONTAINER_MP4:
+		return CONTAINER_MP4
+	default:
+		return ""
+	}
+}
+
+// preferFormats moves the formats in the given container to the front of the
+// youtube-dl format string, keeping their order otherwise.
+func preferFormats(formats, container string) string {
+	if container == "" {
+		return formats
+	}
+	var preferred, other []string
+	for _, format := range strings.Split(formats, "/") {
+		if formatContainers[format] == container {
+			preferred = append(preferred, format)
+		} else {
+			other = append(other, format)
+		}
+	}
+	return strings.Join(append(preferred, other...), "/")
+}
+
+// grabberCommand returns the command that runs the grabber. Tests replace it
+// with a fake grabber.
+var grabberCommand = func(formats, cacheDir string) *exec.Cmd {
+	return exec.Command("python", "-c", pythonGrabber, formats, cacheDir)
 }
 
 func NewVideoGrabber() *VideoGrabber {
-	vg := VideoGrabber{}
-	vg.streams = make(map[string]*VideoURL)
+	return newVideoGrabber(clock.Real)
+}
 
-	cacheDir := *cacheDir
-	if cacheDir != "" {
-		cacheDir = cacheDir + "/" + "youtube-dl"
+// newVideoGrabber is NewVideoGrabber with the clock to use for the restart
+// delay.
+func newVideoGrabber(clk clock.Clock) *VideoGrabber {
+	if *flagContainer != "" && preferredContainer() == "" {
+		logger.Warnf("unknown container %q for -container, expected webm, mkv or mp4\n", *flagContainer)
 	}
 
+	vg := VideoGrabber{}
+	vg.clock = clk
+	vg.streams = make(map[string]*VideoURL)
+	vg.streamsLRU = newLRUList()
+	vg.active = make(map[string]bool)
+	vg.metadata = make(map[string]Metadata)
+	vg.metadataLRU = newLRUList()
+	vg.listTitles = make(map[string]string)
+
 	// Start the process in a separate goroutine.
 	vg.cmdMutex.Lock()
 	go func() {
 		defer vg.cmdMutex.Unlock()
 
-		vg.cmd = exec.Command("python", "-c", pythonGrabber, grabberFormats, cacheDir)
-		stdout, err := vg.cmd.StdoutPipe()
+		err := vg.startProcess()
 		if err != nil {
-			logger.Fatal(err)
+			vg.stopped(err)
 		}
-		vg.cmdStdout = bufio.NewReader(stdout)
-		vg.cmdStdin, err = vg.cmd.StdinPipe()
-		if err != nil {
-			logger.Fatal(err)
+	}()
+
+	return &vg
+}
+
+// startProcess starts the python grabber. It must be called with cmdMutex
+// held.
+func (vg *VideoGrabber) startProcess() error {
+	cacheDir := *cacheDir
+	if cacheDir != "" {
+		cacheDir = cacheDir + "/" + "youtube-dl"
+	}
+
+	cmd := grabberCommand(grabberFormatsFor(Quality()), cacheDir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	vg.cmd = cmd
+	vg.cmdStdin = stdin
+	vg.cmdStdout = bufio.NewReader(stdout)
+	vg.cmdErr = nil
+	atomic.StoreInt32(&vg.running, 1)
+	return nil
+}
+
+// Running returns true if the grabber process has been started and hasn't
+// stopped since.
+func (vg *VideoGrabber) Running() bool {
+	return atomic.LoadInt32(&vg.running) != 0
+}
+
+// stopped cleans up after the grabber process has stopped or couldn't be
+// started, and schedules a restart. It must be called with cmdMutex held.
+func (vg *VideoGrabber) stopped(err error) {
+	if vg.cmd != nil {
+		// It may still be running when it sent garbage.
+		vg.cmd.Process.Kill()
+		vg.cmd.Wait()
+		vg.cmd = nil
+	}
+	atomic.StoreInt32(&vg.running, 0)
+	vg.cmdErr = err
+
+	if vg.restartDelay == 0 {
+		vg.restartDelay = GRABBER_RESTART_DELAY
+	} else if vg.restartDelay *= 2; vg.restartDelay > GRABBER_MAX_RESTART_DELAY {
+		vg.restartDelay = GRABBER_MAX_RESTART_DELAY
+	}
+	vg.restartTime = vg.clock.Now().Add(vg.restartDelay)
+
+	logger.Errf("could not run video grabber: %s (retrying in %s)\n", err, vg.restartDelay)
+}
+
+// fetch sends a single request to the grabber (usually for the stream of a
+// video), restarting the grabber when it isn't running. It must be called with
+// cmdMutex held.
+func (vg *VideoGrabber) fetch(request grabberRequest) (grabberResponse, error) {
+	var response grabberResponse
+
+	if vg.cmd == nil {
+		if vg.clock.Now().Before(vg.restartTime) {
+			return response, vg.cmdErr
 		}
-		vg.cmd.Stderr = os.Stderr
-		err = vg.cmd.Start()
+		logger.Println("Restarting video grabber")
+		err := vg.startProcess()
 		if err != nil {
-			logger.Fatal("Could not start video stream grabber:", err)
+			vg.stopped(err)
+			return response, err
 		}
+	}
 
+	line, err := json.Marshal(request)
+	if err != nil {
+		// should not happen
+		panic(err)
+	}
+
+	// Write errors are ignored: when the process has exited, it may still
+	// have written a message explaining why.
+	vg.cmdStdin.Write(append(line, '\n'))
+	output, err := vg.readLine()
+	if err != nil {
+		vg.stopped(err)
+		return response, err
+	}
+
+	err = json.Unmarshal([]byte(output), &response)
+	if err != nil {
+		logger.Errln("could not parse grabber output:", err)
+		return response, ErrInvalidResponse
+	}
+
+	err = response.err()
+	if err == ErrNotInstalled {
+		vg.stopped(err)
+		return response, err
+	}
+
+	vg.restartDelay = 0
+	return response, err
+}
+
+// readLine reads a response line from the grabber. When the grabber doesn't
+// respond within -grabber-timeout, it is killed and ErrGrabberTimeout is
+// returned, so a hanging grabber doesn't block all other requests. It must be
+// called with cmdMutex held.
+func (vg *VideoGrabber) readLine() (string, error) {
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	stdout := vg.cmdStdout
+	go func() {
+		line, err := stdout.ReadString('\n')
+		done <- result{line, err}
 	}()
 
-	return &vg
+	var timeout <-chan time.Time
+	if *flagGrabberTimeout > 0 {
+		timer := time.NewTimer(*flagGrabberTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return "", ErrGrabberStopped
+		}
+		return r.line, nil
+	case <-timeout:
+		logger.Errf("video grabber did not respond within %s, killing it\n", *flagGrabberTimeout)
+		vg.cmd.Process.Kill()
+		// The read fails now the process is gone.
+		<-done
+		return "", ErrGrabberTimeout
+	}
 }
 
 func (vg *VideoGrabber) Quit() {
 	vg.cmdMutex.Lock()
 	defer vg.cmdMutex.Unlock()
 
-	err := vg.cmd.Process.Signal(os.Interrupt)
-	if err != nil {
-		logger.Fatal("could not send SIGINT:", err)
+	if vg.cmd == nil {
+		// not running
+		return
 	}
 
+	cmd := vg.cmd
+
 	// Wait until exit, and free resources
-	err = vg.cmd.Wait()
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	err := cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		logger.Warnln("could not send SIGINT to video grabber, killing it:", err)
+		cmd.Process.Kill()
+	}
+
+	select {
+	case err = <-exited:
+	case <-time.After(GRABBER_QUIT_TIMEOUT):
+		logger.Warnln("video grabber did not quit in time, killing it")
+		cmd.Process.Kill()
+		err = <-exited
+	}
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); !ok {
-			logger.Fatal("process could not be stopped:", err)
+			logger.Warnln("video grabber could not be stopped:", err)
 		}
 	}
 }
@@ -129,6 +581,12 @@ func (vg *VideoGrabber) GetStream(videoId string) string {
 	return vg.getStream(videoId).GetURL()
 }
 
+// GetVideoURL returns the VideoURL object for videoId, which may still be
+// fetching the stream. Use its methods to wait for the result.
+func (vg *VideoGrabber) GetVideoURL(videoId string) *VideoURL {
+	return vg.getStream(videoId)
+}
+
 func (vg *VideoGrabber) getStream(videoId string) *VideoURL {
 	vg.streamsMutex.Lock()
 	defer vg.streamsMutex.Unlock()
@@ -137,57 +595,274 @@ func (vg *VideoGrabber) getStream(videoId string) *VideoURL {
 		panic("empty video ID")
 	}
 
+	quality := Quality()
+
 	stream, ok := vg.streams[videoId]
 	if ok {
-		if !stream.WillExpire() {
-			return stream
-		} else {
+		if stream.willExpireAt(vg.clock.Now()) {
 			logger.Println("Stream has expired for ID:", videoId)
+		} else if stream.quality != quality {
+			logger.Println("Quality has changed for ID:", videoId)
+		} else {
+			vg.streamsLRU.touch(videoId)
+			return stream
 		}
 	}
 
 	videoURL := "https://www.youtube.com/watch?v=" + videoId
 	logger.Println("Fetching video stream for URL", videoURL)
 
-	// Streams normally expire in 6 hour, give it a margin of one hour.
-	stream = &VideoURL{videoId: videoId, expires: time.Now().Add(5 * time.Hour)}
+	stream = &VideoURL{videoId: videoId, quality: quality, expires: vg.clock.Now().Add(STREAM_EXPIRES), pending: true}
 	stream.fetchMutex.Lock()
 
 	vg.streams[videoId] = stream
+	vg.streamsLRU.touch(videoId)
+	vg.evictStreams()
 
-	go func() {
+	grabberPool.submit(func() {
 		vg.cmdMutex.Lock()
 		defer vg.cmdMutex.Unlock()
 
-		io.WriteString(vg.cmdStdin, videoURL+"\n")
-		line, err := vg.cmdStdout.ReadString('\n')
-		if err != nil {
-			logger.Fatal("could not grab video:", err)
+		vg.streamsMutex.Lock()
+		stream.pending = false
+		cancelled := stream.cancelled
+		vg.streamsMutex.Unlock()
+		if cancelled {
+			logger.Println("Cancelled fetching stream for", videoURL)
+			stream.err = ErrCancelled
+			stream.fetchMutex.Unlock()
+			return
 		}
 
-		stream.url = line[:len(line)-1]
+		response, err := vg.fetch(grabberRequest{URL: videoURL, Format: grabberFormatsFor(quality)})
+		stream.err = err
+		stream.url = response.URL
+		stream.isLive = response.IsLive
+		stream.duration = time.Duration(response.Duration * float64(time.Second))
 		stream.fetchMutex.Unlock()
 
+		if stream.err != nil {
+			logger.Warnf("could not get stream for %s: %s\n", videoURL, stream.err)
+
+			// Don't cache the failure, so the video can be tried again.
+			vg.streamsMutex.Lock()
+			if vg.streams[videoId] == stream {
+				vg.removeStream(videoId)
+			}
+			vg.streamsMutex.Unlock()
+			return
+		}
+
 		logger.Println("Got stream for", videoURL)
 
+		vg.storeMetadata(videoId, Metadata{response.Title, stream.duration, response.Subtitles})
+
 		expires, err := getExpiresFromURL(stream.url)
 		if err != nil {
 			logger.Warnln("failed to extract expires from video URL:", err)
 		} else if expires.Before(stream.expires) {
 			logger.Warnln("URL expires before the estimated expires!")
 		}
-	}()
+	})
 
 	return stream
 }
 
+// fetchInPool does a request to the grabber in the grabber pool, and waits for
+// the response.
+func (vg *VideoGrabber) fetchInPool(request grabberRequest) (response grabberResponse, err error) {
+	grabberPool.run(func() {
+		vg.cmdMutex.Lock()
+		defer vg.cmdMutex.Unlock()
+		response, err = vg.fetch(request)
+	})
+	return
+}
+
+// GetMix returns the videos of the mix (auto-generated playlist) listId,
+// continuing from videoId. It blocks until the grabber has listed them.
+func (vg *VideoGrabber) GetMix(listId, videoId string) ([]string, error) {
+	mixURL := "https://www.youtube.com/watch?v=" + url.QueryEscape(videoId) + "&list=" + url.QueryEscape(listId)
+	logger.Println("Fetching mix for URL", mixURL)
+
+	response, err := vg.fetchInPool(grabberRequest{URL: mixURL, Playlist: true})
+	if err != nil {
+		return nil, err
+	}
+	return response.Entries, nil
+}
+
+// GetPlaylistTitle returns the title of the playlist listId. The title of a
+// mix depends on the video it started with, videoId. Titles are cached. It
+// blocks until the grabber has fetched the title.
+func (vg *VideoGrabber) GetPlaylistTitle(listId, videoId string) (string, error) {
+	vg.metadataMutex.Lock()
+	title, ok := vg.listTitles[listId]
+	vg.metadataMutex.Unlock()
+	if ok {
+		return title, nil
+	}
+
+	listURL := "https://www.youtube.com/playlist?list=" + url.QueryEscape(listId)
+	if IsMix(listId) {
+		// Mixes can only be listed from a video.
+		listURL = "https://www.youtube.com/watch?v=" + url.QueryEscape(videoId) + "&list=" + url.QueryEscape(listId)
+	}
+	logger.Println("Fetching playlist title for URL", listURL)
+
+	response, err := vg.fetchInPool(grabberRequest{URL: listURL, Playlist: true})
+	if err != nil {
+		return "", err
+	}
+
+	vg.metadataMutex.Lock()
+	if len(vg.listTitles) >= MAX_PLAYLIST_TITLES {
+		vg.listTitles = make(map[string]string)
+	}
+	vg.listTitles[listId] = response.Title
+	vg.metadataMutex.Unlock()
+	return response.Title, nil
+}
+
+// cachedStreams returns the streams in the cache, sorted by video ID.
+func (vg *VideoGrabber) cachedStreams() []StreamState {
+	vg.streamsMutex.Lock()
+	defer vg.streamsMutex.Unlock()
+
+	streams := make([]StreamState, 0, len(vg.streams))
+	for videoId, stream := range vg.streams {
+		streams = append(streams, StreamState{videoId, stream.quality, stream.pending, stream.expires})
+	}
+	sort.Slice(streams, func(i, j int) bool {
+		return streams[i].VideoId < streams[j].VideoId
+	})
+	return streams
+}
+
+// FetchMetadata fetches the metadata of a video, unless it is already known.
+// Only the metadata is fetched, so the stream cache isn't touched. It blocks
+// until the grabber has fetched it.
+func (vg *VideoGrabber) FetchMetadata(videoId string) error {
+	if _, ok := vg.GetMetadata(videoId); ok {
+		return nil
+	}
+
+	videoURL := "https://www.youtube.com/watch?v=" + videoId
+	logger.Println("Fetching metadata for URL", videoURL)
+	response, err := vg.fetchInPool(grabberRequest{URL: videoURL, Metadata: true})
+	if err != nil {
+		return err
+	}
+	vg.storeMetadata(videoId, Metadata{response.Title, time.Duration(response.Duration * float64(time.Second)), response.Subtitles})
+	return nil
+}
+
+// storeMetadata adds metadata to the cache, removing the least recently used
+// metadata when the cache is full.
+func (vg *VideoGrabber) storeMetadata(videoId string, metadata Metadata) {
+	vg.metadataMutex.Lock()
+	defer vg.metadataMutex.Unlock()
+
+	vg.metadata[videoId] = metadata
+	vg.metadataLRU.touch(videoId)
+	for len(vg.metadata) > MAX_METADATA {
+		oldest, _ := vg.metadataLRU.oldest(nil)
+		vg.metadataLRU.remove(oldest)
+		delete(vg.metadata, oldest)
+	}
+}
+
+// GetMetadata returns the metadata of videoId, if it has been fetched before.
+func (vg *VideoGrabber) GetMetadata(videoId string) (Metadata, bool) {
+	vg.metadataMutex.Lock()
+	defer vg.metadataMutex.Unlock()
+
+	metadata, ok := vg.metadata[videoId]
+	if ok {
+		vg.metadataLRU.touch(videoId)
+	}
+	return metadata, ok
+}
+
+// SetActive sets the videos that are playing or coming up soon. Their streams
+// are never evicted from the cache.
+func (vg *VideoGrabber) SetActive(videoIds []string) {
+	vg.streamsMutex.Lock()
+	defer vg.streamsMutex.Unlock()
+
+	vg.active = make(map[string]bool, len(videoIds))
+	for _, videoId := range videoIds {
+		vg.active[videoId] = true
+	}
+}
+
+// evictStreams removes the least recently used streams until there are at most
+// -stream-cache streams, keeping active and pending streams. Must be called
+// with streamsMutex held.
+func (vg *VideoGrabber) evictStreams() {
+	for len(vg.streams) > *flagStreamCache {
+		videoId, ok := vg.streamsLRU.oldest(func(videoId string) bool {
+			return vg.active[videoId] || vg.streams[videoId].pending
+		})
+		if !ok {
+			// Everything in the cache is in use.
+			return
+		}
+		vg.removeStream(videoId)
+	}
+}
+
+// removeStream removes a stream from the cache. Must be called with
+// streamsMutex held.
+func (vg *VideoGrabber) removeStream(videoId string) {
+	delete(vg.streams, videoId)
+	vg.streamsLRU.remove(videoId)
+}
+
+// Cancel cancels fetching the stream for videoId, if the grabber hasn't started
+// on it yet. The grabber fetches one stream at a time, so this prevents it from
+// spending time on videos that won't be played anymore.
+func (vg *VideoGrabber) Cancel(videoId string) {
+	vg.streamsMutex.Lock()
+	defer vg.streamsMutex.Unlock()
+
+	stream, ok := vg.streams[videoId]
+	if !ok || !stream.pending {
+		return
+	}
+	stream.cancelled = true
+	vg.removeStream(videoId)
+}
+
+// Forget removes the stream for videoId from the cache, so that it is fetched
+// again next time. This is used when the stream turns out not to work.
+func (vg *VideoGrabber) Forget(videoId string) {
+	vg.streamsMutex.Lock()
+	defer vg.streamsMutex.Unlock()
+
+	stream, ok := vg.streams[videoId]
+	if !ok || stream.pending {
+		return
+	}
+	vg.removeStream(videoId)
+}
+
 type VideoURL struct {
 	videoId    string
+	quality    string // quality preference at the time of fetching
+	pending    bool   // waiting for the grabber, protected by streamsMutex
+	cancelled  bool   // protected by streamsMutex
 	fetchMutex sync.RWMutex
 	url        string
+	err        error
+	isLive     bool
+	duration   time.Duration
 	expires    time.Time
 }
 
+// getExpiresFromURL returns the expiry time of a stream URL, from its 'expire'
+// query parameter (a Unix timestamp). It returns an error when the parameter
+// is missing or invalid.
 func getExpiresFromURL(videoURL string) (time.Time, error) {
 	u, err := url.Parse(videoURL)
 	if err != nil {
@@ -207,9 +882,22 @@ func getExpiresFromURL(videoURL string) (time.Time, error) {
 	return time.Unix(seconds, 0), nil
 }
 
-// WillExpire returns true if this stream will expire within an hour.
+// WillExpire returns true if this stream will expire within
+// STREAM_EXPIRY_MARGIN.
 func (u *VideoURL) WillExpire() bool {
-	return !u.expires.IsZero() && u.expires.Before(time.Now().Add(time.Hour))
+	return u.willExpireAt(time.Now())
+}
+
+// willExpireAt returns true if this stream will expire within
+// STREAM_EXPIRY_MARGIN of the given time. A stream without expiry time never
+// expires.
+func (u *VideoURL) willExpireAt(now time.Time) bool {
+	return !u.expires.IsZero() && u.expires.Before(now.Add(STREAM_EXPIRY_MARGIN))
+}
+
+// Expires returns the (estimated) time at which the stream URL stops working.
+func (u *VideoURL) Expires() time.Time {
+	return u.expires
 }
 
 // Gets the video stream URL, possibly waiting until that video has been fetched
@@ -221,6 +909,33 @@ func (u *VideoURL) GetURL() string {
 	return u.url
 }
 
+// Err returns the reason why the stream could not be fetched, or nil if
+// there was no error. It may wait until the video has been fetched.
+func (u *VideoURL) Err() error {
+	u.fetchMutex.RLock()
+	defer u.fetchMutex.RUnlock()
+
+	return u.err
+}
+
+// IsLive returns true if this is a live stream, possibly waiting until the
+// video has been fetched.
+func (u *VideoURL) IsLive() bool {
+	u.fetchMutex.RLock()
+	defer u.fetchMutex.RUnlock()
+
+	return u.isLive
+}
+
+// Duration returns the duration of the video as reported by the grabber, or 0
+// if it is unknown. It may wait until the video has been fetched.
+func (u *VideoURL) Duration() time.Duration {
+	u.fetchMutex.RLock()
+	defer u.fetchMutex.RUnlock()
+
+	return u.duration
+}
+
 func (u *VideoURL) String() string {
 	return "<VideoURL " + u.videoId + ">"
 }
@@ -0,0 +1,195 @@
+package mp
+
+import (
+	"flag"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aykevl/plaincast/clock"
+)
+
+func TestGetExpiresFromURL(t *testing.T) {
+	expire := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	u := "https://r1---sn-example.googlevideo.com/videoplayback?expire=" + strconv.FormatInt(expire.Unix(), 10) + "&id=o-abc&itag=251"
+	got, err := getExpiresFromURL(u)
+	if err != nil {
+		t.Fatal("could not get expiry:", err)
+	}
+	if !got.Equal(expire) {
+		t.Errorf("got %s, want %s", got, expire)
+	}
+
+	for _, u := range []string{
+		"https://r1---sn-example.googlevideo.com/videoplayback?id=o-abc&itag=251",
+		"https://r1---sn-example.googlevideo.com/videoplayback?expire=soon",
+		"https://r1---sn-example.googlevideo.com/videoplayback?expire=%zz",
+		"",
+	} {
+		if got, err := getExpiresFromURL(u); err == nil {
+			t.Errorf("%q: got %s, want an error", u, got)
+		}
+	}
+}
+
+func TestWillExpire(t *testing.T) {
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, test := range []struct {
+		expires time.Time
+		expired bool
+	}{
+		{time.Time{}, false}, // unknown, never expires
+		{now.Add(STREAM_EXPIRES), false},
+		{now.Add(STREAM_EXPIRY_MARGIN + time.Second), false},
+		{now.Add(STREAM_EXPIRY_MARGIN - time.Second), true},
+		{now, true},
+		{now.Add(-time.Hour), true},
+	} {
+		u := &VideoURL{expires: test.expires}
+		if got := u.willExpireAt(now); got != test.expired {
+			t.Errorf("expires at %s: got %v, want %v", test.expires, got, test.expired)
+		}
+	}
+}
+
+func TestStreamExpiry(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	vg := newVideoGrabber(c)
+	defer vg.Quit()
+
+	const videoId = "aaaaaaaaaaa"
+	stream := vg.GetVideoURL(videoId)
+	if stream.GetURL() == "" {
+		t.Fatal("could not get stream:", stream.Err())
+	}
+	// The fake grabber gives URLs that expire later than the estimate.
+	if want := c.Now().Add(STREAM_EXPIRES); !stream.Expires().Equal(want) {
+		t.Errorf("expires at %s, want the estimate %s", stream.Expires(), want)
+	}
+
+	// The stream is cached until it expires within STREAM_EXPIRY_MARGIN.
+	c.Advance(STREAM_EXPIRES - STREAM_EXPIRY_MARGIN - time.Minute)
+	if cached := vg.GetVideoURL(videoId); cached != stream {
+		t.Error("stream was fetched again before it would expire")
+	}
+	c.Advance(2 * time.Minute)
+	fresh := vg.GetVideoURL(videoId)
+	if fresh == stream {
+		t.Fatal("stream that will expire soon was not fetched again")
+	}
+	if fresh.GetURL() == "" {
+		t.Fatal("could not get stream again:", fresh.Err())
+	}
+}
+
+func TestGrabberRestartDelay(t *testing.T) {
+	starts := 0
+	grabberCommand = func(formats, cacheDir string) *exec.Cmd {
+		starts++ // called with cmdMutex held
+		return failingGrabberCommand(formats, cacheDir)
+	}
+	defer func() {
+		grabberCommand = fakeGrabberCommand
+	}()
+
+	c := clock.NewFake(time.Now())
+	vg := newVideoGrabber(c)
+	defer vg.Quit()
+
+	request := grabberRequest{URL: "https://www.youtube.com/watch?v=aaaaaaaaaaa"}
+	fetch := func() (int, error) {
+		vg.cmdMutex.Lock()
+		defer vg.cmdMutex.Unlock()
+		_, err := vg.fetch(request)
+		return starts, err
+	}
+
+	// The first process has been started by newVideoGrabber, and exits.
+	if n, err := fetch(); err == nil || n != 1 {
+		t.Fatalf("first fetch: got %d starts and error %v, want 1 start and an error", n, err)
+	}
+
+	// The delay doubles after every failed restart.
+	delay := GRABBER_RESTART_DELAY
+	for i := 2; i <= 4; i++ {
+		c.Advance(delay - time.Millisecond)
+		if n, err := fetch(); err == nil || n != i-1 {
+			t.Fatalf("fetch before %s: got %d starts and error %v, want %d starts and an error", delay, n, err, i-1)
+		}
+		c.Advance(time.Millisecond)
+		if n, err := fetch(); err == nil || n != i {
+			t.Fatalf("fetch after %s: got %d starts and error %v, want %d starts and an error", delay, n, err, i)
+		}
+		delay *= 2
+	}
+}
+
+func TestEvictStreams(t *testing.T) {
+	defer flag.Set("stream-cache", strconv.Itoa(*flagStreamCache))
+	flag.Set("stream-cache", "3")
+
+	vg := &VideoGrabber{
+		streams:    make(map[string]*VideoURL),
+		streamsLRU: newLRUList(),
+	}
+	add := func(videoId string, pending bool) {
+		vg.streams[videoId] = &VideoURL{videoId: videoId, pending: pending}
+		vg.streamsLRU.touch(videoId)
+	}
+
+	vg.streamsMutex.Lock()
+	defer vg.streamsMutex.Unlock()
+
+	add("s1", false) // active, never evicted
+	add("s2", true)  // still being fetched
+	add("s3", false)
+	add("s4", false)
+	add("s5", false)
+	vg.streamsLRU.touch("s3") // used again
+	vg.active = map[string]bool{"s1": true}
+
+	// The least recently used streams that aren't in use go first.
+	vg.evictStreams()
+	var cached []string
+	for _, videoId := range []string{"s1", "s2", "s3", "s4", "s5"} {
+		if _, ok := vg.streams[videoId]; ok {
+			cached = append(cached, videoId)
+		}
+	}
+	if !equalStrings(cached, []string{"s1", "s2", "s3"}) {
+		t.Errorf("cached after eviction: got %q, want [s1 s2 s3]", cached)
+	}
+
+	// Streams in use are kept, even when the cache is too big.
+	vg.active["s3"] = true
+	add("s6", true)
+	vg.evictStreams()
+	if len(vg.streams) != 4 {
+		t.Errorf("evicted a stream in use, %d streams left", len(vg.streams))
+	}
+}
+
+func TestEvictMetadata(t *testing.T) {
+	vg := &VideoGrabber{
+		metadata:    make(map[string]Metadata),
+		metadataLRU: newLRUList(),
+	}
+	for i := 0; i < MAX_METADATA; i++ {
+		vg.storeMetadata(strconv.Itoa(i), Metadata{Title: strconv.Itoa(i)})
+	}
+	// Getting metadata counts as using it.
+	if _, ok := vg.GetMetadata("0"); !ok {
+		t.Fatal("metadata is missing")
+	}
+
+	vg.storeMetadata("new", Metadata{Title: "new"})
+	if len(vg.metadata) != MAX_METADATA {
+		t.Errorf("got %d entries, want %d", len(vg.metadata), MAX_METADATA)
+	}
+	for videoId, want := range map[string]bool{"0": true, "1": false, "2": true, "new": true} {
+		if _, ok := vg.metadata[videoId]; ok != want {
+			t.Errorf("metadata of %s cached: got %v, want %v", videoId, ok, want)
+		}
+	}
+}
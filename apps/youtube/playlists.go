@@ -0,0 +1,125 @@
+package youtube
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/aykevl/plaincast/config"
+)
+
+// Config key of the named playlists: an object mapping a name to a list of
+// video IDs.
+const PLAYLISTS_KEY = "apps.youtube.playlists"
+
+// Maximum length of a saved playlist.
+const MAX_PLAYLIST_LENGTH = 500
+
+var ErrUnknownPlaylist = errors.New("unknown playlist")
+
+// Playlists returns the named playlists stored in the config. Invalid entries
+// (e.g. after editing the config by hand) are left out.
+func (yt *YouTube) Playlists() map[string][]string {
+	value, err := config.Get().Get(PLAYLISTS_KEY, func() (interface{}, error) {
+		return map[string]interface{}{}, nil
+	})
+	if err != nil {
+		logger.Warnln("could not load playlists:", err)
+		return make(map[string][]string)
+	}
+	return parsePlaylists(value)
+}
+
+// parsePlaylists converts the playlists as stored in the config, leaving out
+// invalid entries. A missing value has no playlists.
+func parsePlaylists(value interface{}) map[string][]string {
+	playlists := make(map[string][]string)
+	if value == nil {
+		return playlists
+	}
+	stored, ok := value.(map[string]interface{})
+	if !ok {
+		logger.Warnln("playlists in config are not an object")
+		return playlists
+	}
+
+	for name, list := range stored {
+		items, ok := list.([]interface{})
+		if !ok {
+			logger.Warnf("playlist %q in config is not a list\n", name)
+			continue
+		}
+		videoIds := make([]string, 0, len(items))
+		for _, item := range items {
+			if videoId, ok := item.(string); ok && validVideoId(videoId) {
+				videoIds = append(videoIds, videoId)
+			}
+		}
+		if len(videoIds) > 0 {
+			playlists[name] = videoIds
+		}
+	}
+	return playlists
+}
+
+// SavePlaylist stores a named playlist in the config, replacing the playlist
+// with the same name. An empty list removes the playlist.
+func (yt *YouTube) SavePlaylist(name string, videoIds []string) error {
+	if name == "" {
+		return errors.New("empty playlist name")
+	}
+	if len(videoIds) > MAX_PLAYLIST_LENGTH {
+		return errors.New("playlist is too long")
+	}
+	for _, videoId := range videoIds {
+		if !validVideoId(videoId) {
+			return errors.New("invalid video ID: " + videoId)
+		}
+	}
+
+	// Read and write the playlists at once, so that saving two playlists at
+	// the same time doesn't lose one of them.
+	config.Get().Update(PLAYLISTS_KEY, func(value interface{}) interface{} {
+		playlists := make(map[string]interface{})
+		for otherName, otherIds := range parsePlaylists(value) {
+			playlists[otherName] = stringsToInterfaces(otherIds)
+		}
+		if len(videoIds) == 0 {
+			delete(playlists, name)
+		} else {
+			playlists[name] = stringsToInterfaces(videoIds)
+		}
+		return playlists
+	})
+	return nil
+}
+
+// PlayPlaylist replaces the current playlist with the named playlist and starts
+// playing it. The app is started when it isn't running.
+func (yt *YouTube) PlayPlaylist(name string) error {
+	videoIds, ok := yt.Playlists()[name]
+	if !ok {
+		return ErrUnknownPlaylist
+	}
+
+	logger.Printf("Playing playlist %q (%d videos)\n", name, len(videoIds))
+	if player := yt.player(); player != nil {
+		player.SetPlaystate(videoIds, 0, 0, "")
+		return nil
+	}
+	if yt.Running() {
+		return errors.New("app is still starting")
+	}
+	yt.Start(url.Values{"videoIds": {strings.Join(videoIds, ",")}}.Encode())
+	return nil
+}
+
+// stringsToInterfaces converts a list of strings to the type used for lists in
+// the config, so the config contains the same types after a reload.
+func stringsToInterfaces(list []string) []interface{} {
+	result := make([]interface{}, len(list))
+	for i, s := range list {
+		result[i] = s
+	}
+	return result
+}
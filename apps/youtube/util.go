@@ -1,15 +1,86 @@
 package youtube
 
 import (
+	"encoding/json"
 	"errors"
 	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
-	"os"
+	"regexp"
+	"strconv"
+	"strings"
 )
 
+// YouTube video IDs are 11 characters of URL-safe base64.
+var videoIdPattern = regexp.MustCompile("^[A-Za-z0-9_-]{11}$")
+
+// Pairing codes are sent by the remote when launching the app over DIAL. They
+// are UUIDs or numeric codes, but allow some more in case the format changes.
+var pairingCodePattern = regexp.MustCompile("^[A-Za-z0-9_-]{1,64}$")
+
+// validPairingCode returns true if the code looks like a pairing code.
+func validPairingCode(pairingCode string) bool {
+	return pairingCodePattern.MatchString(pairingCode)
+}
+
+// validVideoId returns true if the ID looks like a YouTube video ID. IDs end up
+// in URLs and are passed to the video grabber, so anything else is rejected.
+func validVideoId(videoId string) bool {
+	return videoIdPattern.MatchString(videoId)
+}
+
+// parseVideoIds parses a comma-separated list of video IDs, as sent by the
+// remote. An empty string is an empty list.
+func parseVideoIds(videoIds string) ([]string, error) {
+	if videoIds == "" {
+		return []string{}, nil
+	}
+	playlist := strings.Split(videoIds, ",")
+	for _, videoId := range playlist {
+		if !validVideoId(videoId) {
+			return nil, errors.New("invalid video ID: " + strconv.Quote(videoId))
+		}
+	}
+	return playlist, nil
+}
+
+// parseStartArguments parses the POST data sent when launching the app over
+// DIAL. Usually that is form data, but some clients send a JSON object
+// instead. Values in a JSON object are converted to strings, so both can be
+// used in the same way.
+func parseStartArguments(postData string) (url.Values, error) {
+	postData = strings.TrimSpace(postData)
+	if !strings.HasPrefix(postData, "{") {
+		return url.ParseQuery(postData)
+	}
+
+	var object map[string]interface{}
+	err := json.Unmarshal([]byte(postData), &object)
+	if err != nil {
+		return nil, err
+	}
+	arguments := url.Values{}
+	for key, value := range object {
+		switch value := value.(type) {
+		case string:
+			arguments.Add(key, value)
+		case float64:
+			arguments.Add(key, strconv.FormatFloat(value, 'f', -1, 64))
+		case bool:
+			arguments.Add(key, strconv.FormatBool(value))
+		case []interface{}:
+			for _, item := range value {
+				if item, ok := item.(string); ok {
+					arguments.Add(key, item)
+				}
+			}
+		}
+	}
+	return arguments, nil
+}
+
 // zx generates a random string of bytes that is 12 characters long.
 // It is being used by some (unofficial) Google APIs.
 func zx() []byte {
@@ -65,14 +136,3 @@ func processRequest(resp *http.Response) ([]byte, error) {
 		return buf, nil
 	}
 }
-
-func printHTTPError(resp *http.Response) {
-	buf, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		logger.Errln("could not read error message:", err)
-	} else {
-		logger.Errln("response body:")
-		os.Stdout.Write(buf)
-		os.Stdout.Sync()
-	}
-}
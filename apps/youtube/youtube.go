@@ -3,26 +3,37 @@ package youtube
 import (
 	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/aykevl/plaincast/apps/youtube/mp"
+	"github.com/aykevl/plaincast/clock"
 	"github.com/aykevl/plaincast/config"
 	"github.com/aykevl/plaincast/log"
+	"github.com/aykevl/plaincast/notify"
 	"github.com/nu7hatch/gouuid"
 )
 
 var logger = log.New("youtube", "log YouTube app")
 
+var flagResetScreenId = flag.Bool("reset-screenid", false, "generate a new screen ID, for when pairing keeps failing (remotes need to pair again)")
+var flagSendDelay = flag.Duration("send-delay", 50*time.Millisecond, "collect messages to the remote for this long before sending them in a single request")
+var flagRecast = flag.Bool("recast", true, "play the video when a video is cast to the already running app (instead of only pairing)")
+var flagPauseOnDisconnect = flag.Bool("pause-on-disconnect", false, "pause playback when the last remote disconnects, and resume when a remote connects again")
+var flagPersistent = flag.Bool("persistent", false, "reset the session instead of quitting the YouTube app on fatal connection errors")
+
 // How often a new connection attempt should be done.
 // With a starting delay of 500ms that exponentially increases, this is about 5
 // minutes.
@@ -31,6 +42,29 @@ const RETRIES = 25
 // Initial retry timeout in milliseconds. This timeout increases exponentially.
 const RETRY_TIMEOUT = 500
 
+// Maximum timeout before resetting the session when running with -persistent.
+const MAX_RESET_TIMEOUT = 5 * time.Minute
+
+// Upper limit for the length of a chunk in the message channel. Messages are
+// small, a bigger length means the stream can't be parsed.
+const MAX_CHUNK_SIZE = 1024 * 1024
+
+// How often to try registering a pairing code, and the initial timeout between
+// attempts (doubled after every attempt).
+const PAIRING_ATTEMPTS = 4
+const PAIRING_RETRY_TIMEOUT = time.Second
+
+// What to do after a bind request, see channelResponseAction.
+type channelAction int
+
+const (
+	CHANNEL_CONNECTED   channelAction = iota // the message channel is open
+	CHANNEL_RECONNECT                        // reconnect with an initial request (Unknown SID)
+	CHANNEL_NEW_SESSION                      // start over with a new lounge token (410 Gone)
+	CHANNEL_RETRY                            // back off and try again (502)
+	CHANNEL_FAIL                             // unrecoverable error
+)
+
 // # Preventing race conditions & leaks
 //
 // There were a *lot* race conditions, but most have been fixed by now, using a
@@ -51,9 +85,10 @@ const RETRY_TIMEOUT = 500
 // The YouTube app can play the audio track of YouTube videos, and is designed
 // to be very lightweight (not running Chrome).
 type YouTube struct {
-	systemName   string
+	systemName   string // protected by sendMutex
 	running      bool
 	runningMutex sync.Mutex
+	startTime    time.Time // protected by runningMutex
 	// TODO split everything under here into a separate struct, so re-running
 	// the app won't clash with the previous run.
 	rid              *RandomID // generates random numbers for outgoing messages
@@ -63,22 +98,25 @@ type YouTube struct {
 	sendMutex        sync.Mutex
 	sid              string
 	gsessionid       string
-	aid              int32 // int32 is thread-safe on ARM and Intel processors
+	aid              int32     // index of the last received message, -1 at the start of a session
+	resync           bool      // messages have been missed, start a new session (protected by sendMutex)
+	channel          io.Closer // body of the message channel response, protected by sendMutex
 	mp               *mp.MediaPlayer
 	mpMutex          sync.Mutex // to quit the player safely
 	incomingMessages chan incomingMessage
 	outgoingMessages chan outgoingMessage
 	pairingCodes     chan string
+	clock            clock.Clock // for all retry timeouts and delays, replaced in tests
 }
 
 // JSON data structures for get_lounge_token_batch.
 type loungeTokenBatchJson struct {
-	Screens []screenTokenJson "screens"
+	Screens []screenTokenJson `json:"screens"`
 }
 type screenTokenJson struct {
-	ScreenId    string "screenId"
-	Expiration  int64  "expiration"
-	LoungeToken string "loungeToken"
+	ScreenId    string `json:"screenId"`
+	Expiration  int64  `json:"expiration"`
+	LoungeToken string `json:"loungeToken"`
 }
 
 // JSON data structure for messages received over the message channel.
@@ -90,6 +128,31 @@ type incomingMessage struct {
 	args    map[string]string
 }
 
+// JSON data structure for the devices in a loungeStatus message.
+type loungeDeviceJson struct {
+	Id   string `json:"id"`
+	Type string `json:"type"` // "REMOTE_CONTROL", or "LOUNGE_SCREEN" for this screen
+}
+
+// JSON data structure for state change events sent to the webhook.
+type stateEventJson struct {
+	App      string  `json:"app"`
+	State    string  `json:"state"`
+	VideoId  string  `json:"videoId,omitempty"`
+	Position float64 `json:"position"` // in seconds
+	Duration float64 `json:"duration"` // in seconds
+	Live     bool    `json:"live,omitempty"`
+}
+
+// Names of the states, as used in events.
+var stateNames = map[mp.State]string{
+	mp.STATE_STOPPED:   "stopped",
+	mp.STATE_PLAYING:   "playing",
+	mp.STATE_PAUSED:    "paused",
+	mp.STATE_BUFFERING: "buffering",
+	mp.STATE_SEEKING:   "seeking",
+}
+
 // A single outgoing message, to be fed to the outgoingMessages channel.
 type outgoingMessage struct {
 	command string
@@ -99,11 +162,23 @@ type outgoingMessage struct {
 // New returns a new YouTube object (app).
 func New(systemName string) *YouTube {
 	yt := YouTube{}
+	yt.clock = clock.Real
 	yt.systemName = systemName
 	yt.runQuit = make(chan struct{})
+	if *flagResetScreenId {
+		yt.ResetScreenId()
+	}
 	return &yt
 }
 
+// SetSystemName changes the name shown to remotes. Remotes see the new name
+// after the next request to the message channel.
+func (yt *YouTube) SetSystemName(name string) {
+	yt.sendMutex.Lock()
+	defer yt.sendMutex.Unlock()
+	yt.systemName = name
+}
+
 func (yt *YouTube) FriendlyName() string {
 	return "YouTube"
 }
@@ -115,21 +190,231 @@ func (yt *YouTube) Start(postData string) {
 	running := yt.running
 	yt.runningMutex.Unlock()
 
-	arguments, err := url.ParseQuery(postData)
-	// TODO proper error handling
+	arguments, err := parseStartArguments(postData)
 	if err != nil {
-		panic(err)
+		logger.Errf("could not parse POST data %q: %s\n", postData, err)
+		return
 	}
 
 	if running {
-		// Only use `pairingCode`, ignore `v` and `t` arguments.
-		yt.pairingCodes <- arguments["pairingCode"][0]
+		// Use `pairingCode`, and with -recast also the `v` and `t` arguments.
+		recast := *flagRecast && arguments.Get("v") != ""
+		pairingCode := arguments.Get("pairingCode")
+		if pairingCode == "" && !recast {
+			logger.Warnln("app is already running, ignoring start without pairing code")
+			return
+		}
+		if pairingCode != "" {
+			if validPairingCode(pairingCode) {
+				yt.pairingCodes <- pairingCode
+			} else {
+				logger.Warnf("ignoring invalid pairing code %q\n", pairingCode)
+			}
+		}
+		if recast {
+			if player := yt.player(); player != nil {
+				startVideo(arguments, player)
+			} else {
+				logger.Warnln("app is still starting, ignoring video")
+			}
+		}
 
 	} else {
 		yt.start(arguments)
 	}
 }
 
+// player returns the media player, or nil if the app isn't running.
+// Don't call it with mpMutex held: the player may block on playerEvents, which
+// also locks mpMutex. Calls on a player that has quit are ignored, so it is
+// safe to use the returned player after the app has stopped.
+func (yt *YouTube) player() *mp.MediaPlayer {
+	yt.mpMutex.Lock()
+	defer yt.mpMutex.Unlock()
+
+	return yt.mp
+}
+
+// JSON data structure for DebugState.
+type debugStateJson struct {
+	Running        bool           `json:"running"`
+	HasLoungeToken bool           `json:"hasLoungeToken"`
+	HasSID         bool           `json:"hasSID"`
+	HasGSessionId  bool           `json:"hasGSessionId"`
+	Connected      bool           `json:"connected"` // message channel is open
+	AID            int32          `json:"aid"`
+	Player         *mp.DebugState `json:"player,omitempty"`
+}
+
+// DebugState returns a snapshot of the connection state and the state of the
+// media player, for troubleshooting. It doesn't include secrets like the
+// lounge token.
+func (yt *YouTube) DebugState() interface{} {
+	yt.sendMutex.Lock()
+	state := debugStateJson{
+		Running:        yt.Running(),
+		HasLoungeToken: yt.loungeToken != "",
+		HasSID:         yt.sid != "",
+		HasGSessionId:  yt.gsessionid != "",
+		Connected:      yt.channel != nil,
+		AID:            yt.aid,
+	}
+	yt.sendMutex.Unlock()
+
+	if player := yt.player(); player != nil {
+		playerState := player.DebugState()
+		state.Player = &playerState
+	}
+	return state
+}
+
+// Ready returns true if the media player has started and is ready to play.
+func (yt *YouTube) Ready() bool {
+	player := yt.player()
+	return player != nil && player.Ready()
+}
+
+// Duck temporarily lowers the volume, see mp.MediaPlayer.Duck.
+func (yt *YouTube) Duck(volume int) {
+	if player := yt.player(); player != nil {
+		player.Duck(volume)
+	}
+}
+
+// Unduck restores the volume after Duck.
+func (yt *YouTube) Unduck() {
+	if player := yt.player(); player != nil {
+		player.Unduck()
+	}
+}
+
+// Pause pauses the currently playing video, if any.
+func (yt *YouTube) Pause() {
+	if player := yt.player(); player != nil {
+		player.Pause()
+	}
+}
+
+// Play resumes the current video when it was paused.
+func (yt *YouTube) Play() {
+	if player := yt.player(); player != nil {
+		player.Play()
+	}
+}
+
+// Playback returns the state and position of the current video, or false
+// when the app isn't running.
+func (yt *YouTube) Playback() (mp.Playback, bool) {
+	player := yt.player()
+	if player == nil {
+		return mp.Playback{}, false
+	}
+	return player.Playback(), true
+}
+
+// Follow plays the same as another instance, see MediaPlayer.Follow. The app
+// is started when it isn't running yet.
+func (yt *YouTube) Follow(playlist []string, index int, state mp.State, position, tolerance time.Duration) {
+	for _, videoId := range playlist {
+		if !validVideoId(videoId) {
+			logger.Warnf("not following, invalid video ID %q\n", videoId)
+			return
+		}
+	}
+
+	if player := yt.player(); player != nil {
+		player.Follow(playlist, index, state, position, tolerance)
+		return
+	}
+	if !yt.Running() && state != mp.STATE_STOPPED && len(playlist) > 0 {
+		// Start the app, the player follows on the next call.
+		logger.Println("Starting app to follow another instance")
+		yt.Start("")
+	}
+}
+
+// TogglePlayPause pauses the current video when it is playing, and plays it
+// otherwise.
+func (yt *YouTube) TogglePlayPause() {
+	if player := yt.player(); player != nil {
+		player.TogglePlayPause()
+	}
+}
+
+// Seek jumps to the given position in the current video.
+func (yt *YouTube) Seek(position time.Duration) {
+	if player := yt.player(); player != nil {
+		player.Seek(position)
+	}
+}
+
+// Next plays the next video in the playlist.
+func (yt *YouTube) Next() {
+	if player := yt.player(); player != nil {
+		player.Next()
+	}
+}
+
+// Previous plays the previous video in the playlist.
+func (yt *YouTube) Previous() {
+	if player := yt.player(); player != nil {
+		player.Previous()
+	}
+}
+
+// ResetScreenId forgets the screen ID and the lounge token, so that new ones
+// are generated. This may help when pairing keeps failing. When the app is
+// running, it reconnects with the new screen ID.
+func (yt *YouTube) ResetScreenId() {
+	logger.Println("Resetting screen ID")
+	config.Get().Delete("apps.youtube.screenId")
+
+	yt.sendMutex.Lock()
+	yt.loungeToken = ""
+	yt.sid = ""
+	yt.gsessionid = ""
+	channel := yt.channel
+	yt.sendMutex.Unlock()
+
+	if channel != nil {
+		// Makes handleMessageStream return, after which it reconnects.
+		channel.Close()
+	}
+}
+
+// Queue returns the videos in the playlist.
+func (yt *YouTube) Queue() []mp.QueueItem {
+	if player := yt.player(); player != nil {
+		return player.Queue()
+	}
+	return nil
+}
+
+// SwapIndex returns the current index and playlist, and jumps to index if the
+// current index is expected. See mp.MediaPlayer.SwapIndex.
+func (yt *YouTube) SwapIndex(expected, index int) (int, []string, bool) {
+	if player := yt.player(); player != nil {
+		return player.SwapIndex(expected, index)
+	}
+	return -1, nil, false
+}
+
+// AudioTracks returns the audio tracks of the currently playing video.
+func (yt *YouTube) AudioTracks() []mp.AudioTrack {
+	if player := yt.player(); player != nil {
+		return player.ListAudioTracks()
+	}
+	return nil
+}
+
+// SetAudioTrack switches the currently playing video to a different audio
+// track.
+func (yt *YouTube) SetAudioTrack(id int) {
+	if player := yt.player(); player != nil {
+		player.SetAudioTrack(id)
+	}
+}
+
 // Quit stops this app if it is running.
 func (yt *YouTube) Quit() {
 	// shut down everything about this app
@@ -144,9 +429,14 @@ func (yt *YouTube) Quit() {
 	yt.runQuit <- struct{}{}
 }
 
-func (yt *YouTube) init(arguments url.Values, stateChange chan mp.StateChange) {
+func (yt *YouTube) init(arguments url.Values, player *mp.MediaPlayer) error {
 	var err error
 
+	// playerEvents closes outgoingMessages when the player quits, so these
+	// must exist even when init fails.
+	yt.incomingMessages = make(chan incomingMessage, 5)
+	yt.outgoingMessages = make(chan outgoingMessage, 5)
+
 	yt.rid = NewRandomID()
 
 	yt.uuid, err = config.Get().GetString("apps.youtube.uuid", func() (string, error) {
@@ -157,33 +447,73 @@ func (yt *YouTube) init(arguments url.Values, stateChange chan mp.StateChange) {
 		return uuid.String(), nil
 	})
 	if err != nil {
-		panic(err)
+		return err
 	}
-	yt.incomingMessages = make(chan incomingMessage, 5)
-	yt.outgoingMessages = make(chan outgoingMessage, 5)
 
 	// This is a goroutine that receives messages from YouTube and starts a
 	// goroutine to send messages to YouTube.
 	go yt.connect()
 
-	if pairingCodes, ok := arguments["pairingCode"]; ok {
-		go func() {
-			yt.pairingCodes <- pairingCodes[0]
-		}()
+	if pairingCode := arguments.Get("pairingCode"); pairingCode != "" {
+		if validPairingCode(pairingCode) {
+			go func() {
+				yt.pairingCodes <- pairingCode
+			}()
+		} else {
+			logger.Warnf("ignoring invalid pairing code %q\n", pairingCode)
+		}
 	}
 
-	yt.mp = mp.New(stateChange)
+	yt.mpMutex.Lock()
+	yt.mp = player
+	yt.mpMutex.Unlock()
+
+	startVideo(arguments, player)
+
+	return nil
+}
+
+// startVideo plays the video in the `v` argument (if any), starting at `t`
+// and ending at `end`, replacing the current playlist. The `videoIds` argument
+// (used by PlayPlaylist) plays a whole playlist instead.
+func startVideo(arguments url.Values, player *mp.MediaPlayer) {
+	if videoIds := arguments.Get("videoIds"); videoIds != "" {
+		playlist, err := parseVideoIds(videoIds)
+		if err != nil {
+			logger.Warnln("ignoring videoIds:", err)
+		} else {
+			player.SetPlaystate(playlist, 0, 0, "")
+		}
+		return
+	}
 
 	video, ok := arguments["v"]
-	if ok && len(video[0]) > 0 {
+	if ok && len(video[0]) > 0 && !validVideoId(video[0]) {
+		logger.Warnf("ignoring invalid video ID %q\n", video[0])
+	} else if ok && len(video[0]) > 0 {
 		videoId := video[0]
 
-		position, err := time.ParseDuration(arguments["t"][0] + "s")
-		if err != nil {
-			panic(err)
+		position := time.Duration(0)
+		if t := arguments.Get("t"); t != "" {
+			var err error
+			position, err = time.ParseDuration(t + "s")
+			if err != nil {
+				logger.Warnln("could not parse t, starting at the beginning:", err)
+				position = 0
+			}
 		}
 
-		yt.mp.SetPlaystate([]string{videoId}, 0, position, "")
+		if end, ok := arguments["end"]; ok && len(end[0]) > 0 {
+			// Only play a clip of this video.
+			endPosition, err := time.ParseDuration(end[0] + "s")
+			if err != nil {
+				logger.Warnln("could not parse end:", err)
+			} else {
+				player.SetClipEnd(videoId, endPosition)
+			}
+		}
+
+		player.SetPlaystate([]string{videoId}, 0, position, "")
 	}
 }
 
@@ -191,6 +521,7 @@ func (yt *YouTube) start(arguments url.Values) {
 	yt.runningMutex.Lock()
 	defer yt.runningMutex.Unlock()
 	yt.running = true
+	yt.startTime = yt.clock.Now()
 
 	// Of all values, this one should not be initialized inside a goroutine
 	// because that's a race condition.
@@ -199,6 +530,25 @@ func (yt *YouTube) start(arguments url.Values) {
 	go yt.run(arguments)
 }
 
+// abort marks the app as stopped from within run(), when it couldn't be
+// started or has crashed. Quit() may be called at the same time: it holds
+// runningMutex while waiting for run() to receive from runQuit.
+func (yt *YouTube) abort() {
+	stopped := make(chan struct{})
+	go func() {
+		yt.runningMutex.Lock()
+		yt.running = false
+		yt.runningMutex.Unlock()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-yt.runQuit:
+		<-stopped
+	}
+}
+
 func (yt *YouTube) run(arguments url.Values) {
 	stateChange := make(chan mp.StateChange)
 	volumeChan := make(chan int, 1)
@@ -206,10 +556,37 @@ func (yt *YouTube) run(arguments url.Values) {
 	nowPlayingChan := make(chan mp.PlaylistState, 1)
 	// nowPlayingChan will ask for a signal inside playerEvents.
 
+	player, err := mp.New(stateChange)
+	if err != nil {
+		logger.Errln("could not start media player:", err)
+		yt.abort()
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			// Don't leave the app half alive: it would look like it is
+			// running while no messages are handled. Stop it, so it can be
+			// started again.
+			logger.Errf("app crashed: %v\n%s", r, debug.Stack())
+			yt.quitPlayer()
+			yt.abort()
+		}
+	}()
+
 	// This goroutine handles all signals coming from the media player.
 	go yt.playerEvents(stateChange, volumeChan, playlistChan, nowPlayingChan)
 
-	yt.init(arguments, stateChange)
+	err = yt.init(arguments, player)
+	if err != nil {
+		logger.Errln("could not start app:", err)
+		player.Quit()
+		yt.abort()
+		return
+	}
+
+	// Connected remotes by ID, for -pause-on-disconnect.
+	remotes := make(map[string]bool)
 
 	for {
 		select {
@@ -225,9 +602,28 @@ func (yt *YouTube) run(arguments url.Values) {
 			switch message.command {
 			case "remoteConnected":
 				logger.Printf("Remote connected: %s (%s)\n", message.args["name"], message.args["user"])
+				remotes[message.args["id"]] = true
+				if *flagPauseOnDisconnect && yt.mp.AutoResume() {
+					logger.Println("Resumed playback, a remote is connected again")
+				}
 			case "remoteDisconnected":
 				logger.Printf("Remote disconnected: %s (%s)\n", message.args["name"], message.args["user"])
+				delete(remotes, message.args["id"])
+				if *flagPauseOnDisconnect && len(remotes) == 0 && yt.mp.AutoPause() {
+					logger.Println("Paused playback, no remote is connected")
+				}
 			case "loungeStatus":
+				// Sent after connecting, with the remotes that are already
+				// connected.
+				ids, err := parseLoungeRemotes(message.args["devices"])
+				if err != nil {
+					logger.Warnln("could not parse loungeStatus devices:", err)
+					break
+				}
+				remotes = make(map[string]bool)
+				for _, id := range ids {
+					remotes[id] = true
+				}
 			case "getVolume":
 				yt.mp.RequestVolume(volumeChan)
 			case "setVolume":
@@ -250,7 +646,11 @@ func (yt *YouTube) run(arguments url.Values) {
 			case "getPlaylist":
 				yt.mp.RequestPlaylist(playlistChan)
 			case "setPlaylist":
-				playlist := strings.Split(message.args["videoIds"], ",")
+				playlist, err := parseVideoIds(message.args["videoIds"])
+				if err != nil {
+					logger.Warnln("ignoring setPlaylist:", err)
+					break
+				}
 
 				index, err := strconv.Atoi(message.args["currentIndex"])
 				if err != nil {
@@ -275,11 +675,19 @@ func (yt *YouTube) run(arguments url.Values) {
 
 				yt.mp.SetPlaystate(playlist, index, position, message.args["listId"])
 			case "updatePlaylist":
-				playlist := strings.Split(message.args["videoIds"], ",")
+				playlist, err := parseVideoIds(message.args["videoIds"])
+				if err != nil {
+					logger.Warnln("ignoring updatePlaylist:", err)
+					break
+				}
 				yt.mp.UpdatePlaylist(playlist, message.args["listId"])
 				yt.outgoingMessages <- outgoingMessage{"confirmPlaylistUpdate", map[string]string{"updated": "true"}}
 			case "setVideo":
 				videoId := message.args["videoId"]
+				if !validVideoId(videoId) {
+					logger.Warnf("ignoring setVideo with invalid video ID %q\n", videoId)
+					break
+				}
 				position, err := time.ParseDuration(message.args["currentTime"] + "s")
 				if err != nil {
 					logger.Warnln("could not parse currentTime:", err)
@@ -290,19 +698,24 @@ func (yt *YouTube) run(arguments url.Values) {
 			case "getNowPlaying":
 				yt.mp.RequestPlaylist(nowPlayingChan)
 			case "getSubtitlesTrack":
-				// Just send out an empty message. It looks like the Android
-				// YouTube client doesn't care too much about this message
-				// anyway. Usually `getSubtitlesTrack` is only sent on
-				// connection, and not asked (or sent) when switching videos,
-				// which is kinda odd to me. When a video is playing while this
-				// message is sent, the videoId is sent with it, and some other
-				// stuff like `languageCode` to indicate the currently playing
-				// subtitles track. Again, this is not updated when the video
-				// changes.
-				// No subtitles are visible anyway on a headless Chromecast
-				// installation, and the Android client doesn't seem to change
-				// it's behavior much when leaving out this message.
-				yt.outgoingMessages <- outgoingMessage{"onSubtitlesTrackChanged", map[string]string{"videoId": ""}}
+				// It looks like the Android YouTube client doesn't care too
+				// much about this message. Usually `getSubtitlesTrack` is only
+				// sent on connection, and not asked (or sent) when switching
+				// videos, which is kinda odd to me. When a video is playing
+				// while this message is sent, the videoId is sent with it, and
+				// some other stuff like `languageCode` to indicate the
+				// currently playing subtitles track. Again, this is not
+				// updated when the video changes.
+				// No subtitles are visible on a headless installation, so no
+				// track is selected. The available tracks are sent anyway, as
+				// some controllers only show the CC button when there are
+				// any.
+				videoId, languages := yt.mp.Subtitles()
+				args := map[string]string{"videoId": videoId}
+				if len(languages) > 0 {
+					args["availableLanguageCodes"] = strings.Join(languages, ",")
+				}
+				yt.outgoingMessages <- outgoingMessage{"onSubtitlesTrackChanged", args}
 			case "pause":
 				yt.mp.Pause()
 			case "play":
@@ -321,16 +734,28 @@ func (yt *YouTube) run(arguments url.Values) {
 		case <-yt.runQuit:
 			// The YouTube app has been stopped.
 
-			yt.mpMutex.Lock()
-			yt.mp.Quit()
-			yt.mp = nil
-			yt.mpMutex.Unlock()
+			yt.quitPlayer()
 
 			return
 		}
 	}
 }
 
+// quitPlayer quits the media player, if there is one. yt.mp is cleared first,
+// so playerEvents doesn't use it anymore, and mpMutex is released before
+// quitting: the player may be blocked sending to playerEvents, which needs
+// mpMutex to handle the state change.
+func (yt *YouTube) quitPlayer() {
+	yt.mpMutex.Lock()
+	player := yt.mp
+	yt.mp = nil
+	yt.mpMutex.Unlock()
+
+	if player != nil {
+		player.Quit()
+	}
+}
+
 func (yt *YouTube) playerEvents(stateChange chan mp.StateChange, volumeChan chan int, playlistChan, nowPlayingChan chan mp.PlaylistState) {
 	for {
 		select {
@@ -341,7 +766,8 @@ func (yt *YouTube) playerEvents(stateChange chan mp.StateChange, volumeChan chan
 				return
 			}
 
-			if change.State == mp.STATE_BUFFERING || change.State == mp.STATE_STOPPED {
+			// Progress updates don't change what is playing.
+			if (change.State == mp.STATE_BUFFERING || change.State == mp.STATE_STOPPED) && change.Progress < 0 {
 				// Only access yt.mp when it is certain it isn't being quit.
 				// yt.mp is nil when it is being stopped.
 				yt.mpMutex.Lock()
@@ -356,13 +782,35 @@ func (yt *YouTube) playerEvents(stateChange chan mp.StateChange, volumeChan chan
 				change.State = mp.STATE_BUFFERING
 			}
 
-			yt.outgoingMessages <- outgoingMessage{"onStateChange", map[string]string{
+			seekableEnd := change.Duration
+			if change.Live {
+				// Pin the scrubber to the live edge.
+				seekableEnd = change.Position
+			}
+
+			message := outgoingMessage{"onStateChange", map[string]string{
 				"currentTime":       strconv.FormatFloat(change.Position.Seconds(), 'f', 3, 64),
 				"duration":          strconv.FormatFloat(change.Duration.Seconds(), 'f', 3, 64),
 				"seekableStartTime": "0",
-				"seekableEndTime":   strconv.FormatFloat(change.Duration.Seconds(), 'f', 3, 64),
+				"seekableEndTime":   strconv.FormatFloat(seekableEnd.Seconds(), 'f', 3, 64),
 				"state":             strconv.Itoa(int(change.State)),
 			}}
+			if change.Progress >= 0 {
+				// Not part of the YouTube protocol, remotes ignore it.
+				message.args["bufferingProgress"] = strconv.Itoa(change.Progress)
+			}
+			yt.outgoingMessages <- message
+
+			if change.Progress < 0 {
+				notify.Send(stateEventJson{
+					App:      yt.FriendlyName(),
+					State:    stateNames[change.State],
+					VideoId:  change.VideoId,
+					Position: change.Position.Seconds(),
+					Duration: change.Duration.Seconds(),
+					Live:     change.Live,
+				})
+			}
 
 		case volume := <-volumeChan:
 			yt.outgoingMessages <- outgoingMessage{"onVolumeChanged", map[string]string{
@@ -382,52 +830,112 @@ func (yt *YouTube) playerEvents(stateChange chan mp.StateChange, volumeChan chan
 				//message.args["listId"] = ""
 			}
 			yt.outgoingMessages <- message
+			yt.outgoingMessages <- hasPreviousNextMessage(ps)
 		case ps := <-nowPlayingChan:
 			message := outgoingMessage{"nowPlaying", map[string]string{}}
 			if len(ps.Playlist) > 0 {
+				seekableEnd := ps.Duration
+				if ps.Live {
+					seekableEnd = ps.Position
+				}
 				message.args = map[string]string{
 					"videoId":           ps.Playlist[ps.Index],
 					"currentTime":       strconv.FormatFloat(ps.Position.Seconds(), 'f', 3, 64),
 					"duration":          strconv.FormatFloat(ps.Duration.Seconds(), 'f', 3, 64),
 					"seekableStartTime": "0",
-					"seekableEndTime":   strconv.FormatFloat(ps.Duration.Seconds(), 'f', 3, 64),
+					"seekableEndTime":   strconv.FormatFloat(seekableEnd.Seconds(), 'f', 3, 64),
 					"state":             strconv.Itoa(int(ps.State)),
 					"currentIndex":      strconv.Itoa(ps.Index),
 					"listId":            ps.ListId,
 				}
+				if ps.ListTitle != "" {
+					message.args["listTitle"] = ps.ListTitle
+				}
 			}
 			yt.outgoingMessages <- message
+			yt.outgoingMessages <- hasPreviousNextMessage(ps)
 		}
 	}
 }
 
+// parseLoungeRemotes returns the IDs of the remotes in the devices argument of
+// a loungeStatus message, which is a JSON array.
+func parseLoungeRemotes(devices string) ([]string, error) {
+	var list []loungeDeviceJson
+	err := json.Unmarshal([]byte(devices), &list)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, device := range list {
+		if device.Type == "REMOTE_CONTROL" {
+			ids = append(ids, device.Id)
+		}
+	}
+	return ids, nil
+}
+
+// hasPreviousNextMessage returns the message that tells the remote whether
+// there is a previous and next video, to enable or disable its buttons. A mix
+// always has a next video, as it is continued endlessly.
+func hasPreviousNextMessage(ps mp.PlaylistState) outgoingMessage {
+	hasPrevious := len(ps.Playlist) > 0 && ps.Index > 0
+	hasNext := ps.Index+1 < len(ps.Playlist) || (len(ps.Playlist) > 0 && mp.IsMix(ps.ListId))
+	return outgoingMessage{"onHasPreviousNextChanged", map[string]string{
+		"hasPrevious": strconv.FormatBool(hasPrevious),
+		"hasNext":     strconv.FormatBool(hasNext),
+	}}
+}
+
 func (yt *YouTube) Running() bool {
 	yt.runningMutex.Lock()
 	defer yt.runningMutex.Unlock()
 	return yt.running
 }
 
+// StartTime returns the time this app was last started.
+func (yt *YouTube) StartTime() time.Time {
+	yt.runningMutex.Lock()
+	defer yt.runningMutex.Unlock()
+	return yt.startTime
+}
+
 func (yt *YouTube) connect() {
-	yt.loadLoungeToken()
+	defer func() {
+		if r := recover(); r != nil {
+			logger.Errf("message channel crashed: %v\n%s", r, debug.Stack())
+			yt.Quit()
+		}
+	}()
 
 	// Start sending/receiving channel.
-	// There should now be enough information.
+	// The lounge token will be loaded when opening the channel.
 	yt.bind()
 }
 
-func (yt *YouTube) loadLoungeToken() {
+// loadLoungeToken gets a new lounge token for this screen.
+func (yt *YouTube) loadLoungeToken() error {
 	params := url.Values{
 		"screen_ids": []string{yt.getScreenId()},
 	}
 	logger.Println("Getting lounge token batch...")
 	response, err := httpPostFormBody("https://www.youtube.com/api/lounge/pairing/get_lounge_token_batch", params)
 	if err != nil {
-		// TODO exit the app or something when this happens, don't panic
-		logger.Panic(err)
+		return err
 	}
 	loungeTokenBatch := loungeTokenBatchJson{}
-	json.Unmarshal(response, &loungeTokenBatch)
+	err = json.Unmarshal(response, &loungeTokenBatch)
+	if err != nil {
+		return err
+	}
+	if len(loungeTokenBatch.Screens) == 0 {
+		return errors.New("no screens in lounge token batch")
+	}
+
+	yt.sendMutex.Lock()
 	yt.loungeToken = loungeTokenBatch.Screens[0].LoungeToken
+	yt.sendMutex.Unlock()
+	return nil
 }
 
 func (yt *YouTube) getScreenId() string {
@@ -444,6 +952,19 @@ func (yt *YouTube) getScreenId() string {
 	return screenId
 }
 
+// bindURL returns the URL of the bind endpoint with the given query
+// parameters, plus the parameters that are sent on every request. All values
+// are query-escaped. Must be called with sendMutex held.
+func (yt *YouTube) bindURL(params url.Values) string {
+	params.Set("device", "LOUNGE_SCREEN")
+	params.Set("id", yt.uuid)
+	params.Set("name", yt.systemName)
+	params.Set("loungeIdToken", yt.loungeToken)
+	params.Set("VER", "8")
+	params.Set("zx", string(zx()))
+	return "https://www.youtube.com/api/lounge/bc/bind?" + params.Encode()
+}
+
 func (yt *YouTube) openChannel(initial bool) *http.Response {
 	if initial {
 		yt.rid.Restart()
@@ -451,7 +972,10 @@ func (yt *YouTube) openChannel(initial bool) *http.Response {
 		logger.Println("Getting first batch of messages")
 	}
 
-	doInitial := initial
+	yt.sendMutex.Lock()
+	doInitial := initial || yt.resync
+	yt.resync = false
+	yt.sendMutex.Unlock()
 
 	// How often the connection was retried. Zero on normal operation.
 	// The retry timeout increases exponentially with the number of failures.
@@ -460,25 +984,51 @@ func (yt *YouTube) openChannel(initial bool) *http.Response {
 	for {
 		yt.sendMutex.Lock()
 		aid := yt.aid
+		loungeToken := yt.loungeToken
 		yt.sendMutex.Unlock()
 
+		if loungeToken == "" {
+			// Either this is the first connection, or the session has been
+			// reset.
+			err := yt.loadLoungeToken()
+			if err != nil {
+				logger.Errln("could not get lounge token:", err)
+				if !yt.recoverSession(&retries) {
+					break
+				}
+				continue
+			}
+			doInitial = true
+		}
+
 		var bindUrl string
-		// TODO more fields should be query-escaped
+		yt.sendMutex.Lock()
 		if !doInitial {
 			// normal reconnect
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=rpc&SID=%s&CI=0&AID=%d&gsessionid=%s&TYPE=xmlhttp&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, aid, yt.gsessionid, zx())
+			bindUrl = yt.bindURL(url.Values{
+				"RID":        {"rpc"},
+				"SID":        {yt.sid},
+				"CI":         {"0"},
+				"AID":        {strconv.Itoa(int(aid))},
+				"gsessionid": {yt.gsessionid},
+				"TYPE":       {"xmlhttp"},
+			})
 		} else if yt.sid == "" {
 			// first connection
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&RID=%d&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.rid.Next(), zx())
+			bindUrl = yt.bindURL(url.Values{
+				"RID": {strconv.Itoa(yt.rid.Next())},
+			})
 		} else {
 			// connection after a 400 Unknown SID error
-			bindUrl = fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&OSID=%s&OAID=%d&VER=8&RID=%d&zx=%s",
-				yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, aid, yt.rid.Next(), zx())
+			bindUrl = yt.bindURL(url.Values{
+				"OSID": {yt.sid},
+				"OAID": {strconv.Itoa(int(aid))},
+				"RID":  {strconv.Itoa(yt.rid.Next())},
+			})
 		}
+		yt.sendMutex.Unlock()
 
-		timeBeforeGet := time.Now()
+		timeBeforeGet := yt.clock.Now()
 
 		var resp *http.Response
 		var err error
@@ -494,91 +1044,73 @@ func (yt *YouTube) openChannel(initial bool) *http.Response {
 		if err != nil {
 			if err == io.EOF {
 				if !yt.errorRetryTimeout(&retries, "EOF on bind", err) {
-					yt.Quit()
+					if yt.recoverSession(&retries) {
+						continue
+					}
 					break
 				}
 				// reconnect
 				continue
 			} else if _, ok := err.(net.Error); ok && err.(net.Error).Timeout() {
 				logger.Warnln("timeout while connecting to message channel, retrying in 30s...")
-				time.Sleep(30 * time.Second)
+				yt.clock.Sleep(30 * time.Second)
 				continue
 			}
 			logger.Errln("Unknown error:", err)
-			yt.Quit()
+			if yt.recoverSession(&retries) {
+				continue
+			}
 			break
 		}
 
-		if resp.Status == "400 Unknown SID" {
-			logger.Println("error:", resp.Status, ". Reconnecting the message channel...")
+		action, err := channelResponseAction(resp)
+		if action != CHANNEL_CONNECTED {
+			resp.Body.Close()
+		}
+		switch action {
+		case CHANNEL_RECONNECT:
+			logger.Println("error:", resp.Status, "(Unknown SID). Reconnecting the message channel...")
 			// Restart the Channel API connection
 			doInitial = true
 			continue
 
-		} else if resp.Status == "400 Bad Request" {
-			// Most likely this is also an "Unknown SID" error.
-			buf, err := ioutil.ReadAll(resp.Body)
-			if err != nil {
-				logger.Errln("could not read error message after 400 Bad Request:", err)
-				yt.Quit()
-				break
-			}
-
-			if strings.Index(string(buf), "<TITLE>Unknown SID</TITLE>") < 0 {
-				// Some other error
-				logger.Errln("response body:")
-				os.Stdout.Write(buf)
-				os.Stdout.Sync()
-				yt.Quit()
-				break
+		case CHANNEL_NEW_SESSION:
+			if yt.errorRetryTimeout(&retries, "got "+resp.Status+" on reconnect", nil) {
+				// Restart Channel API connection from the beginning, with a
+				// new lounge token.
+				yt.sendMutex.Lock()
+				yt.sid = ""
+				yt.loungeToken = ""
+				yt.sendMutex.Unlock()
+				continue
 			}
 
-			// Let's try again, similar to "400 Unknown SID"
-			logger.Println("error: 400 Bad Request (Unknown SID). Reconnecting the message channel...")
-			doInitial = true
-			continue
-
-		} else if resp.Status == "410 Gone" {
-			if !yt.errorRetryTimeout(&retries, "got 410 Gone on reconnect", nil) {
-				yt.Quit()
-				break
+		case CHANNEL_RETRY:
+			if yt.errorRetryTimeout(&retries, "got HTTP error "+resp.Status+" on reconnect", nil) {
+				continue
 			}
 
-			// Restart Channel API connection from the beginning
-			yt.sendMutex.Lock()
-			yt.sid = ""
-			yt.loadLoungeToken()
-			yt.sendMutex.Unlock()
-			doInitial = true
-			continue
-
-		} else if resp.StatusCode == 502 {
-			if !yt.errorRetryTimeout(&retries, "got HTTP error 502 on reconnect", nil) {
-				yt.Quit()
-				break
+		case CHANNEL_FAIL:
+			logger.Errln("HTTP error while connecting to message channel:", err)
+		}
+		if action != CHANNEL_CONNECTED {
+			if yt.recoverSession(&retries) {
+				continue
 			}
-			continue
-
-		} else if resp.StatusCode != 200 {
-			logger.Errln("HTTP error while connecting to message channel:", resp.Status)
-
-			// most likely the YouTube server gives back an error in HTML form
-			printHTTPError(resp)
-
-			yt.Quit()
 			break
 		}
 
 		if !initial {
-			latency := time.Now().Sub(timeBeforeGet) / time.Millisecond * time.Millisecond
+			latency := yt.clock.Since(timeBeforeGet) / time.Millisecond * time.Millisecond
 			logger.Println("Connected to message channel in", latency)
 		}
 
+		yt.sendMutex.Lock()
 		if doInitial {
-			yt.sendMutex.Lock()
 			yt.aid = -1
-			yt.sendMutex.Unlock()
 		}
+		yt.channel = resp.Body
+		yt.sendMutex.Unlock()
 
 		return resp
 	}
@@ -586,6 +1118,42 @@ func (yt *YouTube) openChannel(initial bool) *http.Response {
 	return nil
 }
 
+// channelResponseAction inspects the response of a bind request and returns
+// what openChannel should do next. For CHANNEL_FAIL, the returned error
+// describes what went wrong. The body is only read for 400 Bad Request
+// responses, to look for an Unknown SID message.
+func channelResponseAction(resp *http.Response) (channelAction, error) {
+	switch {
+	case resp.Status == "400 Unknown SID":
+		return CHANNEL_RECONNECT, nil
+
+	case resp.Status == "400 Bad Request":
+		// Most likely this is also an "Unknown SID" error.
+		buf, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return CHANNEL_FAIL, fmt.Errorf("could not read error message after 400 Bad Request: %s", err)
+		}
+		if !strings.Contains(string(buf), "<TITLE>Unknown SID</TITLE>") {
+			// Some other error
+			return CHANNEL_FAIL, fmt.Errorf("%s, response body:\n%s", resp.Status, buf)
+		}
+		return CHANNEL_RECONNECT, nil
+
+	case resp.StatusCode == 410:
+		return CHANNEL_NEW_SESSION, nil
+
+	case resp.StatusCode == 502:
+		return CHANNEL_RETRY, nil
+
+	case resp.StatusCode != 200:
+		// most likely the YouTube server gives back an error in HTML form
+		buf, _ := ioutil.ReadAll(resp.Body)
+		return CHANNEL_FAIL, fmt.Errorf("%s, response body:\n%s", resp.Status, buf)
+	}
+
+	return CHANNEL_CONNECTED, nil
+}
+
 func (yt *YouTube) bind() {
 
 	resp := yt.openChannel(true)
@@ -625,7 +1193,34 @@ func (yt *YouTube) errorRetryTimeout(retries *int, message string, err error) bo
 		return false
 	}
 	logger.Warnf("%s, retrying in %s%s\n", message, retryTimeout, ending)
-	time.Sleep(retryTimeout)
+	yt.clock.Sleep(retryTimeout)
+	return true
+}
+
+// recoverSession is called on errors the message channel cannot recover from.
+// When running with -persistent, it waits a while and then resets the session
+// and the screen ID (see ResetScreenId) so that a new one will be set up,
+// returning true. Otherwise, it quits the app and returns false.
+func (yt *YouTube) recoverSession(retries *int) bool {
+	if !*flagPersistent || !yt.Running() {
+		yt.Quit()
+		return false
+	}
+
+	*retries++
+	timeout := time.Duration((*retries)*(*retries)) * RETRY_TIMEOUT * time.Millisecond
+	if timeout > MAX_RESET_TIMEOUT {
+		timeout = MAX_RESET_TIMEOUT
+	}
+	logger.Warnf("resetting session, retrying in %s\n", timeout)
+	yt.clock.Sleep(timeout)
+
+	if !yt.Running() {
+		return false
+	}
+
+	// The screen ID itself may be what YouTube doesn't accept anymore.
+	yt.ResetScreenId()
 	return true
 }
 
@@ -649,21 +1244,48 @@ func (yt *YouTube) handleMessageStream(resp *http.Response, singleBatch bool) bo
 			return false
 		}
 
-		length, err := strconv.Atoi(line[:len(line)-1])
-		if err != nil {
-			panic(err)
+		lengthString := strings.TrimSpace(line)
+		if lengthString == "" {
+			// Skip empty lines between chunks.
+			continue
+		}
+		length, err := strconv.Atoi(lengthString)
+		if err != nil || length < 0 || length > MAX_CHUNK_SIZE {
+			// The stream is out of sync, it can't be parsed anymore.
+			logger.Warnf("invalid chunk length %#v, reconnecting to message channel...\n", line)
+			return false
 		}
 
 		data := make([]byte, length)
 		_, err = io.ReadFull(reader, data)
 		if err != nil {
-			panic(err)
+			logger.Warnln("could not read chunk:", err)
+			logger.Println("Trying to reconnect to message channel...")
+			return false
 		}
 
 		messages := incomingMessagesJson{}
-		json.Unmarshal(data, &messages)
+		err = json.Unmarshal(data, &messages)
+		if err != nil {
+			logger.Warnln("could not decode chunk:", err)
+			logger.Println("Trying to reconnect to message channel...")
+			return false
+		}
 		for _, message := range messages {
-			if yt.handleRawReceivedMessage(message) {
+			quit, err := yt.handleRawReceivedMessage(message)
+			if err != nil {
+				// Continuing would leave the remote and this app out of sync
+				// (and the AID sent on reconnect would be wrong, or point to
+				// the malformed message). Set up a new session instead, see
+				// openChannel.
+				logger.Warnln(err)
+				logger.Warnln("Reconnecting to message channel with a new session...")
+				yt.sendMutex.Lock()
+				yt.resync = true
+				yt.sendMutex.Unlock()
+				return false
+			}
+			if quit {
 				return true
 			}
 		}
@@ -676,33 +1298,83 @@ func (yt *YouTube) handleMessageStream(resp *http.Response, singleBatch bool) bo
 	return false
 }
 
-func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) bool {
-	message := incomingMessage{}
-	message.index = int(rawMessage[0].(float64))
+// Order of a received message, see checkMessageIndex.
+type messageOrder int
 
-	if message.index != int(yt.aid+1) {
-		if message.index <= int(yt.aid) {
-			logger.Warnln("old command:", message.index, message.command, message.args)
-			return false
-		} else {
-			logger.Errf("missing some messages, message number=%d, expected number=%d\n", message.index, yt.aid)
-		}
+const (
+	MESSAGE_NEXT messageOrder = iota // the expected message
+	MESSAGE_OLD                      // already handled, e.g. sent again after a reconnect
+	MESSAGE_GAP                      // one or more messages have been missed
+)
+
+var errMessageGap = errors.New("missed messages from the message channel")
+var errMalformedMessage = errors.New("malformed message from the message channel")
+
+// checkMessageIndex compares the index of a received message with the index of
+// the last handled message (aid, which is -1 at the start of a session).
+// Indices that don't fit in aid are treated as a gap, so a new session is
+// started instead of overflowing.
+func checkMessageIndex(aid int32, index int) messageOrder {
+	switch {
+	case index > math.MaxInt32:
+		return MESSAGE_GAP
+	case index == int(aid)+1:
+		return MESSAGE_NEXT
+	case index <= int(aid):
+		return MESSAGE_OLD
+	default:
+		return MESSAGE_GAP
 	}
-	yt.aid = int32(message.index)
+}
 
-	message.command = rawMessage[1].([]interface{})[0].(string)
+// handleRawReceivedMessage handles a single message from the message channel.
+// It returns true when the app has quit, and errMessageGap or
+// errMalformedMessage when the message channel must set up a new session.
+func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) (bool, error) {
+	if len(rawMessage) < 2 {
+		return false, errMalformedMessage
+	}
+	index, ok := rawMessage[0].(float64)
+	if !ok {
+		return false, errMalformedMessage
+	}
+	body, ok := rawMessage[1].([]interface{})
+	if !ok || len(body) == 0 {
+		return false, errMalformedMessage
+	}
+	command, ok := body[0].(string)
+	if !ok {
+		return false, errMalformedMessage
+	}
 
-	args := make([]interface{}, len(rawMessage[1].([]interface{}))-1)
+	message := incomingMessage{}
+	message.index = int(index)
 
-	for i := 0; i < len(args); i++ {
-		args[i] = rawMessage[1].([]interface{})[i+1]
+	yt.sendMutex.Lock()
+	aid := yt.aid
+	order := checkMessageIndex(aid, message.index)
+	if order == MESSAGE_NEXT {
+		yt.aid = int32(message.index)
 	}
+	yt.sendMutex.Unlock()
+
+	switch order {
+	case MESSAGE_OLD:
+		logger.Warnln("old command:", message.index, body)
+		return false, nil
+	case MESSAGE_GAP:
+		logger.Errf("missing some messages, message number=%d, expected number=%d\n", message.index, int(aid)+1)
+		return false, errMessageGap
+	}
+
+	message.command = command
+	args := body[1:]
 
 	yt.runningMutex.Lock()
 	running := yt.running
 	yt.runningMutex.Unlock()
 	if !running {
-		return true
+		return true, nil
 	}
 
 	switch message.command {
@@ -749,7 +1421,7 @@ func (yt *YouTube) handleRawReceivedMessage(rawMessage incomingMessageJson) bool
 		yt.incomingMessages <- message
 	}
 
-	return false
+	return false, nil
 }
 
 func (yt *YouTube) sendMessages() {
@@ -761,10 +1433,11 @@ func (yt *YouTube) sendMessages() {
 	deadlineEnd := make(chan struct{})
 	go func() {
 		for _ = range deadlineStart {
-			// It looks like 10ms is a good default. HTTP latency appears to be
-			// relatively independent of the machine performance, so I guess it is bound
-			// by the speed of light...
-			time.Sleep(1 * time.Millisecond)
+			// Bursts of messages (e.g. while seeking) are sent in a single
+			// request. The delay is small compared to the HTTP latency, which
+			// appears to be relatively independent of the machine
+			// performance.
+			<-yt.clock.After(*flagSendDelay)
 			deadlineEnd <- struct{}{}
 		}
 	}()
@@ -781,7 +1454,7 @@ func (yt *YouTube) sendMessages() {
 			queuedMessages = append(queuedMessages, message)
 
 			if deadline.IsZero() {
-				deadline = time.Now()
+				deadline = yt.clock.Now()
 				deadlineStart <- struct{}{}
 				continue
 			}
@@ -800,19 +1473,31 @@ func (yt *YouTube) sendMessages() {
 				logger.Println("send msg:", message.command, message.args)
 			}
 
-			timeBeforeSend := time.Now()
+			timeBeforeSend := yt.clock.Now()
 
 			retries := 0
+			sent := true
 			for {
 				yt.sendMutex.Lock()
-				_, err := httpPostFormBody(fmt.Sprintf("https://www.youtube.com/api/lounge/bc/bind?device=LOUNGE_SCREEN&id=%s&name=%s&loungeIdToken=%s&VER=8&SID=%s&RID=%d&AID=%d&gsessionid=%s&zx=%s",
-					yt.uuid, url.QueryEscape(yt.systemName), yt.loungeToken, yt.sid, yt.rid.Next(), yt.aid, yt.gsessionid, zx()), values)
+				_, err := httpPostFormBody(yt.bindURL(url.Values{
+					"SID":        {yt.sid},
+					"RID":        {strconv.Itoa(yt.rid.Next())},
+					"AID":        {strconv.Itoa(int(yt.aid))},
+					"gsessionid": {yt.gsessionid},
+				}), values)
 				yt.sendMutex.Unlock()
 
 				if err != nil {
 					if !yt.errorRetryTimeout(&retries, "could not send message", err) {
-						yt.Quit()
-						return
+						if !*flagPersistent {
+							yt.Quit()
+							return
+						}
+						// Keep running: the receiving side will reset the session
+						// when the connection is really gone.
+						logger.Errln("dropping", len(queuedMessages), "outgoing messages")
+						sent = false
+						break
 					}
 					continue
 				}
@@ -821,11 +1506,13 @@ func (yt *YouTube) sendMessages() {
 				break
 			}
 
-			prepareLatency := timeBeforeSend.Sub(deadline) / time.Millisecond * time.Millisecond
-			httpLatency := time.Now().Sub(timeBeforeSend) / time.Millisecond * time.Millisecond
-			logger.Printf("messages sent: %d (prepare %s, http latency %s)\n", len(queuedMessages), prepareLatency, httpLatency)
+			if sent {
+				prepareLatency := timeBeforeSend.Sub(deadline) / time.Millisecond * time.Millisecond
+				httpLatency := yt.clock.Now().Sub(timeBeforeSend) / time.Millisecond * time.Millisecond
+				logger.Printf("messages sent: %d (prepare %s, http latency %s)\n", len(queuedMessages), prepareLatency, httpLatency)
 
-			count += len(queuedMessages)
+				count += len(queuedMessages)
+			}
 			queuedMessages = queuedMessages[:0]
 
 			deadline = time.Time{}
@@ -833,16 +1520,36 @@ func (yt *YouTube) sendMessages() {
 		case pairingCode := <-yt.pairingCodes:
 			// Register the pairing code: that can be done after sending and
 			// receiving message channels have been set up.
-			logger.Println("Registering pairing code...")
-			params := url.Values{
-				"access_type":  []string{"permanent"},
-				"pairing_code": []string{pairingCode},
-				"screen_id":    []string{yt.getScreenId()},
-			}
-			_, err := httpPostFormBody("https://www.youtube.com/api/lounge/pairing/register_pairing_code", params)
-			if err != nil {
-				logger.Warnln("could not register pairing code:", err)
-			}
+			// Retrying may take a while, so don't block sending messages.
+			go yt.registerPairingCode(pairingCode)
+		}
+	}
+}
+
+// registerPairingCode registers a pairing code, so the remote that sent it can
+// connect. It retries a few times, as the remote can't connect otherwise.
+func (yt *YouTube) registerPairingCode(pairingCode string) {
+	params := url.Values{
+		"access_type":  []string{"permanent"},
+		"pairing_code": []string{pairingCode},
+		"screen_id":    []string{yt.getScreenId()},
+	}
+
+	timeout := PAIRING_RETRY_TIMEOUT
+	for i := 0; ; i++ {
+		logger.Println("Registering pairing code...")
+		_, err := httpPostFormBody("https://www.youtube.com/api/lounge/pairing/register_pairing_code", params)
+		if err == nil {
+			logger.Println("Registered pairing code")
+			return
+		}
+
+		if i+1 >= PAIRING_ATTEMPTS {
+			logger.Errf("could not register pairing code after %d attempts, the remote won't be able to connect: %s\n", PAIRING_ATTEMPTS, err)
+			return
 		}
+		logger.Warnf("could not register pairing code, retrying in %s: %s\n", timeout, err)
+		yt.clock.Sleep(timeout)
+		timeout *= 2
 	}
 }
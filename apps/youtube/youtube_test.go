@@ -0,0 +1,236 @@
+package youtube
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aykevl/plaincast/clock"
+)
+
+func TestChannelResponseAction(t *testing.T) {
+	tests := []struct {
+		status string // status line as sent by the server, which may be non-standard
+		body   string
+		action channelAction
+	}{
+		{"200 OK", "", CHANNEL_CONNECTED},
+		{"400 Unknown SID", "", CHANNEL_RECONNECT},
+		{"400 Bad Request", "<HTML><HEAD><TITLE>Unknown SID</TITLE></HEAD></HTML>", CHANNEL_RECONNECT},
+		{"400 Bad Request", "<HTML><HEAD><TITLE>Bad Request</TITLE></HEAD></HTML>", CHANNEL_FAIL},
+		{"410 Gone", "", CHANNEL_NEW_SESSION},
+		{"502 Bad Gateway", "", CHANNEL_RETRY},
+		{"404 Not Found", "not found", CHANNEL_FAIL},
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var i int
+		fmt.Sscan(r.URL.Query().Get("test"), &i)
+		test := tests[i]
+
+		// The server of YouTube sends status texts that net/http doesn't, so
+		// write the response by hand.
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Error("could not hijack connection:", err)
+			return
+		}
+		defer conn.Close()
+		fmt.Fprintf(buf, "HTTP/1.1 %s\r\nContent-Length: %d\r\nConnection: close\r\n\r\n%s", test.status, len(test.body), test.body)
+		buf.Flush()
+	}))
+	defer server.Close()
+
+	for i, test := range tests {
+		resp, err := http.Get(fmt.Sprintf("%s/bind?test=%d", server.URL, i))
+		if err != nil {
+			t.Fatalf("%s: could not get response: %s", test.status, err)
+		}
+		action, err := channelResponseAction(resp)
+		resp.Body.Close()
+
+		if action != test.action {
+			t.Errorf("%s %q: got action %d, want %d", test.status, test.body, action, test.action)
+		}
+		if (action == CHANNEL_FAIL) != (err != nil) {
+			t.Errorf("%s %q: got error %v for action %d", test.status, test.body, err, action)
+		}
+		if err != nil && test.body != "" && !strings.Contains(err.Error(), test.body) {
+			t.Errorf("%s: error doesn't include the response body: %s", test.status, err)
+		}
+	}
+}
+
+func TestBindURLEscaping(t *testing.T) {
+	yt := &YouTube{
+		uuid:        "0a1b2c3d-4e5f-6789-abcd-ef0123456789",
+		systemName:  "Living room & kitchen",
+		loungeToken: "AGdO5p+/=&token#1",
+	}
+	params := url.Values{
+		"SID":        {"sid&AID=1"},
+		"gsessionid": {"g/h?i#j k"},
+		"AID":        {"5"},
+	}
+	bindURL := yt.bindURL(params)
+
+	u, err := url.Parse(bindURL)
+	if err != nil {
+		t.Fatal("could not parse bind URL:", err)
+	}
+	if u.Scheme != "https" || u.Host != "www.youtube.com" || u.Path != "/api/lounge/bc/bind" {
+		t.Errorf("wrong endpoint: %s", bindURL)
+	}
+	if u.Fragment != "" {
+		t.Errorf("URL has a fragment %q, a value wasn't escaped", u.Fragment)
+	}
+
+	query := u.Query()
+	for key, want := range map[string]string{
+		"SID":           "sid&AID=1",
+		"gsessionid":    "g/h?i#j k",
+		"AID":           "5",
+		"name":          yt.systemName,
+		"loungeIdToken": yt.loungeToken,
+		"id":            yt.uuid,
+		"device":        "LOUNGE_SCREEN",
+	} {
+		if got := query[key]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if query.Get("zx") == "" {
+		t.Error("zx is missing")
+	}
+}
+
+func TestCheckMessageIndex(t *testing.T) {
+	for _, test := range []struct {
+		aid   int32
+		index int
+		order messageOrder
+	}{
+		{-1, 0, MESSAGE_NEXT}, // first message of a new session
+		{-1, 1, MESSAGE_GAP},
+		{-1, -1, MESSAGE_OLD},
+		{0, 0, MESSAGE_OLD},
+		{5, 6, MESSAGE_NEXT},
+		{5, 3, MESSAGE_OLD},
+		{5, 8, MESSAGE_GAP},
+		{math.MaxInt32 - 1, math.MaxInt32, MESSAGE_NEXT},
+	} {
+		if got := checkMessageIndex(test.aid, test.index); got != test.order {
+			t.Errorf("aid %d, index %d: got %d, want %d", test.aid, test.index, got, test.order)
+		}
+	}
+
+	if strconv.IntSize == 64 {
+		// An index that would overflow aid starts a new session.
+		index := math.MaxInt32
+		index++
+		if got := checkMessageIndex(math.MaxInt32, index); got != MESSAGE_GAP {
+			t.Errorf("index %d after aid %d: got %d, want %d", index, math.MaxInt32, got, MESSAGE_GAP)
+		}
+	}
+}
+
+func TestHandleRawReceivedMessageOrder(t *testing.T) {
+	yt := &YouTube{aid: -1, running: true}
+
+	for _, test := range []struct {
+		message incomingMessageJson
+		err     error
+		aid     int32
+	}{
+		{incomingMessageJson{0.0, []interface{}{"noop"}}, nil, 0},
+		{incomingMessageJson{1.0, []interface{}{"noop"}}, nil, 1},
+		{incomingMessageJson{1.0, []interface{}{"noop"}}, nil, 1}, // sent again
+		{incomingMessageJson{3.0, []interface{}{"noop"}}, errMessageGap, 1},
+		{incomingMessageJson{2.0}, errMalformedMessage, 1},
+		{incomingMessageJson{"2", []interface{}{"noop"}}, errMalformedMessage, 1},
+		{incomingMessageJson{2.0, []interface{}{}}, errMalformedMessage, 1},
+		{incomingMessageJson{2.0, []interface{}{3.0}}, errMalformedMessage, 1},
+		{incomingMessageJson{2.0, []interface{}{"noop"}}, nil, 2},
+	} {
+		quit, err := yt.handleRawReceivedMessage(test.message)
+		if quit {
+			t.Fatalf("%v: quit", test.message)
+		}
+		if err != test.err {
+			t.Errorf("%v: got error %v, want %v", test.message, err, test.err)
+		}
+		if yt.aid != test.aid {
+			t.Errorf("%v: aid is %d, want %d", test.message, yt.aid, test.aid)
+		}
+	}
+}
+
+func TestParseLoungeRemotes(t *testing.T) {
+	devices := `[{"app":"lb-v4","name":"Plaincast","id":"screen","type":"LOUNGE_SCREEN"},` +
+		`{"app":"android-phone","name":"Phone","id":"remote1","type":"REMOTE_CONTROL"},` +
+		`{"app":"desktop","name":"Chrome","id":"remote2","type":"REMOTE_CONTROL"}]`
+	ids, err := parseLoungeRemotes(devices)
+	if err != nil {
+		t.Fatal("could not parse devices:", err)
+	}
+	if want := []string{"remote1", "remote2"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("got %q, want %q", ids, want)
+	}
+
+	if ids, err := parseLoungeRemotes("[]"); err != nil || len(ids) != 0 {
+		t.Errorf("no devices: got %q %v", ids, err)
+	}
+	if _, err := parseLoungeRemotes(""); err == nil {
+		t.Error("missing devices: got no error")
+	}
+}
+
+func TestErrorRetryTimeout(t *testing.T) {
+	c := clock.NewFake(time.Now())
+	yt := &YouTube{clock: c}
+
+	retries := 0
+	for i := 1; i <= 3; i++ {
+		done := make(chan bool)
+		go func() {
+			done <- yt.errorRetryTimeout(&retries, "test error", nil)
+		}()
+		if !c.WaitForWaiters(1, time.Second) {
+			t.Fatalf("retry %d: didn't wait", i)
+		}
+
+		// The timeout grows quadratically with the number of retries.
+		timeout := time.Duration(i*i) * RETRY_TIMEOUT * time.Millisecond
+		c.Advance(timeout - time.Millisecond)
+		select {
+		case <-done:
+			t.Fatalf("retry %d: returned before %s", i, timeout)
+		case <-time.After(10 * time.Millisecond):
+		}
+		c.Advance(time.Millisecond)
+		select {
+		case retry := <-done:
+			if !retry {
+				t.Fatalf("retry %d: gave up", i)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("retry %d: didn't return after %s", i, timeout)
+		}
+	}
+
+	// After RETRIES, it gives up without waiting.
+	retries = RETRIES
+	if yt.errorRetryTimeout(&retries, "test error", nil) {
+		t.Error("didn't give up after RETRIES")
+	}
+	if n := c.Waiters(); n != 0 {
+		t.Errorf("waiters after giving up: got %d, want 0", n)
+	}
+}
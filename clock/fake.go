@@ -0,0 +1,155 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock for tests. Time only passes when Advance is called, which
+// wakes up the sleepers, timers and tickers that are due, in order.
+type Fake struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending Sleep, After or Ticker.
+type fakeWaiter struct {
+	when   time.Time
+	period time.Duration // 0 for Sleep and After
+	ch     chan time.Time
+}
+
+// NewFake returns a fake clock that starts at the given time.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.addWaiter(d, 0).ch
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	return &fakeTicker{f, f.addWaiter(d, d)}
+}
+
+// addWaiter adds a waiter that is due after d, repeating every period if it is
+// not 0.
+func (f *Fake) addWaiter(d, period time.Duration) *fakeWaiter {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	// Buffered like the channels of the time package, so that firing never
+	// blocks.
+	w := &fakeWaiter{when: f.now.Add(d), period: period, ch: make(chan time.Time, 1)}
+	if d <= 0 {
+		w.ch <- f.now
+		return w
+	}
+	f.waiters = append(f.waiters, w)
+	return w
+}
+
+// removeWaiter removes a waiter, e.g. when a ticker is stopped.
+func (f *Fake) removeWaiter(w *fakeWaiter) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for i, other := range f.waiters {
+		if other == w {
+			f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+			return
+		}
+	}
+}
+
+// Advance moves the time forward by d, and fires everything that is due on the
+// way. Like a real ticker, a ticker that isn't read drops ticks.
+func (f *Fake) Advance(d time.Duration) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	end := f.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for _, w := range f.waiters {
+			if !w.when.After(end) && (next == nil || w.when.Before(next.when)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+
+		f.now = next.when
+		select {
+		case next.ch <- f.now:
+		default:
+		}
+		if next.period > 0 {
+			next.when = next.when.Add(next.period)
+		} else {
+			for i, w := range f.waiters {
+				if w == next {
+					f.waiters = append(f.waiters[:i], f.waiters[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	f.now = end
+}
+
+// Waiters returns the number of pending sleepers, timers and tickers. Tests
+// can use it to wait until a goroutine has started sleeping before advancing
+// the time.
+func (f *Fake) Waiters() int {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return len(f.waiters)
+}
+
+// WaitForWaiters blocks until there are at least n pending sleepers, timers and
+// tickers, or the (real) timeout has passed. It returns whether there are.
+func (f *Fake) WaitForWaiters(n int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for f.Waiters() < n {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return true
+}
+
+type fakeTicker struct {
+	clock  *Fake
+	waiter *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.waiter.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.clock.removeWaiter(t.waiter)
+}
@@ -0,0 +1,99 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var start = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestFakeSleep(t *testing.T) {
+	c := NewFake(start)
+
+	done := make(chan time.Time)
+	go func() {
+		c.Sleep(10 * time.Second)
+		done <- c.Now()
+	}()
+
+	if !c.WaitForWaiters(1, time.Second) {
+		t.Fatal("Sleep didn't start waiting")
+	}
+	c.Advance(9 * time.Second)
+	select {
+	case <-done:
+		t.Fatal("Sleep returned before its duration had passed")
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	c.Advance(time.Second)
+	select {
+	case now := <-done:
+		if want := start.Add(10 * time.Second); !now.Equal(want) {
+			t.Errorf("time after Sleep: got %s, want %s", now, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Sleep didn't return after its duration had passed")
+	}
+	if n := c.Waiters(); n != 0 {
+		t.Errorf("waiters after Sleep: got %d, want 0", n)
+	}
+}
+
+func TestFakeAfterOrder(t *testing.T) {
+	c := NewFake(start)
+
+	late := c.After(2 * time.Second)
+	early := c.After(time.Second)
+	c.Advance(5 * time.Second)
+
+	// Every channel gets the time it was due, not the time after Advance.
+	if got, want := <-early, start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("early: got %s, want %s", got, want)
+	}
+	if got, want := <-late, start.Add(2*time.Second); !got.Equal(want) {
+		t.Errorf("late: got %s, want %s", got, want)
+	}
+	if got, want := c.Since(start), 5*time.Second; got != want {
+		t.Errorf("Since: got %s, want %s", got, want)
+	}
+
+	// A non-positive duration fires immediately.
+	select {
+	case <-c.After(0):
+	default:
+		t.Error("After(0) didn't fire immediately")
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	c := NewFake(start)
+
+	ticker := c.NewTicker(time.Second)
+	c.Advance(time.Second)
+	if got, want := <-ticker.C(), start.Add(time.Second); !got.Equal(want) {
+		t.Errorf("first tick: got %s, want %s", got, want)
+	}
+
+	// Ticks that aren't read are dropped, like with time.Ticker.
+	c.Advance(3 * time.Second)
+	if got, want := <-ticker.C(), start.Add(2*time.Second); !got.Equal(want) {
+		t.Errorf("second tick: got %s, want %s", got, want)
+	}
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("got a tick at %s that should have been dropped", tick)
+	default:
+	}
+
+	ticker.Stop()
+	if n := c.Waiters(); n != 0 {
+		t.Errorf("waiters after Stop: got %d, want 0", n)
+	}
+	c.Advance(time.Second)
+	select {
+	case tick := <-ticker.C():
+		t.Errorf("got a tick at %s after Stop", tick)
+	default:
+	}
+}
@@ -13,7 +13,15 @@ import (
 	"sync"
 )
 
+// Config is the configuration, stored in a JSON file.
 type Config struct {
+	*configState
+}
+
+// configState is the state of a Config. It is separate from Config so that
+// the save goroutine doesn't keep the Config alive: when the Config is garbage
+// collected, its finalizer stops the goroutine.
+type configState struct {
 	path          string
 	dataMutex     sync.Mutex
 	data          map[string]interface{}
@@ -63,7 +71,7 @@ func Get() *Config {
 }
 
 func newConfig(path string) *Config {
-	c := &Config{}
+	c := &Config{&configState{}}
 	c.data = make(map[string]interface{})
 	c.saveChan = make(chan struct{}, 1)
 
@@ -81,9 +89,16 @@ func newConfig(path string) *Config {
 		buf, err := ioutil.ReadAll(f)
 		handle(err, "could not read config file")
 		handle(json.Unmarshal(buf, &c.data), "could not decode config file")
+
+		if c.migrate() {
+			c.save()
+		}
+	} else {
+		// A new config file has the current layout.
+		c.data["version"] = float64(CONFIG_VERSION)
 	}
 
-	go c.saveTask()
+	go c.configState.saveTask()
 
 	runtime.SetFinalizer(c, func(c *Config) {
 		// Close the channel and exit the goroutine.
@@ -166,6 +181,30 @@ func (c *Config) Set(key string, value interface{}) {
 	c.save()
 }
 
+// Update replaces the value of key with the value returned by update, which is
+// called with the current value (nil when the key isn't set). The value is read
+// and written under the same lock, so concurrent updates don't get lost. update
+// must not call the Config.
+func (c *Config) Update(key string, update func(value interface{}) interface{}) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	c.data[key] = update(c.data[key])
+	c.save()
+}
+
+// Delete removes the key, so it gets its default value again on the next Get.
+func (c *Config) Delete(key string) {
+	c.dataMutex.Lock()
+	defer c.dataMutex.Unlock()
+
+	if _, ok := c.data[key]; !ok {
+		return
+	}
+	delete(c.data, key)
+	c.save()
+}
+
 func (c *Config) SetInt(key string, value int) {
 	c.dataMutex.Lock()
 	defer c.dataMutex.Unlock()
@@ -174,7 +213,43 @@ func (c *Config) SetInt(key string, value int) {
 	c.save()
 }
 
-func (c *Config) save() {
+// Reload reads the config file again, for when it has been edited while
+// running. The contents of the file replace the current values, so keys that
+// have been removed from the file are removed as well. Afterwards, the
+// functions registered with OnReload are called to apply the new values.
+func (c *Config) Reload() error {
+	if c.path == "" {
+		return errors.New("no config file")
+	}
+
+	buf, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	data := make(map[string]interface{})
+	err = json.Unmarshal(buf, &data)
+	if err != nil {
+		return err
+	}
+
+	c.dataMutex.Lock()
+	c.data = data
+	if c.migrate() {
+		c.save()
+	}
+	c.dataMutex.Unlock()
+
+	reloadHooksMutex.Lock()
+	hooks := append([]func(){}, reloadHooks...)
+	reloadHooksMutex.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+
+	return nil
+}
+
+func (c *configState) save() {
 	if *disableConfig {
 		return
 	}
@@ -200,10 +275,12 @@ func (c *Config) save() {
 }
 
 // saveTask runs in a goroutine and handles saving the configuration
-// asynchronously.
-func (c *Config) saveTask() {
+// asynchronously, until saveChan is closed.
+func (c *configState) saveTask() {
 	for _ = range c.saveChan {
+		c.dataMutex.Lock()
 		data, err := json.MarshalIndent(&c.data, "", "\t")
+		c.dataMutex.Unlock()
 		handle(err, "could not serialize config data")
 
 		f, err := os.OpenFile(c.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
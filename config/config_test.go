@@ -0,0 +1,103 @@
+package config
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForFile polls the config file until key has the given value, or fails
+// the test after a while.
+func waitForFile(t *testing.T, path, key string, value interface{}) {
+	t.Helper()
+	var data map[string]interface{}
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		buf, err := ioutil.ReadFile(path)
+		if err == nil && json.Unmarshal(buf, &data) == nil && data[key] == value {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("config file doesn't have %s=%v, got: %v", key, value, data)
+}
+
+func TestSaveRapidSets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plaincast.json")
+	c := newConfig(path)
+
+	for i := 0; i < 1000; i++ {
+		c.SetInt("count", i)
+	}
+	waitForFile(t, path, "count", float64(999))
+}
+
+func TestUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plaincast.json")
+	c := newConfig(path)
+
+	// Without a single lock for reading and writing, increments get lost.
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Update("count", func(value interface{}) interface{} {
+				count, _ := value.(float64)
+				return count + 1
+			})
+		}()
+	}
+	wg.Wait()
+	waitForFile(t, path, "count", float64(100))
+}
+
+func TestSaveWhileSaving(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plaincast.json")
+	c := newConfig(path)
+
+	// Queue a save, and let saveTask pick it up. It then waits for the data,
+	// which is held here: the save is in flight.
+	c.dataMutex.Lock()
+	c.data["key"] = "first"
+	c.save()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(c.saveChan) != 0 {
+		if time.Now().After(deadline) {
+			c.dataMutex.Unlock()
+			t.Fatal("saveTask didn't pick up the save")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Change the data while the save is in flight.
+	c.data["key"] = "second"
+	c.save()
+	c.dataMutex.Unlock()
+
+	waitForFile(t, path, "key", "second")
+}
+
+func TestSaveTaskStops(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plaincast.json")
+	c := newConfig(path)
+	c.Set("key", "value")
+	waitForFile(t, path, "key", "value")
+
+	// Once the Config is unreachable, its finalizer closes the channel, which
+	// stops saveTask.
+	running := runtime.NumGoroutine()
+	c = nil
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() >= running {
+		if time.Now().After(deadline) {
+			t.Fatal("saveTask is still running after the Config has been garbage collected")
+		}
+		runtime.GC()
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -0,0 +1,40 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"strings"
+)
+
+// ENV_PREFIX is the prefix of environment variables that set flags.
+const ENV_PREFIX = "PLAINCAST_"
+
+// ApplyEnvironment sets flags from environment variables, for deployments
+// where flags are awkward (e.g. containers). The variable for a flag is its
+// name in upper case with dashes replaced by underscores, prefixed with
+// ENV_PREFIX. For example, -http-port can be set with PLAINCAST_HTTP_PORT.
+// Flags given on the command line take precedence.
+// It must be called after flag.Parse() and before flags are used.
+func ApplyEnvironment() {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	flag.VisitAll(func(f *flag.Flag) {
+		if set[f.Name] {
+			return
+		}
+		name := envName(f.Name)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		handle(flag.Set(f.Name, value), "invalid value for "+name)
+	})
+}
+
+// envName returns the environment variable name for the given flag.
+func envName(flagName string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(flagName, "-", "_", -1))
+}
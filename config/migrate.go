@@ -0,0 +1,51 @@
+package config
+
+// CONFIG_VERSION is the version of the layout of the config file. Increment it
+// when adding a migration.
+const CONFIG_VERSION = 1
+
+// Migrations that upgrade the config data to the next version: migrations[i]
+// upgrades from version i to version i+1. Config files without a version are
+// version 0.
+var migrations = []func(data map[string]interface{}){
+	// 0 -> 1: the volume isn't specific to the mpv backend.
+	func(data map[string]interface{}) {
+		renameKey(data, "player.mpv.volume", "player.volume")
+	},
+}
+
+// migrate upgrades the config data to CONFIG_VERSION. It returns true if the
+// data has been changed.
+func (c *Config) migrate() bool {
+	version := 0
+	if value, ok := c.data["version"].(float64); ok {
+		version = int(value)
+	}
+
+	if version > CONFIG_VERSION {
+		logger.Warnf("config file has version %d, but this version of Plaincast only knows up to version %d\n", version, CONFIG_VERSION)
+		return false
+	}
+	if version == CONFIG_VERSION {
+		return false
+	}
+
+	for ; version < CONFIG_VERSION; version++ {
+		migrations[version](c.data)
+	}
+	c.data["version"] = float64(CONFIG_VERSION)
+	return true
+}
+
+// renameKey moves a value to a different key, unless the new key already
+// exists.
+func renameKey(data map[string]interface{}, oldKey, newKey string) {
+	value, ok := data[oldKey]
+	if !ok {
+		return
+	}
+	if _, ok := data[newKey]; !ok {
+		data[newKey] = value
+	}
+	delete(data, oldKey)
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"net/http"
+	"net/url"
+	"os"
+)
+
+var flagProxyURL = flag.String("proxy-url", "", "send all outgoing HTTP requests through this proxy (e.g. http://proxy:3128 or socks5://localhost:9050)")
+
+// ApplyProxy routes outgoing HTTP requests through the proxy given with
+// -proxy-url. Without it, the standard HTTP_PROXY and HTTPS_PROXY environment
+// variables are honored as usual.
+// The proxy environment variables are also set, so the video grabber (a
+// subprocess, which inherits the environment) uses the same proxy.
+// It must be called after flag.Parse() and before any HTTP request is made.
+func ApplyProxy() {
+	if *flagProxyURL == "" {
+		return
+	}
+
+	proxyURL, err := url.Parse(*flagProxyURL)
+	if err == nil && (proxyURL.Scheme == "" || proxyURL.Host == "") {
+		err = errors.New("expected an URL like http://host:port")
+	}
+	handle(err, "invalid -proxy-url")
+
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		handle(errors.New("unexpected type of http.DefaultTransport"), "could not set proxy")
+	}
+	transport.Proxy = http.ProxyURL(proxyURL)
+
+	for _, name := range []string{"HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"} {
+		handle(os.Setenv(name, proxyURL.String()), "could not set proxy")
+	}
+}
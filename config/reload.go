@@ -0,0 +1,82 @@
+package config
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/aykevl/plaincast/log"
+)
+
+// Config key for the loglevel, used when -loglevel isn't given. It can be
+// changed while running, see HandleReload.
+const LOGLEVEL_KEY = "loglevel"
+
+var logger = log.New("config", "log config file changes")
+
+// Functions to call after the config file has been reloaded.
+var reloadHooks []func()
+var reloadHooksMutex sync.Mutex
+
+// OnReload registers a function that is called after the config file has been
+// reloaded, to apply settings that can change while running.
+func OnReload(hook func()) {
+	reloadHooksMutex.Lock()
+	defer reloadHooksMutex.Unlock()
+
+	reloadHooks = append(reloadHooks, hook)
+}
+
+// HandleReload applies the settings of the config file that can change while
+// running, and reloads the config file on SIGHUP. It must be called after
+// flag.Parse().
+func HandleReload() {
+	OnReload(applyLoglevel)
+	applyLoglevel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			logger.Println("Reloading config file")
+			err := Get().Reload()
+			if err != nil {
+				logger.Errln("could not reload config file:", err)
+			}
+		}
+	}()
+}
+
+// applyLoglevel sets the loglevel from the config file, unless it has been
+// given on the command line.
+func applyLoglevel() {
+	if flagGiven("loglevel") {
+		return
+	}
+	c := Get()
+	c.dataMutex.Lock()
+	level, ok := c.data[LOGLEVEL_KEY].(string)
+	c.dataMutex.Unlock()
+	if !ok {
+		return
+	}
+
+	err := log.SetLoglevel(level)
+	if err != nil {
+		logger.Errln("invalid config value for "+LOGLEVEL_KEY+":", err)
+	}
+}
+
+// flagGiven returns true if the flag has been set on the command line (or
+// with an environment variable, see ApplyEnvironment).
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
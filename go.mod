@@ -2,6 +2,8 @@ module github.com/aykevl/plaincast
 
 go 1.17
 
+require github.com/godbus/dbus/v5 v5.1.0
+
 require (
 	github.com/nu7hatch/gouuid v0.0.0-20131221200532-179d4d0c4d8d // indirect
 	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa // indirect
@@ -4,6 +4,8 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/crypto/ssh/terminal"
@@ -26,30 +28,62 @@ const (
 
 var isTerminal = terminal.IsTerminal(int(os.Stdout.Fd()))
 
+// Number of log lines kept for Recent.
+const RECENT_LINES = 100
+
+// The most recently written log lines, in a ring buffer.
+var recentLines [RECENT_LINES]string
+var recentIndex int
+var recentMutex sync.Mutex
+
 var flagLoglevel = flag.String("loglevel", "warn", "baseline loglevel (info, warn, err)")
 
-var loglevel = 0
+// The current loglevel, 0 until it has been read from the flag. It must be
+// accessed atomically, as it may be changed with SetLoglevel.
+var loglevel int32 = 0
 
 func getLoglevel() int {
 	if !flag.Parsed() {
 		panic("log called before flag.Parse()")
 	}
 
-	if loglevel == 0 {
-		switch *flagLoglevel {
-		case "info", "i":
-			loglevel = LOGLEVEL_INFO
-		case "warn", "warning", "w":
-			loglevel = LOGLEVEL_WARN
-		case "err", "error", "e":
-			loglevel = LOGLEVEL_ERR
-		default:
-			fmt.Println("Error in parsing 'loglevel' flag: unknown value")
-			os.Exit(1)
-		}
+	if level := atomic.LoadInt32(&loglevel); level != 0 {
+		return int(level)
+	}
+
+	level, ok := parseLoglevel(*flagLoglevel)
+	if !ok {
+		fmt.Println("Error in parsing 'loglevel' flag: unknown value")
+		os.Exit(1)
 	}
+	atomic.StoreInt32(&loglevel, int32(level))
+	return level
+}
 
-	return loglevel
+// parseLoglevel returns the loglevel with the given name, as accepted by
+// -loglevel.
+func parseLoglevel(name string) (int, bool) {
+	switch name {
+	case "info", "i":
+		return LOGLEVEL_INFO, true
+	case "warn", "warning", "w":
+		return LOGLEVEL_WARN, true
+	case "err", "error", "e":
+		return LOGLEVEL_ERR, true
+	default:
+		return 0, false
+	}
+}
+
+// SetLoglevel changes the baseline loglevel at runtime. The name is one of the
+// values accepted by -loglevel.
+func SetLoglevel(name string) error {
+	level, ok := parseLoglevel(name)
+	if !ok {
+		return fmt.Errorf("unknown loglevel: %s", name)
+	}
+	atomic.StoreInt32(&loglevel, int32(level))
+	return nil
 }
 
 // New creates a new logger that can be enabled or disabled via program flags.
@@ -78,6 +112,7 @@ func (l *Logger) write(s string, loglevel int) {
 	}
 
 	s = fmt.Sprintf("[%s] %s", l.name, s)
+	remember(time.Now().Format(TIME_FORMAT) + " " + s)
 
 	if isTerminal {
 		switch loglevel {
@@ -100,6 +135,30 @@ func (l *Logger) write(s string, loglevel int) {
 	fmt.Print(s)
 }
 
+// remember adds the line to the recent lines.
+func remember(line string) {
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+
+	recentLines[recentIndex] = line
+	recentIndex = (recentIndex + 1) % RECENT_LINES
+}
+
+// Recent returns the most recently written log lines (at most RECENT_LINES),
+// oldest first.
+func Recent() []string {
+	recentMutex.Lock()
+	defer recentMutex.Unlock()
+
+	lines := make([]string, 0, RECENT_LINES)
+	for i := 0; i < RECENT_LINES; i++ {
+		if line := recentLines[(recentIndex+i)%RECENT_LINES]; line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
 func (l *Logger) Printf(format string, v ...interface{}) {
 	l.write(fmt.Sprintf(format, v...), LOGLEVEL_INFO)
 }
@@ -3,11 +3,15 @@ package main
 import (
 	"flag"
 
+	"github.com/aykevl/plaincast/config"
 	"github.com/aykevl/plaincast/server"
 )
 
 func main() {
 	flag.Parse()
+	config.ApplyEnvironment()
+	config.ApplyProxy()
+	config.HandleReload()
 
 	server.Serve()
 }
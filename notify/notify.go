@@ -0,0 +1,147 @@
+// Package notify sends events to a webhook, so that other software (e.g. home
+// automation) can react to what Plaincast is doing.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aykevl/plaincast/config"
+	"github.com/aykevl/plaincast/log"
+)
+
+var logger = log.New("notify", "log webhook notifications")
+
+var flagWebhook = flag.String("webhook", "", "URL to POST a JSON message to on every playback state change (default: config key "+CONFIG_KEY+")")
+
+// Config key for the webhook URL, used when -webhook isn't given.
+const CONFIG_KEY = "notify.webhook"
+
+// How many events may be waiting to be sent. Events are dropped when the
+// webhook can't keep up.
+const QUEUE_SIZE = 16
+
+// Failed requests are retried a few times, with an exponential backoff.
+const RETRIES = 3
+const RETRY_TIMEOUT = time.Second
+
+// A webhook that doesn't respond in time is treated as a failed request, so
+// that it can't block the events after it.
+const REQUEST_TIMEOUT = 10 * time.Second
+
+var client = &http.Client{Timeout: REQUEST_TIMEOUT}
+
+var (
+	queue        chan []byte
+	startOnce    sync.Once
+	webhook      string
+	webhookMutex sync.Mutex // protects queue and webhook
+)
+
+// Send sends the event, encoded as JSON, to the webhook. It doesn't block:
+// the request is done in the background. Nothing is sent when no webhook has
+// been configured.
+func Send(event interface{}) {
+	startOnce.Do(start)
+	webhookMutex.Lock()
+	queue := queue
+	webhookMutex.Unlock()
+	if queue == nil {
+		return
+	}
+
+	data, err := json.Marshal(event)
+	if err != nil {
+		logger.Errln("could not encode event:", err)
+		return
+	}
+
+	select {
+	case queue <- data:
+	default:
+		logger.Warnln("webhook is too slow, dropping event")
+	}
+}
+
+// start reads the webhook URL, also when the config file is reloaded.
+func start() {
+	loadWebhook()
+	if *flagWebhook == "" {
+		config.OnReload(loadWebhook)
+	}
+}
+
+// loadWebhook reads the webhook URL and starts the goroutine sending events
+// when it is set.
+func loadWebhook() {
+	url := *flagWebhook
+	if url == "" {
+		var err error
+		url, err = config.Get().GetString(CONFIG_KEY, func() (string, error) {
+			return "", nil
+		})
+		if err != nil {
+			logger.Errln("could not read webhook URL:", err)
+			return
+		}
+	}
+
+	webhookMutex.Lock()
+	defer webhookMutex.Unlock()
+
+	if url != webhook && url != "" {
+		logger.Println("Sending events to", url)
+	}
+	webhook = url
+	if webhook != "" && queue == nil {
+		queue = make(chan []byte, QUEUE_SIZE)
+		go sendTask()
+	}
+}
+
+// sendTask sends the queued events one by one, so they arrive in order.
+func sendTask() {
+	for data := range queue {
+		timeout := RETRY_TIMEOUT
+		for i := 0; ; i++ {
+			err := post(data)
+			if err == nil {
+				break
+			}
+			if i == RETRIES {
+				logger.Warnln("could not send event, giving up:", err)
+				break
+			}
+			logger.Warnf("could not send event, retrying in %s: %s\n", timeout, err)
+			time.Sleep(timeout)
+			timeout *= 2
+		}
+	}
+}
+
+// post does a single request to the webhook.
+func post(data []byte) error {
+	webhookMutex.Lock()
+	url := webhook
+	webhookMutex.Unlock()
+	if url == "" {
+		// removed from the config file
+		return nil
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New("webhook returned " + resp.Status)
+	}
+	return nil
+}
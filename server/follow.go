@@ -0,0 +1,94 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aykevl/plaincast/apps/youtube/mp"
+)
+
+// This implements following another instance (the leader) for rough
+// multi-room playback: the leader's /status is polled, and the apps play the
+// same video at about the same position.
+
+var flagFollow = flag.String("follow", "", "URL of another plaincast instance (e.g. http://livingroom:8008) to play the same as, for multi-room audio")
+var flagFollowTolerance = flag.Duration("follow-tolerance", 3*time.Second, "how far the position may be off from the leader before seeking, with -follow")
+
+// How often the status of the leader is polled.
+const FOLLOW_INTERVAL = 5 * time.Second
+
+// Apps that can follow the playback of the same app on another instance
+// implement this interface.
+type followApp interface {
+	Playback() (mp.Playback, bool)
+	Follow(playlist []string, index int, state mp.State, position, tolerance time.Duration)
+}
+
+// follow polls the leader and lets the apps follow it. It never returns.
+func (us *UPnPServer) follow(leaderURL string) {
+	statusURL := strings.TrimSuffix(leaderURL, "/") + "/status"
+	client := &http.Client{Timeout: FOLLOW_INTERVAL}
+	logger.Println("following", statusURL)
+
+	failing := false
+	for {
+		err := us.followOnce(client, statusURL)
+		if err != nil && !failing {
+			// Only log the first error, the leader may be offline for a
+			// long time.
+			logger.Warnln("could not follow leader:", err)
+		} else if err == nil && failing {
+			logger.Println("following leader again")
+		}
+		failing = err != nil
+
+		time.Sleep(FOLLOW_INTERVAL)
+	}
+}
+
+// followOnce gets the status of the leader and passes it to the apps.
+func (us *UPnPServer) followOnce(client *http.Client, statusURL string) error {
+	requestTime := time.Now()
+	resp, err := client.Get(statusURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("unexpected HTTP status code: " + resp.Status)
+	}
+
+	var status statusJson
+	err = json.NewDecoder(resp.Body).Decode(&status)
+	if err != nil {
+		return err
+	}
+
+	for name, app := range us.apps {
+		app, ok := app.(followApp)
+		if !ok {
+			continue
+		}
+		leader, ok := status.Apps[name]
+		if !ok || !leader.Running || leader.Playback == nil {
+			// Nothing to follow (yet).
+			continue
+		}
+
+		playlist := make([]string, len(leader.Queue))
+		for i, item := range leader.Queue {
+			playlist[i] = item.VideoId
+		}
+		position := time.Duration(leader.Playback.Position * float64(time.Second))
+		if leader.Playback.State == mp.STATE_PLAYING {
+			// The leader has played on while the response was underway.
+			position += time.Since(requestTime) / 2
+		}
+		app.Follow(playlist, leader.Playback.Index, leader.Playback.State, position, *flagFollowTolerance)
+	}
+	return nil
+}
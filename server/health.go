@@ -0,0 +1,90 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Startup steps that must be done before the server is ready, see /readyz.
+const (
+	STEP_HTTP = "http"
+	STEP_SSDP = "ssdp"
+)
+
+// Map of startup step to whether it is done.
+var readySteps = map[string]bool{STEP_HTTP: false}
+var readyStepsMutex sync.Mutex
+
+// Apps that need some time to start implement this interface.
+type readyApp interface {
+	Ready() bool
+}
+
+// requireStep adds a startup step that must be done before the server is
+// ready.
+func requireStep(step string) {
+	readyStepsMutex.Lock()
+	defer readyStepsMutex.Unlock()
+
+	readySteps[step] = false
+}
+
+// setStepDone marks a required startup step as done or, when it fails later
+// on (e.g. SSDP when the network goes down), as not done.
+func setStepDone(step string, done bool) {
+	readyStepsMutex.Lock()
+	defer readyStepsMutex.Unlock()
+
+	if _, ok := readySteps[step]; ok {
+		readySteps[step] = done
+	}
+}
+
+// notReady returns the startup steps that aren't done, including the app
+// started with -app.
+func (us *UPnPServer) notReady() []string {
+	var steps []string
+
+	readyStepsMutex.Lock()
+	for step, done := range readySteps {
+		if !done {
+			steps = append(steps, step)
+		}
+	}
+	readyStepsMutex.Unlock()
+	sort.Strings(steps)
+
+	if *flagInitialApp != "" {
+		_, app, _ := us.getApp(*flagInitialApp)
+		if r, ok := app.(readyApp); !app.Running() || ok && !r.Ready() {
+			steps = append(steps, "app "+*flagInitialApp)
+		}
+	}
+
+	return steps
+}
+
+// serveHealthz is a liveness check: it responds as long as the HTTP server is
+// running.
+func (us *UPnPServer) serveHealthz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// serveReadyz is a readiness check: it only responds with 200 OK when the HTTP
+// and SSDP listeners are up and, when started with -app, the app is ready to
+// play. Otherwise it responds with 503 Service Unavailable and lists what isn't
+// ready.
+func (us *UPnPServer) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	steps := us.notReady()
+	if len(steps) > 0 {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready: " + strings.Join(steps, ", ") + "\n"))
+		return
+	}
+	w.Write([]byte("ready\n"))
+}
@@ -1,20 +1,29 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"flag"
+	htmltemplate "html/template"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
+	"strings"
 	"text/template"
 	"time"
 
 	"github.com/aykevl/plaincast/apps"
 	"github.com/aykevl/plaincast/apps/youtube"
+	"github.com/aykevl/plaincast/apps/youtube/mp"
+	"github.com/aykevl/plaincast/config"
+	"github.com/aykevl/plaincast/log"
 )
 
 // This implements a UPnP/DIAL server.
@@ -22,6 +31,46 @@ import (
 
 var flagHTTPPort = flag.Int("http-port", 8008, "default http port (0=available)")
 var flagInitialApp = flag.String("app", "", "App to run on startup")
+var flagMinimalHTTP = flag.Bool("minimal-http", false, "only serve what is needed for DIAL and the proxy, to expose less information")
+var flagProxyPort = flag.Int("proxy-port", -1, "serve the stream proxy on a separate port, so the other HTTP services can be firewalled (0=available, default: on the HTTP port)")
+var flagKeepAlivePeriod = flag.Duration("keepalive-period", 30*time.Second, "TCP keep-alive period of HTTP connections")
+var flagReadTimeout = flag.Duration("http-read-timeout", 30*time.Second, "maximum time to read an HTTP request (0=no limit)")
+var flagWriteTimeout = flag.Duration("http-write-timeout", 30*time.Second, "maximum time to write an HTTP response, not applied to the stream proxy (0=no limit)")
+var flagIdleTimeout = flag.Duration("http-idle-timeout", 2*time.Minute, "close idle HTTP connections after this time (0=use -http-read-timeout)")
+var flagProxyIdentity = flag.Bool("proxy-identity", false, "make the proxy request streams without compression (Accept-Encoding: identity), for players that can't handle it")
+var flagMaxProxyStreams = flag.Int("max-proxy-streams", 0, "maximum number of concurrent proxy requests (0=unlimited)")
+var flagProxyHosts = flag.String("proxy-hosts", "googlevideo.com", "comma-separated list of hosts the proxy may forward to, including their subdomains (empty=any host)")
+var flagHomeTemplate = flag.String("home-template", "", "HTML template file for the home page, with the fields .Title and .Apps (default: built-in page)")
+var flagDeviceType = flag.String("device-type", "dial", "device type to present in the UPnP description: dial or chromecast (for apps that only offer some features to a Chromecast)")
+var flagMaxRate = flag.Int("max-rate-kbps", 0, "limit the bandwidth used by the proxy in kbit/s (0=unlimited)")
+
+// Default volume for /control/duck.
+const DUCK_VOLUME = 20
+
+// deviceIdentity is how this device presents itself in the UPnP description.
+type deviceIdentity struct {
+	DeviceType   string
+	Manufacturer string
+	ModelName    string
+}
+
+// Device identities that can be selected with -device-type.
+var deviceIdentities = map[string]deviceIdentity{
+	"dial": {
+		DeviceType:   "urn:schemas-upnp-org:device:dial:1",
+		Manufacturer: "-",
+		ModelName:    NAME,
+	},
+	"chromecast": {
+		DeviceType:   "urn:dial-multiscreen-org:device:dial:1",
+		Manufacturer: "Google Inc.",
+		ModelName:    "Eureka Dongle",
+	},
+}
+
+// Audio streams have a bitrate of up to about 160kbps. Lower limits will cause
+// playback to stall.
+const MIN_RATE_KBPS = 192
 
 // UPnP device description template
 const DEVICE_DESCRIPTION = `<?xml version="1.0"?>
@@ -31,13 +80,18 @@ const DEVICE_DESCRIPTION = `<?xml version="1.0"?>
 		<minor>1</minor>
 	</specVersion>
 	<device>
-		<deviceType>urn:schemas-upnp-org:device:dial:1</deviceType>
+		<deviceType>{{.DeviceType}}</deviceType>
 		<friendlyName>{{.FriendlyName}}</friendlyName>
-		<manufacturer>-</manufacturer>
+		<manufacturer>{{.Manufacturer}}</manufacturer>
+{{- if not .Minimal}}
 		<modelDescription>Play the audio of YouTube videos</modelDescription>
+{{- end}}
 		<modelName>{{.ModelName}}</modelName>
+{{- if not .Minimal}}
 		<modelNumber>{{.ModelNumber}}</modelNumber>
+{{- end}}
 		<UDN>uuid:{{.DeviceUUID}}</UDN>
+{{- if not .Minimal}}
 		<serviceList>
 			<service>
 				<serviceType>urn:schemas-upnp-org:service:dail:1</serviceType>
@@ -47,6 +101,7 @@ const DEVICE_DESCRIPTION = `<?xml version="1.0"?>
 				<eventSubURL></eventSubURL>
 			</service>
 		</serviceList>
+{{- end}}
 	</device>
 </root>
 `
@@ -84,29 +139,39 @@ Apps:
 type UPnPServer struct {
 	descriptionTemplate *template.Template
 	appStateTemplate    *template.Template
-	homeTemplate        *template.Template
+	homeTemplate        *htmltemplate.Template // HTML, so titles and app names are escaped
 	httpPort            int
+	proxyPort           int
+	proxyMux            *http.ServeMux // nil if the proxy is served on the HTTP port
 	apps                map[string]apps.App
 	friendlyName        string
 	appMatchString      *regexp.Regexp
 	proxyClient         *http.Client
+	proxyLimiter        *rateLimiter
+	proxySlots          chan struct{} // semaphore for -max-proxy-streams, nil if unlimited
 }
 
 func NewUPnPServer() *UPnPServer {
 	us := &UPnPServer{}
 
-	us.appMatchString = regexp.MustCompile("^/apps/([a-zA-Z]+)(/run)?$")
+	us.appMatchString = regexp.MustCompile("^/apps/([a-zA-Z0-9._-]+)(/run)?$")
 	hostname, err := os.Hostname()
 	if err != nil {
 		panic(err)
 	}
 	us.friendlyName = FRIENDLY_NAME + " " + hostname
 
+	us.homeTemplate, err = loadHomeTemplate()
+	if err != nil {
+		logger.Fatalln("could not load -home-template:", err)
+	}
+
 	// initialize all known apps
 	us.apps = make(map[string]apps.App)
-	us.apps["YouTube"] = youtube.New(FRIENDLY_NAME)
+	us.apps["YouTube"] = youtube.New(getSystemName())
+	config.OnReload(us.reloadSystemName)
 	if *flagInitialApp != "" {
-		if app, ok := us.apps[*flagInitialApp]; ok {
+		if _, app, ok := us.getApp(*flagInitialApp); ok {
 			app.Start("")
 		} else {
 			logger.Fatalln("Unknown app:", *flagInitialApp)
@@ -114,12 +179,43 @@ func NewUPnPServer() *UPnPServer {
 	}
 
 	// http Client as used by the proxy
-	us.proxyClient = &http.Client{}
+	// Responses must be forwarded as they are: the transport must not ask for
+	// gzip on its own and decode it, the player decides which encodings it
+	// accepts.
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableCompression = true
+	us.proxyClient = &http.Client{Transport: transport}
+	if *flagMaxRate > 0 {
+		if *flagMaxRate < MIN_RATE_KBPS {
+			logger.Warnf("-max-rate-kbps is below %dkbps, playback may stall\n", MIN_RATE_KBPS)
+		}
+		us.proxyLimiter = newRateLimiter(*flagMaxRate * 1000 / 8)
+	}
+
+	if *flagMaxProxyStreams > 0 {
+		us.proxySlots = make(chan struct{}, *flagMaxProxyStreams)
+	}
 
 	http.HandleFunc("/upnp/description.xml", us.serveDescription)
+	http.HandleFunc("/upnp/announce", us.serveAnnounce)
 	http.HandleFunc("/apps/", us.serveApp)
-	http.HandleFunc("/proxy/", us.serveProxy)
-	http.HandleFunc("/", us.serveHome)
+	http.HandleFunc("/healthz", us.serveHealthz)
+	http.HandleFunc("/readyz", us.serveReadyz)
+	if *flagProxyPort >= 0 {
+		us.proxyMux = http.NewServeMux()
+		us.proxyMux.HandleFunc("/proxy/", us.serveProxy)
+	} else {
+		http.HandleFunc("/proxy/", us.serveProxy)
+	}
+	if !*flagMinimalHTTP {
+		http.HandleFunc("/status", us.serveStatus)
+		http.HandleFunc("/debug/state", us.serveDebugState)
+		http.HandleFunc("/audio-track", us.serveAudioTrack)
+		http.HandleFunc("/control/", us.serveControl)
+		http.HandleFunc("/playlists", us.servePlaylists)
+		http.HandleFunc("/playlists/save", us.servePlaylists)
+		http.HandleFunc("/", us.serveHome)
+	}
 
 	return us
 }
@@ -129,12 +225,32 @@ func (us *UPnPServer) startServing() (int, error) {
 		return 0, errors.New("already serving")
 	}
 
-	port, err := serve()
+	var handler http.Handler
+	writeTimeout := time.Duration(0)
+	if us.proxyMux != nil {
+		// The proxy is served separately.
+		writeTimeout = *flagWriteTimeout
+	} else if *flagWriteTimeout > 0 {
+		// The proxy is served on this port as well, so the write timeout can
+		// only be applied to the other routes.
+		handler = routeTimeouts(http.DefaultServeMux, *flagWriteTimeout)
+	}
+	port, err := serve(*flagHTTPPort, handler, writeTimeout)
 	if err != nil {
 		return 0, err
 	}
 
 	us.httpPort = port
+	us.proxyPort = port
+
+	if us.proxyMux != nil {
+		us.proxyPort, err = serve(*flagProxyPort, us.proxyMux, 0)
+		if err != nil {
+			return 0, err
+		}
+		logger.Println("serving the proxy on port", us.proxyPort)
+	}
+	mp.SetProxyURL("http://localhost:" + strconv.Itoa(us.proxyPort) + "/proxy/")
 
 	return us.httpPort, nil
 }
@@ -147,15 +263,10 @@ func (us *UPnPServer) serveHome(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
-
-	if us.homeTemplate == nil {
-		tmpl, err := template.New("").Parse(HOME_TEMPLATE)
-		if err != nil {
-			// this shouldn't happen
-			panic(err)
-		}
-		us.homeTemplate = tmpl
+	if *flagHomeTemplate != "" {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/xhtml+xml; charset=utf-8")
 	}
 
 	appNames := make([]string, len(us.apps))
@@ -179,14 +290,268 @@ func (us *UPnPServer) serveHome(w http.ResponseWriter, req *http.Request) {
 		"Title": us.friendlyName,
 		"Apps":  apps,
 	})
+	if err != nil {
+		// Only a custom template can fail, e.g. on an unknown field.
+		logger.Errln("could not render home page:", err)
+	}
+}
+
+// loadHomeTemplate parses the template for the home page: the file given with
+// -home-template, or HOME_TEMPLATE.
+func loadHomeTemplate() (*htmltemplate.Template, error) {
+	if *flagHomeTemplate == "" {
+		return htmltemplate.New("").Parse(HOME_TEMPLATE)
+	}
+	data, err := ioutil.ReadFile(*flagHomeTemplate)
+	if err != nil {
+		return nil, err
+	}
+	return htmltemplate.New(filepath.Base(*flagHomeTemplate)).Parse(string(data))
+}
+
+// JSON data structures for /status.
+type statusJson struct {
+	Name      string               `json:"name"`
+	Version   string               `json:"version"`
+	StartTime time.Time            `json:"startTime"`
+	Uptime    int64                `json:"uptime"` // in seconds
+	Quality   string               `json:"quality"`
+	Address   string               `json:"address,omitempty"` // local address most recently advertised to a remote
+	Apps      map[string]appStatus `json:"apps"`
+}
+type appStatus struct {
+	Running     bool            `json:"running"`
+	StartTime   *time.Time      `json:"startTime,omitempty"`
+	Uptime      int64           `json:"uptime,omitempty"` // in seconds, when running
+	AudioTracks []mp.AudioTrack `json:"audioTracks,omitempty"`
+	Queue       []mp.QueueItem  `json:"queue,omitempty"`
+	Playback    *mp.Playback    `json:"playback,omitempty"`
+}
+
+// Apps that pair with remotes using a screen ID implement this interface.
+type screenIdApp interface {
+	ResetScreenId()
+}
+
+// Apps that can temporarily lower their volume implement this interface.
+type duckApp interface {
+	Duck(int)
+	Unduck()
+}
+
+// Apps that show a system name to remotes implement this interface.
+type systemNameApp interface {
+	SetSystemName(string)
+}
+
+// Apps that can toggle between playing and paused implement this interface.
+type toggleApp interface {
+	TogglePlayPause()
+}
+
+// Apps that can seek in the current video implement this interface.
+type seekApp interface {
+	Seek(time.Duration)
+}
+
+// Apps that can go to the next or previous video implement this interface.
+type skipApp interface {
+	Next()
+	Previous()
+}
+
+// Apps that can describe their internal state implement this interface.
+type debugApp interface {
+	DebugState() interface{}
+}
+
+// Apps with a playlist implement this interface.
+type queueApp interface {
+	Queue() []mp.QueueItem
+}
+
+// Apps that can jump to a video in the playlist without racing against the
+// playlist advancing implement this interface.
+type indexApp interface {
+	SwapIndex(expected, index int) (int, []string, bool)
+}
+
+// Apps that can switch between audio tracks implement this interface.
+type audioTrackApp interface {
+	AudioTracks() []mp.AudioTrack
+	SetAudioTrack(int)
+}
+
+// Apps with named playlists (stored in the config) implement this interface.
+type playlistApp interface {
+	Playlists() map[string][]string
+	SavePlaylist(name string, videoIds []string) error
+	PlayPlaylist(name string) error
+}
+
+// servePlaylists lists the named playlists as JSON (GET /playlists), plays one
+// (POST /playlists with the 'name' form value) or saves one (POST
+// /playlists/save with the 'name' and 'videoIds' form values, an empty list
+// removes the playlist). This allows playing music without a remote, e.g.
+// with a button.
+func (us *UPnPServer) servePlaylists(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	var app playlistApp
+	for _, a := range us.apps {
+		if a, ok := a.(playlistApp); ok {
+			app = a
+			break
+		}
+	}
+	if app == nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	if req.URL.Path == "/playlists" && req.Method == "GET" {
+		data, err := json.MarshalIndent(app.Playlists(), "", "\t")
+		if err != nil {
+			// this shouldn't happen
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := req.FormValue("name")
+	if name == "" {
+		http.Error(w, "missing playlist name", http.StatusBadRequest)
+		return
+	}
+
+	if req.URL.Path == "/playlists/save" {
+		var videoIds []string
+		if value := req.FormValue("videoIds"); value != "" {
+			videoIds = strings.Split(value, ",")
+		}
+		err := app.SavePlaylist(name, videoIds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	err := app.PlayPlaylist(name)
+	if err == youtube.ErrUnknownPlaylist {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveStatus serves the status of the server and apps as JSON, for
+// monitoring.
+func (us *UPnPServer) serveStatus(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	now := time.Now()
+	status := statusJson{
+		Name:      us.friendlyName,
+		Version:   VERSION,
+		StartTime: startTime,
+		Uptime:    int64(now.Sub(startTime) / time.Second),
+		Quality:   mp.Quality(),
+		Address:   getLastAdvertisedIP(),
+		Apps:      make(map[string]appStatus, len(us.apps)),
+	}
+	for name, app := range us.apps {
+		appStatus := appStatus{
+			Running: app.Running(),
+		}
+		if appStart := app.StartTime(); !appStart.IsZero() {
+			appStatus.StartTime = &appStart
+			if appStatus.Running {
+				appStatus.Uptime = int64(now.Sub(appStart) / time.Second)
+			}
+		}
+		if trackApp, ok := app.(audioTrackApp); ok && appStatus.Running {
+			appStatus.AudioTracks = trackApp.AudioTracks()
+		}
+		if queueApp, ok := app.(queueApp); ok && appStatus.Running {
+			appStatus.Queue = queueApp.Queue()
+		}
+		if followApp, ok := app.(followApp); ok && appStatus.Running {
+			if playback, ok := followApp.Playback(); ok {
+				appStatus.Playback = &playback
+			}
+		}
+		status.Apps[name] = appStatus
+	}
+
+	data, err := json.MarshalIndent(status, "", "\t")
 	if err != nil {
 		// this shouldn't happen
 		panic(err)
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// serveDebugState dumps the internal state of all apps and the recent log
+// lines, to attach to bug reports. It is only available from localhost.
+func (us *UPnPServer) serveDebugState(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	if !isLocalRequest(req) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	apps := make(map[string]interface{}, len(us.apps))
+	for name, app := range us.apps {
+		if app, ok := app.(debugApp); ok {
+			apps[name] = app.DebugState()
+		}
+	}
+
+	data, err := json.MarshalIndent(map[string]interface{}{
+		"version":  VERSION,
+		"uptime":   int64(time.Since(startTime) / time.Second),
+		"address":  getLastAdvertisedIP(),
+		"notReady": us.notReady(),
+		"apps":     apps,
+		"log":      log.Recent(),
+	}, "", "\t")
+	if err != nil {
+		// this shouldn't happen
+		panic(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// reloadSystemName passes the system name to the apps again, after the config
+// file has been reloaded.
+func (us *UPnPServer) reloadSystemName() {
+	name := getSystemName()
+	for _, app := range us.apps {
+		if app, ok := app.(systemNameApp); ok {
+			app.SetSystemName(name)
+		}
+	}
 }
 
 func (us *UPnPServer) getApplicationURL(req *http.Request) string {
-	return "http://" + getUrlIP(getLocalAddr(req)) + ":" + strconv.Itoa(us.httpPort) + "/apps/"
+	return "http://" + advertisedIP(getLocalAddr(req), req.RemoteAddr) + ":" + strconv.Itoa(us.httpPort) + "/apps/"
 }
 
 // serveDescription serves the UPnP device description
@@ -195,12 +560,16 @@ func (us *UPnPServer) serveDescription(w http.ResponseWriter, req *http.Request)
 
 	w.Header().Set("Application-URL", us.getApplicationURL(req))
 
+	identity := deviceIdentities[*flagDeviceType]
 	deviceDescription := map[string]interface{}{
 		"ConfigId":     CONFIGID,
 		"FriendlyName": us.friendlyName,
-		"ModelName":    NAME,
+		"DeviceType":   identity.DeviceType,
+		"Manufacturer": identity.Manufacturer,
+		"ModelName":    identity.ModelName,
 		"ModelNumber":  VERSION,
 		"DeviceUUID":   deviceUUID,
+		"Minimal":      *flagMinimalHTTP,
 	}
 
 	if us.descriptionTemplate == nil {
@@ -218,6 +587,203 @@ func (us *UPnPServer) serveDescription(w http.ResponseWriter, req *http.Request)
 	}
 }
 
+// serveAnnounce sends a SSDP NOTIFY burst on request, for when a control point
+// has missed this device. Only requests from localhost are accepted.
+func (us *UPnPServer) serveAnnounce(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	if !isLocalRequest(req) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := sendSSDPNotify(us.httpPort)
+	if err != nil {
+		logger.Warnln("could not send SSDP NOTIFY:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveAudioTrack switches the audio track of the running apps. The track ID
+// is passed in the 'id' form value, see /status for the available tracks.
+func (us *UPnPServer) serveAudioTrack(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.Atoi(req.FormValue("id"))
+	if err != nil {
+		http.Error(w, "invalid track ID", http.StatusBadRequest)
+		return
+	}
+
+	for _, app := range us.apps {
+		if trackApp, ok := app.(audioTrackApp); ok && app.Running() {
+			trackApp.SetAudioTrack(id)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveControl pauses (/control/pause), resumes (/control/play) or toggles
+// (/control/toggle) playback in all running apps, e.g. for home automation.
+// /control/quality sets the stream quality preference ('quality' form value:
+// low, normal or best).
+// /control/reset-screenid generates a new screen ID, for when pairing fails.
+// /control/duck temporarily lowers the volume ('volume' form value, default
+// DUCK_VOLUME) until /control/unduck, e.g. to talk over the music.
+// /control/index returns the current index and playlist as JSON, and jumps to
+// the 'index' form value if the current index is still the 'expected' form
+// value (if given).
+func (us *UPnPServer) serveControl(w http.ResponseWriter, req *http.Request) {
+	logger.Println(req.Method, req.URL.Path)
+
+	if req.Method != "POST" {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if req.URL.Path == "/control/reset-screenid" {
+		for _, app := range us.apps {
+			if app, ok := app.(screenIdApp); ok {
+				app.ResetScreenId()
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.URL.Path == "/control/duck" || req.URL.Path == "/control/unduck" {
+		volume := DUCK_VOLUME
+		if value := req.FormValue("volume"); value != "" {
+			var err error
+			volume, err = strconv.Atoi(value)
+			if err != nil || volume < 0 || volume > 100 {
+				http.Error(w, "invalid volume, expected 0-100", http.StatusBadRequest)
+				return
+			}
+		}
+		for _, app := range us.apps {
+			if app, ok := app.(duckApp); ok {
+				if req.URL.Path == "/control/duck" {
+					app.Duck(volume)
+				} else {
+					app.Unduck()
+				}
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	if req.URL.Path == "/control/index" {
+		us.serveIndex(w, req)
+		return
+	}
+
+	if req.URL.Path == "/control/quality" {
+		err := mp.SetQuality(req.FormValue("quality"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var action func(apps.App)
+	switch req.URL.Path {
+	case "/control/pause":
+		action = apps.App.Pause
+	case "/control/play":
+		action = apps.App.Play
+	case "/control/toggle":
+		action = func(app apps.App) {
+			if app, ok := app.(toggleApp); ok {
+				app.TogglePlayPause()
+			}
+		}
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	for _, app := range us.apps {
+		if app.Running() {
+			action(app)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// serveIndex handles /control/index, see serveControl.
+func (us *UPnPServer) serveIndex(w http.ResponseWriter, req *http.Request) {
+	index, expected := -1, -1
+	var err error
+	if value := req.FormValue("index"); value != "" {
+		index, err = strconv.Atoi(value)
+		if err != nil || index < 0 {
+			http.Error(w, "invalid index", http.StatusBadRequest)
+			return
+		}
+	}
+	if value := req.FormValue("expected"); value != "" {
+		expected, err = strconv.Atoi(value)
+		if err != nil || expected < 0 {
+			http.Error(w, "invalid expected index", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, app := range us.apps {
+		indexApp, ok := app.(indexApp)
+		if !ok || !app.Running() {
+			continue
+		}
+		current, playlist, swapped := indexApp.SwapIndex(expected, index)
+		data, err := json.MarshalIndent(map[string]interface{}{
+			"index":    current,
+			"playlist": playlist,
+			"swapped":  swapped,
+		}, "", "\t")
+		if err != nil {
+			// this shouldn't happen
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+		return
+	}
+
+	http.Error(w, "no app is running", http.StatusServiceUnavailable)
+}
+
+// getApp returns the app with the given name and its canonical name. The name
+// is matched case-insensitively, as not all controllers use the same case.
+func (us *UPnPServer) getApp(name string) (string, apps.App, bool) {
+	if app, ok := us.apps[name]; ok {
+		return name, app, true
+	}
+	for appName, app := range us.apps {
+		if strings.EqualFold(appName, name) {
+			return appName, app, true
+		}
+	}
+	return "", nil, false
+}
+
 // serveApp serves an app description and handles starting/stopping of apps
 func (us *UPnPServer) serveApp(w http.ResponseWriter, req *http.Request) {
 	logger.Println(req.Method, req.URL.Path)
@@ -228,9 +794,7 @@ func (us *UPnPServer) serveApp(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	appName := string(matches[1])
-
-	app, ok := us.apps[appName]
+	appName, app, ok := us.getApp(string(matches[1]))
 	if !ok {
 		http.NotFound(w, req)
 		return
@@ -300,19 +864,65 @@ func (us *UPnPServer) serveApp(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// proxyHostAllowed returns true if host is in -proxy-hosts, or is a subdomain
+// of one of them. This prevents the proxy from being used as an open proxy.
+func proxyHostAllowed(host string) bool {
+	if *flagProxyHosts == "" {
+		return true
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, allowed := range strings.Split(*flagProxyHosts, ",") {
+		allowed = strings.ToLower(strings.TrimSpace(allowed))
+		if allowed == "" {
+			continue
+		}
+		if host == allowed || strings.HasSuffix(host, "."+allowed) {
+			return true
+		}
+	}
+	return false
+}
+
 // serveProxy is a simple proxy that is being used by the mplayer2 player
 // backend, because it doesn't support SSL.
 func (us *UPnPServer) serveProxy(w http.ResponseWriter, req *http.Request) {
+	if us.proxySlots != nil {
+		select {
+		case us.proxySlots <- struct{}{}:
+			defer func() {
+				<-us.proxySlots
+			}()
+		default:
+			logger.Warnln("too many concurrent proxy requests, rejecting", req.URL.Path)
+			http.Error(w, "Too many concurrent streams", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
 	proxyUrl := req.URL.Path
 	if req.URL.RawQuery != "" {
 		proxyUrl += "?" + req.URL.RawQuery
 	}
 	proxyUrl = "https://" + proxyUrl[len("/proxy/"):]
 
+	target, err := url.Parse(proxyUrl)
+	if err != nil || target.Hostname() == "" {
+		logger.Warnln("invalid proxy URL:", proxyUrl)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+	if !proxyHostAllowed(target.Hostname()) {
+		logger.Warnln("proxy host not allowed:", target.Hostname())
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
 	// client/proxied request
 	creq, err := http.NewRequest("GET", proxyUrl, nil)
 	if err != nil {
-		panic(err)
+		logger.Warnln("invalid proxy URL:", err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
 	}
 	for key, values := range req.Header {
 		if key == "Host" {
@@ -322,10 +932,15 @@ func (us *UPnPServer) serveProxy(w http.ResponseWriter, req *http.Request) {
 			creq.Header.Add(key, value)
 		}
 	}
+	if *flagProxyIdentity {
+		creq.Header.Set("Accept-Encoding", "identity")
+	}
 
 	resp, err := us.proxyClient.Do(creq)
 	if err != nil {
-		panic(err)
+		logger.Warnln("could not proxy stream:", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
 	}
 	defer resp.Body.Close()
 
@@ -334,16 +949,41 @@ func (us *UPnPServer) serveProxy(w http.ResponseWriter, req *http.Request) {
 			w.Header().Add(key, value)
 		}
 	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Flush after every write, so the stream reaches the player without
+	// delay.
+	var dst io.Writer = w
+	if flusher, ok := w.(http.Flusher); ok {
+		dst = flushWriter{w, flusher}
+	}
+
+	var src io.Reader = resp.Body
+	if us.proxyLimiter != nil {
+		src = rateLimitedReader{resp.Body, us.proxyLimiter}
+	}
 
 	if resp.ContentLength >= 0 {
 		// ignore errors
-		io.CopyN(w, resp.Body, resp.ContentLength)
+		io.CopyN(dst, src, resp.ContentLength)
 	} else {
 		// ignore errors
-		io.Copy(w, resp.Body)
+		io.Copy(dst, src)
 	}
 }
 
+// flushWriter flushes the underlying http.ResponseWriter after every write.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (fw flushWriter) Write(p []byte) (int, error) {
+	n, err := fw.w.Write(p)
+	fw.flusher.Flush()
+	return n, err
+}
+
 // copied from net/http/server.go, but modified the Keep-Alive period
 type tcpKeepAliveListener struct {
 	*net.TCPListener
@@ -355,22 +995,47 @@ func (ln tcpKeepAliveListener) Accept() (c net.Conn, err error) {
 		return
 	}
 	tc.SetKeepAlive(true)
-	tc.SetKeepAlivePeriod(5 * time.Second)
+	tc.SetKeepAlivePeriod(*flagKeepAlivePeriod)
 	return tc, nil
 }
 
+// routeTimeouts returns a handler that limits the time to handle a request to
+// timeout, except for the stream proxy which streams for as long as the video
+// plays. Handlers that time out get a 503 Service Unavailable response.
+func routeTimeouts(handler http.Handler, timeout time.Duration) http.Handler {
+	limited := http.TimeoutHandler(handler, timeout, "request timed out\n")
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.URL.Path, "/proxy/") {
+			handler.ServeHTTP(w, req)
+			return
+		}
+		limited.ServeHTTP(w, req)
+	})
+}
+
 // Partially copied from net/http sources.
 // We do it ourselves to be able to let the server run on a random (0) port, and
 // know which port the server runs on.
-func serve() (int, error) {
-	server := &http.Server{Addr: ":" + strconv.Itoa(*flagHTTPPort), Handler: nil}
+// Responses of the stream proxy can take as long as the stream plays, so
+// writeTimeout must be 0 when it is served.
+func serve(port int, handler http.Handler, writeTimeout time.Duration) (int, error) {
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(port),
+		Handler: handler,
+		// Against clients that open a connection and send their request
+		// very slowly (or never), keeping the connection open.
+		ReadHeaderTimeout: *flagReadTimeout,
+		ReadTimeout:       *flagReadTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       *flagIdleTimeout,
+	}
 
 	ln, err := net.Listen("tcp", server.Addr)
 	if err != nil {
 		return 0, err
 	}
 
-	port := ln.Addr().(*net.TCPAddr).Port
+	port = ln.Addr().(*net.TCPAddr).Port
 	server.Addr = ":" + strconv.Itoa(port)
 
 	go func() {
@@ -0,0 +1,290 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"flag"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// This implements a minimal mDNS (Bonjour) responder, which announces the HTTP
+// service as a DNS-SD service. See RFC 6762 and RFC 6763.
+
+var flagMDNS = flag.Bool("mdns", false, "announce the HTTP service with mDNS (Bonjour) as well")
+
+const (
+	MDNS_ADDR    = "224.0.0.251:5353"
+	MDNS_PORT    = 5353
+	MDNS_SERVICE = "_http._tcp.local."
+	MDNS_TTL     = 120 // seconds
+)
+
+// DNS constants used by mDNS.
+const (
+	DNS_TYPE_PTR  = 12
+	DNS_TYPE_TXT  = 16
+	DNS_TYPE_SRV  = 33
+	DNS_CLASS_IN  = 1
+	DNS_FLUSH     = 0x8000 // cache-flush bit in the class of unique records
+	DNS_FLAG_QR   = 0x8000 // message is a response
+	DNS_FLAG_AA   = 0x0400 // authoritative answer
+	DNS_MAX_JUMPS = 16     // maximum number of compression pointers in a name
+)
+
+var errInvalidDNSMessage = errors.New("invalid DNS message")
+
+// mdnsService is the DNS-SD service that is announced.
+type mdnsService struct {
+	instance string // full service instance name, e.g. "Plaincast host._http._tcp.local."
+	host     string // host name, e.g. "host.local."
+	port     int
+	txt      []string
+}
+
+// newMDNSService returns the service description for the HTTP server.
+func newMDNSService(friendlyName string, httpPort int) (*mdnsService, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	// Only the first label, the host may have a FQDN as hostname.
+	hostname = strings.SplitN(hostname, ".", 2)[0]
+
+	return &mdnsService{
+		instance: strings.Replace(friendlyName, ".", " ", -1) + "." + MDNS_SERVICE,
+		host:     hostname + ".local.",
+		port:     httpPort,
+		txt: []string{
+			"uuid=" + deviceUUID.String(),
+			"path=/upnp/description.xml",
+			"version=" + VERSION,
+		},
+	}, nil
+}
+
+// serveMDNS announces the service and responds to mDNS queries for it. Like
+// serveSSDP, it never returns.
+func serveMDNS(friendlyName string, httpPort int) {
+	service, err := newMDNSService(friendlyName, httpPort)
+	if err != nil {
+		logger.Errln("could not start mDNS:", err)
+		return
+	}
+
+	retryTimeout := SSDP_RETRY_TIMEOUT
+	for {
+		listened, err := listenMDNS(service)
+		if listened {
+			// The previous attempt worked for a while.
+			retryTimeout = SSDP_RETRY_TIMEOUT
+		}
+		logger.Warnf("mDNS error: %s, retrying in %s\n", err, retryTimeout)
+		time.Sleep(retryTimeout)
+
+		retryTimeout *= 2
+		if retryTimeout > SSDP_MAX_RETRY_TIMEOUT {
+			retryTimeout = SSDP_MAX_RETRY_TIMEOUT
+		}
+	}
+}
+
+// listenMDNS responds to queries until an error occurs. It returns whether it
+// could start listening, and the error.
+func listenMDNS(service *mdnsService) (bool, error) {
+	maddr, err := net.ResolveUDPAddr("udp4", MDNS_ADDR)
+	if err != nil {
+		return false, err
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, maddr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	go service.announce(conn, maddr)
+
+	buf := make([]byte, UDP_PACKET_SIZE)
+	for {
+		n, raddr, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return true, err
+		}
+
+		id, names, err := parseDNSQuery(buf[:n])
+		if err != nil {
+			// ignore responses and malformed packets
+			continue
+		}
+		if !service.matches(names) {
+			continue
+		}
+
+		go service.respond(conn, id, raddr, maddr)
+	}
+}
+
+// announce sends unsolicited responses, so browsers notice the service
+// without querying. It is sent twice, as UDP is unreliable.
+func (s *mdnsService) announce(conn *net.UDPConn, maddr *net.UDPAddr) {
+	for i := 0; i < 2; i++ {
+		err := s.send(conn, 0, maddr)
+		if err != nil {
+			logger.Warnln("could not send mDNS announcement:", err)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// respond answers a query from raddr. Queries from port 5353 are answered on
+// the multicast group, other (legacy unicast) queries are answered directly.
+func (s *mdnsService) respond(conn *net.UDPConn, id uint16, raddr, maddr *net.UDPAddr) {
+	var err error
+	if raddr.Port == MDNS_PORT {
+		err = s.send(conn, 0, maddr)
+	} else {
+		err = s.send(conn, id, raddr)
+	}
+	if err != nil {
+		logger.Warnln("could not send mDNS response:", err)
+	}
+}
+
+// send sends the records of the service to dest. Responses are sent from the
+// listening connection, as mDNS responses must come from port 5353.
+func (s *mdnsService) send(conn *net.UDPConn, id uint16, dest *net.UDPAddr) error {
+	_, err := conn.WriteToUDP(s.response(id), dest)
+	return err
+}
+
+// matches returns true if any of the queried names is about this service.
+func (s *mdnsService) matches(names []string) bool {
+	for _, name := range names {
+		if strings.EqualFold(name, MDNS_SERVICE) || strings.EqualFold(name, s.instance) {
+			return true
+		}
+	}
+	return false
+}
+
+// response builds a DNS response with all records of the service: PTR, SRV and
+// TXT. The address of the host is left to the mDNS responder of the system
+// (e.g. Avahi), which owns the host name.
+func (s *mdnsService) response(id uint16) []byte {
+	msg := make([]byte, 12, 512)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[2:], DNS_FLAG_QR|DNS_FLAG_AA)
+	binary.BigEndian.PutUint16(msg[6:], 3) // number of answers
+
+	msg = appendDNSRecord(msg, MDNS_SERVICE, DNS_TYPE_PTR, DNS_CLASS_IN, appendDNSName(nil, s.instance))
+
+	srv := make([]byte, 6)
+	binary.BigEndian.PutUint16(srv[4:], uint16(s.port)) // priority and weight are 0
+	msg = appendDNSRecord(msg, s.instance, DNS_TYPE_SRV, DNS_CLASS_IN|DNS_FLUSH, appendDNSName(srv, s.host))
+
+	var txt []byte
+	for _, entry := range s.txt {
+		txt = append(txt, byte(len(entry)))
+		txt = append(txt, entry...)
+	}
+	msg = appendDNSRecord(msg, s.instance, DNS_TYPE_TXT, DNS_CLASS_IN|DNS_FLUSH, txt)
+
+	return msg
+}
+
+// appendDNSRecord appends a resource record to the message.
+func appendDNSRecord(msg []byte, name string, rrtype, class uint16, data []byte) []byte {
+	msg = appendDNSName(msg, name)
+	var header [10]byte
+	binary.BigEndian.PutUint16(header[0:], rrtype)
+	binary.BigEndian.PutUint16(header[2:], class)
+	binary.BigEndian.PutUint32(header[4:], MDNS_TTL)
+	binary.BigEndian.PutUint16(header[8:], uint16(len(data)))
+	msg = append(msg, header[:]...)
+	return append(msg, data...)
+}
+
+// appendDNSName appends a name (with a trailing dot) in DNS label format,
+// without compression.
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
+
+// parseDNSQuery returns the ID and the names asked for in a DNS query. It
+// returns an error for responses and malformed messages.
+func parseDNSQuery(msg []byte) (uint16, []string, error) {
+	if len(msg) < 12 {
+		return 0, nil, errInvalidDNSMessage
+	}
+	id := binary.BigEndian.Uint16(msg[0:])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&DNS_FLAG_QR != 0 {
+		// not a query
+		return 0, nil, errInvalidDNSMessage
+	}
+
+	count := int(binary.BigEndian.Uint16(msg[4:]))
+	names := make([]string, 0, count)
+	offset := 12
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(msg, offset)
+		if err != nil {
+			return 0, nil, err
+		}
+		// skip type and class
+		offset = next + 4
+		if offset > len(msg) {
+			return 0, nil, errInvalidDNSMessage
+		}
+		names = append(names, name)
+	}
+	return id, names, nil
+}
+
+// readDNSName reads a (possibly compressed) name at offset. It returns the
+// name with a trailing dot and the offset just after the name.
+func readDNSName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if offset >= len(msg) {
+			return "", 0, errInvalidDNSMessage
+		}
+		length := int(msg[offset])
+		switch {
+		case length == 0:
+			if next < 0 {
+				next = offset + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case length&0xc0 == 0xc0:
+			// compression pointer
+			if offset+1 >= len(msg) || jumps >= DNS_MAX_JUMPS {
+				return "", 0, errInvalidDNSMessage
+			}
+			if next < 0 {
+				next = offset + 2
+			}
+			offset = int(binary.BigEndian.Uint16(msg[offset:]) & 0x3fff)
+			jumps++
+		case length > 63:
+			return "", 0, errInvalidDNSMessage
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, errInvalidDNSMessage
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+// testDNSQuery returns a DNS query with a question for every name.
+func testDNSQuery(id uint16, names ...string) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[0:], id)
+	binary.BigEndian.PutUint16(msg[4:], uint16(len(names)))
+	for _, name := range names {
+		msg = appendDNSName(msg, name)
+		msg = append(msg, 0, DNS_TYPE_PTR, 0, DNS_CLASS_IN)
+	}
+	return msg
+}
+
+func TestParseDNSQuery(t *testing.T) {
+	query := testDNSQuery(1234, MDNS_SERVICE, "host.local.")
+	id, names, err := parseDNSQuery(query)
+	if err != nil {
+		t.Fatal("could not parse query:", err)
+	}
+	if want := []string{MDNS_SERVICE, "host.local."}; id != 1234 || !reflect.DeepEqual(names, want) {
+		t.Errorf("got %d %q, want 1234 %q", id, names, want)
+	}
+
+	// Every truncated packet is rejected.
+	for n := 0; n < len(query); n++ {
+		if _, names, err := parseDNSQuery(query[:n]); err == nil {
+			t.Errorf("truncated to %d bytes: got %q, want an error", n, names)
+		}
+	}
+
+	// A second question may point to the name of the first.
+	compressed := testDNSQuery(0, MDNS_SERVICE)
+	binary.BigEndian.PutUint16(compressed[4:], 2)
+	compressed = append(compressed, 0xc0, 12, 0, DNS_TYPE_PTR, 0, DNS_CLASS_IN)
+	if _, names, err := parseDNSQuery(compressed); err != nil || !reflect.DeepEqual(names, []string{MDNS_SERVICE, MDNS_SERVICE}) {
+		t.Errorf("compressed name: got %q %v", names, err)
+	}
+
+	// Responses are not queries.
+	response := testDNSQuery(0, MDNS_SERVICE)
+	binary.BigEndian.PutUint16(response[2:], DNS_FLAG_QR)
+	if _, _, err := parseDNSQuery(response); err == nil {
+		t.Error("response was parsed as a query")
+	}
+}
+
+func TestReadDNSName(t *testing.T) {
+	// The name at offset 3 is "a.b." where "b" is reached through a pointer.
+	msg := []byte{1, 'b', 0, 1, 'a', 0xc0, 0}
+	name, next, err := readDNSName(msg, 3)
+	if err != nil || name != "a.b." || next != len(msg) {
+		t.Errorf("got %q %d %v, want \"a.b.\" %d", name, next, err, len(msg))
+	}
+
+	for _, test := range []struct {
+		name   string
+		msg    []byte
+		offset int
+	}{
+		{"empty", nil, 0},
+		{"offset past the end", []byte{0}, 1},
+		{"missing terminator", []byte{1, 'a'}, 0},
+		{"label past the end", []byte{5, 'a', 'b'}, 0},
+		{"label too long", append([]byte{64}, make([]byte, 65)...), 0},
+		{"truncated pointer", []byte{0xc0}, 0},
+		{"pointer past the end", []byte{0xc0, 10}, 0},
+		{"pointer to itself", []byte{0xc0, 0}, 0},
+		{"pointer loop", []byte{0xc0, 2, 0xc0, 0}, 0},
+		{"pointer loop after a label", []byte{1, 'a', 0xc0, 0}, 0},
+	} {
+		if name, _, err := readDNSName(test.msg, test.offset); err == nil {
+			t.Errorf("%s: got %q, want an error", test.name, name)
+		}
+	}
+}
+
+func TestMDNSResponse(t *testing.T) {
+	s := &mdnsService{
+		instance: "Plaincast host." + MDNS_SERVICE,
+		host:     "host.local.",
+		port:     8008,
+		txt:      []string{"path=/upnp/description.xml"},
+	}
+	msg := s.response(0)
+
+	// Only the service is announced: the host name belongs to the mDNS
+	// responder of the system.
+	if count := binary.BigEndian.Uint16(msg[6:]); count != 3 {
+		t.Fatalf("got %d answers, want 3", count)
+	}
+	var types []uint16
+	offset := 12
+	for i := 0; i < 3; i++ {
+		_, next, err := readDNSName(msg, offset)
+		if err != nil || next+10 > len(msg) {
+			t.Fatalf("answer %d is invalid", i)
+		}
+		types = append(types, binary.BigEndian.Uint16(msg[next:]))
+		offset = next + 10 + int(binary.BigEndian.Uint16(msg[next+8:]))
+	}
+	if want := []uint16{DNS_TYPE_PTR, DNS_TYPE_SRV, DNS_TYPE_TXT}; !reflect.DeepEqual(types, want) || offset != len(msg) {
+		t.Errorf("got record types %v and %d of %d bytes, want %v", types, offset, len(msg), want)
+	}
+}
@@ -0,0 +1,500 @@
+//go:build linux
+
+package server
+
+import (
+	"errors"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aykevl/plaincast/apps"
+	"github.com/aykevl/plaincast/apps/youtube/mp"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/introspect"
+)
+
+// This implements the MPRIS D-Bus interface, so desktop environments can show
+// what is playing and control it, for example with media keys. See
+// https://specifications.freedesktop.org/mpris-spec/latest/
+
+const (
+	MPRIS_NAME           = "org.mpris.MediaPlayer2.plaincast"
+	MPRIS_PATH           = "/org/mpris/MediaPlayer2"
+	MPRIS_INTERFACE      = "org.mpris.MediaPlayer2"
+	MPRIS_PLAYER         = "org.mpris.MediaPlayer2.Player"
+	MPRIS_TRACK_PATH     = "/org/plaincast/track/"
+	MPRIS_NO_TRACK       = "/org/mpris/MediaPlayer2/TrackList/NoTrack"
+	MPRIS_POLL_INTERVAL  = time.Second
+	MPRIS_SEEK_TOLERANCE = 2 * time.Second // position jumps larger than this are reported as Seeked
+)
+
+const DBUS_PROPERTIES = "org.freedesktop.DBus.Properties"
+
+const mprisIntrospection = `<!DOCTYPE node PUBLIC "-//freedesktop//DTD D-BUS Object Introspection 1.0//EN"
+ "http://www.freedesktop.org/standards/dbus/1.0/introspect.dtd">
+<node>
+  <interface name="org.freedesktop.DBus.Introspectable">
+    <method name="Introspect"><arg name="data" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Peer">
+    <method name="Ping"/>
+    <method name="GetMachineId"><arg name="machine_uuid" type="s" direction="out"/></method>
+  </interface>
+  <interface name="org.freedesktop.DBus.Properties">
+    <method name="Get">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="name" type="s" direction="in"/>
+      <arg name="value" type="v" direction="out"/>
+    </method>
+    <method name="GetAll">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="properties" type="a{sv}" direction="out"/>
+    </method>
+    <method name="Set">
+      <arg name="interface" type="s" direction="in"/>
+      <arg name="name" type="s" direction="in"/>
+      <arg name="value" type="v" direction="in"/>
+    </method>
+    <signal name="PropertiesChanged">
+      <arg name="interface" type="s"/>
+      <arg name="changed" type="a{sv}"/>
+      <arg name="invalidated" type="as"/>
+    </signal>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2">
+    <method name="Raise"/>
+    <method name="Quit"/>
+    <property name="CanQuit" type="b" access="read"/>
+    <property name="CanRaise" type="b" access="read"/>
+    <property name="HasTrackList" type="b" access="read"/>
+    <property name="Identity" type="s" access="read"/>
+    <property name="SupportedUriSchemes" type="as" access="read"/>
+    <property name="SupportedMimeTypes" type="as" access="read"/>
+  </interface>
+  <interface name="org.mpris.MediaPlayer2.Player">
+    <method name="Next"/>
+    <method name="Previous"/>
+    <method name="Pause"/>
+    <method name="PlayPause"/>
+    <method name="Stop"/>
+    <method name="Play"/>
+    <method name="Seek"><arg name="Offset" type="x" direction="in"/></method>
+    <method name="SetPosition">
+      <arg name="TrackId" type="o" direction="in"/>
+      <arg name="Position" type="x" direction="in"/>
+    </method>
+    <method name="OpenUri"><arg name="Uri" type="s" direction="in"/></method>
+    <signal name="Seeked"><arg name="Position" type="x"/></signal>
+    <property name="PlaybackStatus" type="s" access="read"/>
+    <property name="Rate" type="d" access="read"/>
+    <property name="Metadata" type="a{sv}" access="read"/>
+    <property name="Position" type="x" access="read"/>
+    <property name="MinimumRate" type="d" access="read"/>
+    <property name="MaximumRate" type="d" access="read"/>
+    <property name="CanGoNext" type="b" access="read"/>
+    <property name="CanGoPrevious" type="b" access="read"/>
+    <property name="CanPlay" type="b" access="read"/>
+    <property name="CanPause" type="b" access="read"/>
+    <property name="CanSeek" type="b" access="read"/>
+    <property name="CanControl" type="b" access="read"/>
+  </interface>
+</node>
+`
+
+// mprisState is the state of the app as reported over MPRIS.
+type mprisState struct {
+	status      string // PlaybackStatus: Playing, Paused or Stopped
+	index       int    // index of the current video, -1 if there is none
+	videoId     string
+	title       string
+	length      time.Duration
+	position    time.Duration
+	canNext     bool
+	canPrevious bool
+}
+
+// trackId returns the MPRIS track ID of the current video.
+func (s mprisState) trackId() dbus.ObjectPath {
+	if s.index < 0 {
+		return MPRIS_NO_TRACK
+	}
+	return dbus.ObjectPath(MPRIS_TRACK_PATH + strconv.Itoa(s.index))
+}
+
+// metadata returns the Metadata property.
+func (s mprisState) metadata() map[string]dbus.Variant {
+	m := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(s.trackId()),
+	}
+	if s.index >= 0 {
+		m["xesam:url"] = dbus.MakeVariant("https://www.youtube.com/watch?v=" + s.videoId)
+		m["mpris:artUrl"] = dbus.MakeVariant("https://i.ytimg.com/vi/" + s.videoId + "/hqdefault.jpg")
+		if s.title != "" {
+			m["xesam:title"] = dbus.MakeVariant(s.title)
+		}
+		if s.length > 0 {
+			m["mpris:length"] = dbus.MakeVariant(int64(s.length / time.Microsecond))
+		}
+	}
+	return m
+}
+
+// playerProperties returns the properties of the Player interface.
+func (s mprisState) playerProperties() map[string]dbus.Variant {
+	hasVideo := s.index >= 0
+	return map[string]dbus.Variant{
+		"PlaybackStatus": dbus.MakeVariant(s.status),
+		"Rate":           dbus.MakeVariant(1.0),
+		"Metadata":       dbus.MakeVariant(s.metadata()),
+		"Position":       dbus.MakeVariant(int64(s.position / time.Microsecond)),
+		"MinimumRate":    dbus.MakeVariant(1.0),
+		"MaximumRate":    dbus.MakeVariant(1.0),
+		"CanGoNext":      dbus.MakeVariant(s.canNext),
+		"CanGoPrevious":  dbus.MakeVariant(s.canPrevious),
+		"CanPlay":        dbus.MakeVariant(hasVideo),
+		"CanPause":       dbus.MakeVariant(hasVideo),
+		"CanSeek":        dbus.MakeVariant(hasVideo),
+		"CanControl":     dbus.MakeVariant(true),
+	}
+}
+
+// mprisChanges returns the Player properties that changed between two polls,
+// and whether the position jumped, elapsed apart. Position isn't included, as
+// clients are supposed to extrapolate it.
+func mprisChanges(last, state mprisState, elapsed time.Duration) ([]string, bool) {
+	var changed []string
+	if last.status != state.status {
+		changed = append(changed, "PlaybackStatus")
+	}
+	sameVideo := last.index == state.index && last.videoId == state.videoId
+	if !sameVideo || last.title != state.title || last.length != state.length {
+		changed = append(changed, "Metadata")
+	}
+	if last.canNext != state.canNext {
+		changed = append(changed, "CanGoNext")
+	}
+	if last.canPrevious != state.canPrevious {
+		changed = append(changed, "CanGoPrevious")
+	}
+	if (last.index >= 0) != (state.index >= 0) {
+		changed = append(changed, "CanPlay", "CanPause", "CanSeek")
+	}
+
+	expected := last.position
+	if last.status == "Playing" {
+		expected += elapsed
+	}
+	jump := state.position - expected
+	seeked := sameVideo && state.index >= 0 && (jump > MPRIS_SEEK_TOLERANCE || jump < -MPRIS_SEEK_TOLERANCE)
+	return changed, seeked
+}
+
+// serveMPRIS exports the MPRIS object on the session bus, and reconnects when
+// the connection is lost. It never returns.
+func (us *UPnPServer) serveMPRIS() {
+	retryTimeout := SSDP_RETRY_TIMEOUT
+	for {
+		connected, err := us.connectMPRIS()
+		if connected {
+			// The previous attempt worked for a while.
+			retryTimeout = SSDP_RETRY_TIMEOUT
+		}
+		logger.Warnf("MPRIS error: %s, retrying in %s\n", err, retryTimeout)
+		time.Sleep(retryTimeout)
+
+		retryTimeout *= 2
+		if retryTimeout > SSDP_MAX_RETRY_TIMEOUT {
+			retryTimeout = SSDP_MAX_RETRY_TIMEOUT
+		}
+	}
+}
+
+// connectMPRIS connects to the session bus and serves MPRIS until an error
+// occurs. It returns whether it could connect, and the error.
+func (us *UPnPServer) connectMPRIS() (bool, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	// Method calls are handled by godbus, in its own goroutines.
+	exports := []struct {
+		v       interface{}
+		mapping map[string]string
+		iface   string
+	}{
+		{introspect.Introspectable(mprisIntrospection), nil, "org.freedesktop.DBus.Introspectable"},
+		{&mprisProperties{us}, nil, DBUS_PROPERTIES},
+		{&mprisRoot{}, nil, MPRIS_INTERFACE},
+		// SeekBy is exported as Seek, which is reserved for io.Seeker in Go.
+		{&mprisPlayer{us}, map[string]string{"SeekBy": "Seek"}, MPRIS_PLAYER},
+	}
+	for _, export := range exports {
+		if err := conn.ExportWithMap(export.v, export.mapping, MPRIS_PATH, export.iface); err != nil {
+			return false, err
+		}
+	}
+
+	name, err := requestMPRISName(conn)
+	if err != nil {
+		return false, err
+	}
+	logger.Println("MPRIS: serving as", name)
+
+	return true, us.watchMPRIS(conn, us.mprisState())
+}
+
+// requestMPRISName requests MPRIS_NAME, or a name unique to this process when
+// another instance already has it (as recommended by the specification).
+func requestMPRISName(conn *dbus.Conn) (string, error) {
+	for _, name := range []string{MPRIS_NAME, MPRIS_NAME + ".instance" + strconv.Itoa(os.Getpid())} {
+		reply, err := conn.RequestName(name, dbus.NameFlagDoNotQueue)
+		if err != nil {
+			return "", err
+		}
+		if reply == dbus.RequestNameReplyPrimaryOwner {
+			return name, nil
+		}
+	}
+	return "", errors.New("could not get an MPRIS bus name")
+}
+
+// watchMPRIS polls the app and emits signals when its state changes from last,
+// until the connection is lost.
+func (us *UPnPServer) watchMPRIS(conn *dbus.Conn, last mprisState) error {
+	ticker := time.NewTicker(MPRIS_POLL_INTERVAL)
+	defer ticker.Stop()
+
+	lastTime := time.Now()
+	for {
+		select {
+		case <-conn.Context().Done():
+			return errors.New("lost the connection to the session bus")
+		case <-ticker.C:
+		}
+
+		state := us.mprisState()
+		now := time.Now()
+		changed, seeked := mprisChanges(last, state, now.Sub(lastTime))
+		last, lastTime = state, now
+
+		if len(changed) != 0 {
+			properties := state.playerProperties()
+			values := make(map[string]dbus.Variant, len(changed))
+			for _, name := range changed {
+				values[name] = properties[name]
+			}
+			err := conn.Emit(MPRIS_PATH, DBUS_PROPERTIES+".PropertiesChanged", MPRIS_PLAYER, values, []string{})
+			if err != nil {
+				return err
+			}
+		}
+		if seeked {
+			err := conn.Emit(MPRIS_PATH, MPRIS_PLAYER+".Seeked", int64(state.position/time.Microsecond))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// mprisApp returns the running app that MPRIS reports on and controls, or nil.
+func (us *UPnPServer) mprisApp() apps.App {
+	names := make([]string, 0, len(us.apps))
+	for name := range us.apps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		app := us.apps[name]
+		_, isFollowApp := app.(followApp)
+		_, isQueueApp := app.(queueApp)
+		if isFollowApp && isQueueApp && app.Running() {
+			return app
+		}
+	}
+	return nil
+}
+
+// mprisState returns the current state of the app.
+func (us *UPnPServer) mprisState() mprisState {
+	state := mprisState{status: "Stopped", index: -1}
+	app := us.mprisApp()
+	if app == nil {
+		return state
+	}
+	playback, ok := app.(followApp).Playback()
+	if !ok {
+		return state
+	}
+	queue := app.(queueApp).Queue()
+
+	switch playback.State {
+	case mp.STATE_PLAYING, mp.STATE_BUFFERING, mp.STATE_SEEKING:
+		state.status = "Playing"
+	case mp.STATE_PAUSED:
+		state.status = "Paused"
+	}
+	if playback.Index < 0 || playback.Index >= len(queue) {
+		return state
+	}
+	item := queue[playback.Index]
+	state.index = playback.Index
+	state.videoId = item.VideoId
+	state.title = item.Title
+	state.length = time.Duration(item.Duration * float64(time.Second))
+	state.position = time.Duration(playback.Position * float64(time.Second))
+	state.canPrevious = playback.Index > 0
+	state.canNext = playback.Index+1 < len(queue)
+	return state
+}
+
+// mprisProperties implements org.freedesktop.DBus.Properties for the MPRIS
+// object. The properties are read from the app on every call.
+type mprisProperties struct {
+	us *UPnPServer
+}
+
+// properties returns the properties of an MPRIS interface.
+func (p *mprisProperties) properties(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	switch iface {
+	case MPRIS_INTERFACE:
+		return map[string]dbus.Variant{
+			"CanQuit":             dbus.MakeVariant(false),
+			"CanRaise":            dbus.MakeVariant(false),
+			"HasTrackList":        dbus.MakeVariant(false),
+			"Identity":            dbus.MakeVariant(NAME),
+			"SupportedUriSchemes": dbus.MakeVariant([]string{}),
+			"SupportedMimeTypes":  dbus.MakeVariant([]string{}),
+		}, nil
+	case MPRIS_PLAYER:
+		return p.us.mprisState().playerProperties(), nil
+	default:
+		return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownInterface", []interface{}{"unknown interface " + iface})
+	}
+}
+
+func (p *mprisProperties) Get(iface, name string) (dbus.Variant, *dbus.Error) {
+	properties, err := p.properties(iface)
+	if err != nil {
+		return dbus.Variant{}, err
+	}
+	value, ok := properties[name]
+	if !ok {
+		return dbus.Variant{}, dbus.NewError("org.freedesktop.DBus.Error.UnknownProperty", []interface{}{"unknown property " + name})
+	}
+	return value, nil
+}
+
+func (p *mprisProperties) GetAll(iface string) (map[string]dbus.Variant, *dbus.Error) {
+	return p.properties(iface)
+}
+
+func (p *mprisProperties) Set(iface, name string, value dbus.Variant) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.PropertyReadOnly", []interface{}{"all properties are read-only"})
+}
+
+// mprisRoot implements the org.mpris.MediaPlayer2 interface.
+type mprisRoot struct{}
+
+// Raise is not supported, see CanRaise.
+func (r *mprisRoot) Raise() *dbus.Error {
+	return nil
+}
+
+// Quit is not supported, see CanQuit.
+func (r *mprisRoot) Quit() *dbus.Error {
+	return nil
+}
+
+// mprisPlayer implements the org.mpris.MediaPlayer2.Player interface. The
+// methods do nothing when no app is running, as the specification requires.
+type mprisPlayer struct {
+	us *UPnPServer
+}
+
+func (p *mprisPlayer) Play() *dbus.Error {
+	if app := p.us.mprisApp(); app != nil {
+		app.Play()
+	}
+	return nil
+}
+
+func (p *mprisPlayer) Pause() *dbus.Error {
+	if app := p.us.mprisApp(); app != nil {
+		app.Pause()
+	}
+	return nil
+}
+
+// Stop pauses, as a stopped video can't be resumed by the remote.
+func (p *mprisPlayer) Stop() *dbus.Error {
+	return p.Pause()
+}
+
+func (p *mprisPlayer) PlayPause() *dbus.Error {
+	if app, ok := p.us.mprisApp().(toggleApp); ok {
+		app.TogglePlayPause()
+	}
+	return nil
+}
+
+func (p *mprisPlayer) Next() *dbus.Error {
+	if app, ok := p.us.mprisApp().(skipApp); ok {
+		app.Next()
+	}
+	return nil
+}
+
+func (p *mprisPlayer) Previous() *dbus.Error {
+	if app, ok := p.us.mprisApp().(skipApp); ok {
+		app.Previous()
+	}
+	return nil
+}
+
+// SeekBy seeks by offset (in microseconds) from the current position. It is
+// the Seek method on the bus.
+func (p *mprisPlayer) SeekBy(offset int64) *dbus.Error {
+	state := p.us.mprisState()
+	position := state.position + time.Duration(offset)*time.Microsecond
+	if position < 0 {
+		position = 0
+	}
+	if state.length > 0 && position > state.length {
+		// Seeking past the end goes to the next video.
+		if state.canNext {
+			return p.Next()
+		}
+		return nil
+	}
+	p.seek(state, position)
+	return nil
+}
+
+// SetPosition seeks to position (in microseconds) in the given track. It is
+// ignored when the track is no longer current or the position is out of range.
+func (p *mprisPlayer) SetPosition(trackId dbus.ObjectPath, position int64) *dbus.Error {
+	state := p.us.mprisState()
+	newPosition := time.Duration(position) * time.Microsecond
+	if trackId != state.trackId() || newPosition < 0 || state.length > 0 && newPosition > state.length {
+		return nil
+	}
+	p.seek(state, newPosition)
+	return nil
+}
+
+func (p *mprisPlayer) OpenUri(uri string) *dbus.Error {
+	return dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []interface{}{"opening URIs is not supported"})
+}
+
+// seek seeks in the current video, if there is one.
+func (p *mprisPlayer) seek(state mprisState, position time.Duration) {
+	if app, ok := p.us.mprisApp().(seekApp); ok && state.index >= 0 {
+		app.Seek(position)
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package server
+
+// serveMPRIS only warns, MPRIS (over D-Bus) is only supported on Linux.
+func (us *UPnPServer) serveMPRIS() {
+	logger.Warnln("-mpris is only supported on Linux")
+}
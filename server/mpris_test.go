@@ -0,0 +1,198 @@
+//go:build linux
+
+package server
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aykevl/plaincast/apps"
+	"github.com/aykevl/plaincast/apps/youtube/mp"
+	"github.com/godbus/dbus/v5"
+)
+
+// testMPRISApp is an app with a playlist that records how it is controlled.
+type testMPRISApp struct {
+	mutex    sync.Mutex
+	playback mp.Playback
+	queue    []mp.QueueItem
+	calls    []string
+}
+
+func (a *testMPRISApp) record(call string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.calls = append(a.calls, call)
+}
+
+// takeCalls returns the calls since the last takeCalls.
+func (a *testMPRISApp) takeCalls() []string {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	calls := a.calls
+	a.calls = nil
+	return calls
+}
+
+func (a *testMPRISApp) setPlayback(playback mp.Playback) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.playback = playback
+}
+
+func (a *testMPRISApp) Start(string)         {}
+func (a *testMPRISApp) Running() bool        { return true }
+func (a *testMPRISApp) Quit()                {}
+func (a *testMPRISApp) FriendlyName() string { return "Test" }
+func (a *testMPRISApp) StartTime() time.Time { return time.Time{} }
+func (a *testMPRISApp) Pause()               { a.record("Pause") }
+func (a *testMPRISApp) Play()                { a.record("Play") }
+func (a *testMPRISApp) TogglePlayPause()     { a.record("TogglePlayPause") }
+func (a *testMPRISApp) Next()                { a.record("Next") }
+func (a *testMPRISApp) Previous()            { a.record("Previous") }
+func (a *testMPRISApp) Seek(position time.Duration) {
+	a.record("Seek " + position.String())
+}
+func (a *testMPRISApp) Follow([]string, int, mp.State, time.Duration, time.Duration) {}
+
+func (a *testMPRISApp) Playback() (mp.Playback, bool) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.playback, true
+}
+
+func (a *testMPRISApp) Queue() []mp.QueueItem {
+	return a.queue
+}
+
+func newTestMPRISApp() *testMPRISApp {
+	return &testMPRISApp{
+		playback: mp.Playback{State: mp.STATE_PLAYING, Index: 1, Position: 30},
+		queue: []mp.QueueItem{
+			{VideoId: "video0", Title: "First", Duration: 60},
+			{VideoId: "video1", Title: "Second", Duration: 120},
+			{VideoId: "video2", Title: "Third", Duration: 180},
+		},
+	}
+}
+
+func TestMPRISProperties(t *testing.T) {
+	app := newTestMPRISApp()
+	properties := &mprisProperties{&UPnPServer{apps: map[string]apps.App{"Test": app}}}
+
+	if got, err := properties.Get(MPRIS_INTERFACE, "Identity"); err != nil || got.Value() != NAME {
+		t.Errorf("Identity: got %v %v, want %s", got, err, NAME)
+	}
+	for name, want := range map[string]interface{}{
+		"PlaybackStatus": "Playing",
+		"Position":       int64(30e6),
+		"CanGoNext":      true,
+		"CanGoPrevious":  true,
+		"CanSeek":        true,
+	} {
+		if got, err := properties.Get(MPRIS_PLAYER, name); err != nil || got.Value() != want {
+			t.Errorf("%s: got %v %v, want %v", name, got, err, want)
+		}
+	}
+
+	metadata, err := properties.Get(MPRIS_PLAYER, "Metadata")
+	if err != nil {
+		t.Fatalf("Metadata: %v", err)
+	}
+	want := map[string]dbus.Variant{
+		"mpris:trackid": dbus.MakeVariant(dbus.ObjectPath(MPRIS_TRACK_PATH + "1")),
+		"mpris:length":  dbus.MakeVariant(int64(120e6)),
+		"mpris:artUrl":  dbus.MakeVariant("https://i.ytimg.com/vi/video1/hqdefault.jpg"),
+		"xesam:title":   dbus.MakeVariant("Second"),
+		"xesam:url":     dbus.MakeVariant("https://www.youtube.com/watch?v=video1"),
+	}
+	if !reflect.DeepEqual(metadata.Value(), want) {
+		t.Errorf("Metadata: got %v, want %v", metadata.Value(), want)
+	}
+
+	all, err := properties.GetAll(MPRIS_PLAYER)
+	if err != nil || len(all) != len(mprisState{}.playerProperties()) {
+		t.Errorf("GetAll: got %v %v", all, err)
+	}
+
+	if _, err := properties.Get(MPRIS_PLAYER, "Volume"); err == nil || err.Name != "org.freedesktop.DBus.Error.UnknownProperty" {
+		t.Errorf("Get unknown property: got error %v", err)
+	}
+	if _, err := properties.Get("org.example", "Volume"); err == nil || err.Name != "org.freedesktop.DBus.Error.UnknownInterface" {
+		t.Errorf("Get unknown interface: got error %v", err)
+	}
+	if err := properties.Set(MPRIS_PLAYER, "Rate", dbus.MakeVariant(2.0)); err == nil || err.Name != "org.freedesktop.DBus.Error.PropertyReadOnly" {
+		t.Errorf("Set: got error %v", err)
+	}
+}
+
+func TestMPRISMethods(t *testing.T) {
+	app := newTestMPRISApp()
+	player := &mprisPlayer{&UPnPServer{apps: map[string]apps.App{"Test": app}}}
+
+	for _, test := range []struct {
+		name  string
+		call  func() *dbus.Error
+		calls []string
+	}{
+		{"Play", player.Play, []string{"Play"}},
+		{"Pause", player.Pause, []string{"Pause"}},
+		{"Stop", player.Stop, []string{"Pause"}},
+		{"PlayPause", player.PlayPause, []string{"TogglePlayPause"}},
+		{"Next", player.Next, []string{"Next"}},
+		{"Previous", player.Previous, []string{"Previous"}},
+		{"Seek forward", func() *dbus.Error { return player.SeekBy(10e6) }, []string{"Seek 40s"}},
+		{"Seek back", func() *dbus.Error { return player.SeekBy(-60e6) }, []string{"Seek 0s"}},
+		{"Seek past the end", func() *dbus.Error { return player.SeekBy(100e6) }, []string{"Next"}},
+		{"SetPosition", func() *dbus.Error { return player.SetPosition(MPRIS_TRACK_PATH+"1", 5e6) }, []string{"Seek 5s"}},
+		{"SetPosition other track", func() *dbus.Error { return player.SetPosition(MPRIS_TRACK_PATH+"0", 5e6) }, nil},
+		{"SetPosition past the end", func() *dbus.Error { return player.SetPosition(MPRIS_TRACK_PATH+"1", 200e6) }, nil},
+	} {
+		if err := test.call(); err != nil {
+			t.Errorf("%s: got error %v", test.name, err)
+		}
+		if calls := app.takeCalls(); !reflect.DeepEqual(calls, test.calls) {
+			t.Errorf("%s: got calls %v, want %v", test.name, calls, test.calls)
+		}
+	}
+
+	if err := player.OpenUri("https://example.com/"); err == nil || err.Name != "org.freedesktop.DBus.Error.NotSupported" {
+		t.Errorf("OpenUri: got error %v", err)
+	}
+
+	// There is nothing to go to at the end of the playlist.
+	app.setPlayback(mp.Playback{State: mp.STATE_PLAYING, Index: 2})
+	player.SeekBy(1000e6)
+	if calls := app.takeCalls(); len(calls) != 0 {
+		t.Errorf("Seek past the end of the playlist: got calls %v", calls)
+	}
+}
+
+func TestMPRISChanges(t *testing.T) {
+	playing := mprisState{status: "Playing", index: 1, videoId: "video1", title: "Second", length: time.Minute, position: 10 * time.Second, canNext: true, canPrevious: true}
+
+	for _, test := range []struct {
+		name    string
+		change  func(*mprisState)
+		elapsed time.Duration
+		changed []string
+		seeked  bool
+	}{
+		{"playing", func(s *mprisState) { s.position += time.Second }, time.Second, nil, false},
+		{"paused", func(s *mprisState) { s.status = "Paused" }, time.Second, []string{"PlaybackStatus"}, false},
+		{"title", func(s *mprisState) { s.title = "Other" }, 0, []string{"Metadata"}, false},
+		{"seek forward", func(s *mprisState) { s.position += 30 * time.Second }, time.Second, nil, true},
+		{"seek back", func(s *mprisState) { s.position = 0 }, time.Second, nil, true},
+		{"next", func(s *mprisState) { s.index, s.videoId, s.position, s.canNext = 2, "video2", 0, false }, time.Second, []string{"Metadata", "CanGoNext"}, false},
+		{"stopped", func(s *mprisState) { *s = mprisState{status: "Stopped", index: -1} }, time.Second, []string{"PlaybackStatus", "Metadata", "CanGoNext", "CanGoPrevious", "CanPlay", "CanPause", "CanSeek"}, false},
+	} {
+		state := playing
+		test.change(&state)
+		changed, seeked := mprisChanges(playing, state, test.elapsed)
+		if !reflect.DeepEqual(changed, test.changed) || seeked != test.seeked {
+			t.Errorf("%s: got %v, %v, want %v, %v", test.name, changed, seeked, test.changed, test.seeked)
+		}
+	}
+}
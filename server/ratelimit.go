@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token bucket. It is shared between all proxied
+// streams, so it limits the total bandwidth.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int) *rateLimiter {
+	return &rateLimiter{
+		rate:   float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// wait blocks until n bytes may be transferred.
+func (rl *rateLimiter) wait(n int) {
+	rl.mutex.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.rate {
+		// allow bursts of at most one second
+		rl.tokens = rl.rate
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	delay := time.Duration(0)
+	if rl.tokens < 0 {
+		delay = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.mutex.Unlock()
+
+	time.Sleep(delay)
+}
+
+// chunkSize returns how much should be read at once. Reading in small chunks
+// keeps the stream smooth, so the player doesn't run out of data while waiting
+// for a big chunk.
+func (rl *rateLimiter) chunkSize() int {
+	size := int(rl.rate / 10)
+	if size < 512 {
+		size = 512
+	}
+	return size
+}
+
+// rateLimitedReader is an io.Reader that reads no faster than the limiter
+// allows.
+type rateLimitedReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (r rateLimitedReader) Read(p []byte) (int, error) {
+	if size := r.limiter.chunkSize(); len(p) > size {
+		p = p[:size]
+	}
+	n, err := r.r.Read(p)
+	r.limiter.wait(n)
+	return n, err
+}
@@ -2,6 +2,8 @@ package server
 
 import (
 	"flag"
+	"net"
+	"time"
 
 	"github.com/aykevl/plaincast/log"
 	"github.com/nu7hatch/gouuid"
@@ -15,22 +17,64 @@ const (
 )
 
 var deviceUUID *uuid.UUID
+var startTime time.Time
 var disableSSDP = flag.Bool("no-ssdp", false, "disable SSDP broadcast")
+var flagAdvertiseIP = flag.String("advertise-ip", "", "IP address to advertise in SSDP and DIAL, for when the detected address isn't reachable (e.g. in Docker)")
+var flagPreferIPv4 = flag.Bool("prefer-ipv4", false, "advertise an IPv4 address when the remote is reached over IPv6 (on dual-stack hosts)")
+var flagPreferIPv6 = flag.Bool("prefer-ipv6", false, "advertise an IPv6 address when the remote is reached over IPv4 (on dual-stack hosts)")
+var flagSystemName = flag.String("system-name", "", "name shown in the list of connected devices of the YouTube app (default: stored in config, or "+FRIENDLY_NAME+")")
+var flagMPRIS = flag.Bool("mpris", false, "let the desktop show and control playback over D-Bus (MPRIS), e.g. with media keys (Linux only)")
+var flagUUID = flag.String("uuid", "", "device UUID (default: stored in config or derived from MAC address)")
 var logger = log.New("server", "log HTTP and SSDP server")
 
 func Serve() {
+	startTime = time.Now()
+
+	if *flagAdvertiseIP != "" && net.ParseIP(*flagAdvertiseIP) == nil {
+		logger.Fatalln("invalid -advertise-ip:", *flagAdvertiseIP)
+	}
+
+	if _, ok := deviceIdentities[*flagDeviceType]; !ok {
+		logger.Fatalln("unknown -device-type:", *flagDeviceType)
+	}
+
+	if *flagPreferIPv4 && *flagPreferIPv6 {
+		logger.Fatalln("-prefer-ipv4 and -prefer-ipv6 can't be combined")
+	}
+
 	var err error
+	allowedSubnets, err = parseSubnets(*flagAllowSubnets)
+	if err != nil {
+		logger.Fatalln("invalid -allow-subnets:", err)
+	}
+
 	deviceUUID, err = getUUID()
 	if err != nil {
 		logger.Fatal(err)
 	}
 
 	us := NewUPnPServer()
+	if !*disableSSDP {
+		requireStep(STEP_SSDP)
+	}
 	httpPort, err := us.startServing()
 	if err != nil {
 		logger.Fatal(err)
 	}
 	logger.Println("serving HTTP on port", httpPort)
+	setStepDone(STEP_HTTP, true)
+
+	if *flagMDNS {
+		go serveMDNS(us.friendlyName, httpPort)
+	}
+
+	if *flagMPRIS {
+		go us.serveMPRIS()
+	}
+
+	if *flagFollow != "" {
+		go us.follow(*flagFollow)
+	}
 
 	if !*disableSSDP {
 		serveSSDP(httpPort)
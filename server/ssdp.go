@@ -2,6 +2,8 @@ package server
 
 import (
 	"bytes"
+	"errors"
+	"flag"
 	"fmt"
 	"math/rand"
 	"net"
@@ -11,21 +13,59 @@ import (
 	"time"
 )
 
+var flagAllowSubnets = flag.String("allow-subnets", "", "comma-separated list of subnets (e.g. 192.168.1.0/24) to answer SSDP searches from, to hide the device from other networks (default: all)")
+
+// Subnets parsed from -allow-subnets, nil to allow all. Set in Serve.
+var allowedSubnets []*net.IPNet
+
 const (
 	UDP_PACKET_SIZE = 1500
 	MSEARCH_HEADER  = "M-SEARCH * HTTP/1.1\r\n"
 	SSDP_ADDR       = "239.255.255.250:1900"
 )
 
+// Initial and maximum timeout before trying to listen for SSDP packets again
+// after an error. The timeout doubles on every failed attempt.
+const (
+	SSDP_RETRY_TIMEOUT     = time.Second
+	SSDP_MAX_RETRY_TIMEOUT = time.Minute
+)
+
+// serveSSDP responds to SSDP M-SEARCH requests. It never returns: when the
+// network goes down, it keeps trying to listen again.
 func serveSSDP(httpPort int) {
+	retryTimeout := SSDP_RETRY_TIMEOUT
+	for {
+		listened, err := listenSSDP(httpPort)
+		if listened {
+			// The previous attempt worked for a while.
+			retryTimeout = SSDP_RETRY_TIMEOUT
+		}
+		logger.Warnf("SSDP error: %s, retrying in %s\n", err, retryTimeout)
+		time.Sleep(retryTimeout)
+
+		retryTimeout *= 2
+		if retryTimeout > SSDP_MAX_RETRY_TIMEOUT {
+			retryTimeout = SSDP_MAX_RETRY_TIMEOUT
+		}
+	}
+}
+
+// listenSSDP listens for M-SEARCH requests until an error occurs. It returns
+// whether it could start listening, and the error.
+func listenSSDP(httpPort int) (bool, error) {
 	maddr, err := net.ResolveUDPAddr("udp", SSDP_ADDR)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
 	conn, err := net.ListenMulticastUDP("udp4", nil, maddr)
 	if err != nil {
-		panic(err)
+		return false, err
 	}
+	defer conn.Close()
+
+	setStepDone(STEP_SSDP, true)
+	defer setStepDone(STEP_SSDP, false)
 
 	// SSDP packets may at most be one UDP packet
 	buf := make([]byte, UDP_PACKET_SIZE)
@@ -33,7 +73,12 @@ func serveSSDP(httpPort int) {
 	for {
 		n, raddr, err := conn.ReadFromUDP(buf)
 		if err != nil {
-			panic(err)
+			return true, err
+		}
+
+		if !ssdpAllowed(raddr.IP) {
+			// Silently ignore requests from other networks.
+			continue
 		}
 
 		packet := buf[:n]
@@ -48,18 +93,106 @@ func serveSSDP(httpPort int) {
 			continue
 		}
 
-		if !strings.HasPrefix(msg.Header.Get("ST"), "urn:dial-multiscreen-org:service:dial:") {
+		if !ssdpMatchesSearch(msg.Header.Get("ST")) {
 			// not the request we're looking for
-			// TODO this is not UPnP compliant: it needs to respond to various other requests as well like ssdp:any.
-			// On the other hand, the DIAL specification seems to imply this is the only required "ST"
-			// that needs to be responded to.
 			continue
 		}
 
 		go serveSSDPResponse(msg, raddr, httpPort)
 	}
+}
+
+// parseSubnets parses a comma-separated list of subnets in CIDR notation. An
+// empty list returns nil.
+func parseSubnets(list string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, cidr := range strings.Split(list, ",") {
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, errors.New("invalid subnet: " + cidr)
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// ssdpAllowed returns true if searches from ip should be answered, according
+// to -allow-subnets.
+func ssdpAllowed(ip net.IP) bool {
+	if allowedSubnets == nil {
+		return true
+	}
+	for _, subnet := range allowedSubnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
 
+// ssdpMatchesSearch returns true if this device should respond to an M-SEARCH
+// with the given search target (ST header).
+// TODO this is not UPnP compliant: it needs to respond to various other
+// requests as well like ssdp:any. On the other hand, the DIAL specification
+// seems to imply this is the only required "ST" that needs to be responded to.
+func ssdpMatchesSearch(st string) bool {
+	return strings.HasPrefix(st, "urn:dial-multiscreen-org:service:dial:")
+}
+
+// ssdpNotifyTypes are the notification types sent in a NOTIFY burst.
+var ssdpNotifyTypes = []string{
+	"upnp:rootdevice",
+	"", // uuid:<device UUID>
+	"urn:dial-multiscreen-org:service:dial:1",
+}
+
+// sendSSDPNotify sends a burst of ssdp:alive NOTIFY messages to announce this
+// device on the network. The burst is sent twice, as UDP is unreliable.
+func sendSSDPNotify(httpPort int) error {
+	maddr, err := net.ResolveUDPAddr("udp", SSDP_ADDR)
+	if err != nil {
+		return err
+	}
+	conn, err := net.DialUDP("udp", nil, maddr)
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
+
+	ip := advertisedIP(conn.LocalAddr(), SSDP_ADDR)
+	for i := 0; i < 2; i++ {
+		for _, nt := range ssdpNotifyTypes {
+			usn := "uuid:" + deviceUUID.String()
+			if nt == "" {
+				nt = usn
+			} else {
+				usn += "::" + nt
+			}
+
+			message := fmt.Sprintf("NOTIFY * HTTP/1.1\r\n"+
+				"HOST: %s\r\n"+
+				"CACHE-CONTROL: max-age=1800\r\n"+
+				"LOCATION: http://%s:%d/upnp/description.xml\r\n"+
+				"NT: %s\r\n"+
+				"NTS: ssdp:alive\r\n"+
+				"SERVER: Linux/2.6.16+ UPnP/1.1 %s/%s\r\n"+
+				"USN: %s\r\n"+
+				"CONFIGID.UPNP.ORG: %d\r\n"+
+				"\r\n", SSDP_ADDR, ip, httpPort, nt, NAME, VERSION, usn, CONFIGID)
+
+			_, err = conn.Write([]byte(message))
+			if err != nil {
+				return err
+			}
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	return nil
 }
 
 func serveSSDPResponse(msg *mail.Message, raddr *net.UDPAddr, httpPort int) {
@@ -73,24 +206,32 @@ func serveSSDPResponse(msg *mail.Message, raddr *net.UDPAddr, httpPort int) {
 
 	conn, err := net.DialUDP("udp", nil, raddr)
 	if err != nil {
-		panic(err)
+		logger.Warnln("could not send SSDP response:", err)
+		return
 	}
 	defer conn.Close()
 
+	response := ssdpResponse(advertisedIP(conn.LocalAddr(), raddr.String()), httpPort, deviceUUID.String(), time.Now())
+
+	_, err = conn.Write(response)
+	if err != nil {
+		logger.Warnln("could not send SSDP response:", err)
+	}
+}
+
+// ssdpResponse builds the response to a M-SEARCH request for the DIAL service.
+// ip must already be formatted for use in an URL (see getUrlIP).
+func ssdpResponse(ip string, httpPort int, deviceUUID string, now time.Time) []byte {
 	// TODO implement OS header, BOOTID.UPNP.ORG
 	// and make this a real template
-	response := fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
+	return []byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n"+
 		"CACHE-CONTROL: max-age=1800\r\n"+
 		"DATE: %s\r\n"+
 		"EXT: \r\n"+
 		"LOCATION: http://%s:%d/upnp/description.xml\r\n"+
 		"SERVER: Linux/2.6.16+ UPnP/1.1 %s/%s\r\n"+
 		"ST: urn:dial-multiscreen-org:service:dial:1\r\n"+
+		"USN: uuid:%s::urn:dial-multiscreen-org:service:dial:1\r\n"+
 		"CONFIGID.UPNP.ORG: %d\r\n"+
-		"\r\n", time.Now().Format(time.RFC1123Z), getUrlIP(conn.LocalAddr()), httpPort, NAME, VERSION, CONFIGID)
-
-	_, err = conn.Write([]byte(response))
-	if err != nil {
-		panic(err)
-	}
+		"\r\n", now.Format(time.RFC1123Z), ip, httpPort, NAME, VERSION, deviceUUID, CONFIGID))
 }
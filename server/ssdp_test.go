@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// An M-SEARCH as sent by the YouTube app on Android.
+const testMSearch = "M-SEARCH * HTTP/1.1\r\n" +
+	"HOST: 239.255.255.250:1900\r\n" +
+	"MAN: \"ssdp:discover\"\r\n" +
+	"MX: 1\r\n" +
+	"ST: urn:dial-multiscreen-org:service:dial:1\r\n" +
+	"USER-AGENT: Google Chrome/60.0.3112.116 Linux\r\n" +
+	"\r\n"
+
+func TestSSDPMatchesSearch(t *testing.T) {
+	packet := []byte(testMSearch)
+	if !bytes.HasPrefix(packet, []byte(MSEARCH_HEADER)) {
+		t.Fatal("M-SEARCH doesn't start with MSEARCH_HEADER")
+	}
+	msg, err := mail.ReadMessage(bytes.NewReader(packet[len(MSEARCH_HEADER):]))
+	if err != nil {
+		t.Fatal("could not parse M-SEARCH:", err)
+	}
+	if !ssdpMatchesSearch(msg.Header.Get("ST")) {
+		t.Error("M-SEARCH for DIAL doesn't match")
+	}
+
+	for _, st := range []string{
+		"",
+		"ssdp:all",
+		"upnp:rootdevice",
+		"urn:schemas-upnp-org:device:MediaRenderer:1",
+		"urn:dial-multiscreen-org:device:dial:1",
+	} {
+		if ssdpMatchesSearch(st) {
+			t.Errorf("ST %q matches, only DIAL searches should be answered", st)
+		}
+	}
+}
+
+func TestSSDPResponse(t *testing.T) {
+	const uuid = "f0f0f0f0-1234-5678-9abc-def012345678"
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	response := ssdpResponse("192.168.1.10", 8008, uuid, now)
+
+	if !bytes.HasSuffix(response, []byte("\r\n\r\n")) {
+		t.Error("response doesn't end with an empty line")
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		t.Fatal("could not parse response:", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status: got %d, want 200", resp.StatusCode)
+	}
+
+	for key, want := range map[string]string{
+		"ST":                "urn:dial-multiscreen-org:service:dial:1",
+		"USN":               "uuid:" + uuid + "::urn:dial-multiscreen-org:service:dial:1",
+		"LOCATION":          "http://192.168.1.10:8008/upnp/description.xml",
+		"CACHE-CONTROL":     "max-age=1800",
+		"DATE":              "Thu, 02 Jan 2020 03:04:05 +0000",
+		"CONFIGID.UPNP.ORG": strconv.Itoa(CONFIGID),
+	} {
+		if got := resp.Header.Get(key); got != want {
+			t.Errorf("%s: got %q, want %q", key, got, want)
+		}
+	}
+	if _, ok := resp.Header["Ext"]; !ok {
+		t.Error("EXT header is missing")
+	}
+}
+
+func TestSSDPResponseIPv6(t *testing.T) {
+	response := ssdpResponse("[fe80::1]", 8008, "uuid", time.Now())
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(response)), nil)
+	if err != nil {
+		t.Fatal("could not parse response:", err)
+	}
+	if got, want := resp.Header.Get("LOCATION"), "http://[fe80::1]:8008/upnp/description.xml"; got != want {
+		t.Errorf("LOCATION: got %q, want %q", got, want)
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"net"
 	"net/http"
+	"sync"
 
+	"github.com/aykevl/plaincast/config"
 	"github.com/nu7hatch/gouuid"
 )
 
@@ -23,6 +25,16 @@ func getLocalAddr(req *http.Request) net.Addr {
 	return conn.LocalAddr()
 }
 
+// isLocalRequest returns true if the request comes from this host.
+func isLocalRequest(req *http.Request) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // getUrlIP formats the address so it can be used inside an URL.
 // It wraps the IP address inside [ and ] when it's an IPv6 address.
 func getUrlIP(addr net.Addr) string {
@@ -42,8 +54,132 @@ func getUrlIP(addr net.Addr) string {
 	return addrString
 }
 
-// getUUID returns a stable UUID based on the first MAC address
+// The address most recently advertised in a DIAL or SSDP response, for
+// /status.
+var lastAdvertisedIP string
+var lastAdvertisedIPMutex sync.Mutex
+
+// advertisedIP formats the local address (see getUrlIP) to be advertised to
+// the given remote, and logs and remembers it. A wrong address here (e.g. of a
+// Docker bridge) makes the device unreachable for the remote, so it can be
+// overridden with -advertise-ip.
+func advertisedIP(addr net.Addr, remote string) string {
+	if ip := net.ParseIP(*flagAdvertiseIP); ip != nil {
+		addr = &net.UDPAddr{IP: ip}
+	} else if *flagPreferIPv4 || *flagPreferIPv6 {
+		addr = preferFamily(addr, *flagPreferIPv4)
+	}
+	ip := getUrlIP(addr)
+	logger.Printf("Advertising address %s to %s\n", ip, remote)
+
+	lastAdvertisedIPMutex.Lock()
+	lastAdvertisedIP = ip
+	lastAdvertisedIPMutex.Unlock()
+
+	return ip
+}
+
+// preferFamily returns an address of the preferred family (IPv4 or IPv6) on
+// the same interface as addr, for dual-stack hosts where the remote can only
+// reach one of them. It returns addr itself when it already is of the
+// preferred family or no such address exists.
+func preferFamily(addr net.Addr, ipv4 bool) net.Addr {
+	udpAddr, ok := addr.(*net.UDPAddr)
+	if !ok || (udpAddr.IP.To4() != nil) == ipv4 {
+		return addr
+	}
+
+	itfs, err := net.Interfaces()
+	if err != nil {
+		logger.Warnln("could not list network interfaces:", err)
+		return addr
+	}
+	for _, itf := range itfs {
+		addrs, err := itf.Addrs()
+		if err != nil || !hasIP(addrs, udpAddr.IP) {
+			continue
+		}
+		for _, itfAddr := range addrs {
+			ipNet, ok := itfAddr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() != nil) != ipv4 || ipNet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			return &net.UDPAddr{IP: ipNet.IP}
+		}
+	}
+	return addr
+}
+
+// hasIP returns true if ip is one of the interface addresses.
+func hasIP(addrs []net.Addr, ip net.IP) bool {
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// getLastAdvertisedIP returns the address most recently advertised, or an
+// empty string if none has been advertised yet.
+func getLastAdvertisedIP() string {
+	lastAdvertisedIPMutex.Lock()
+	defer lastAdvertisedIPMutex.Unlock()
+
+	return lastAdvertisedIP
+}
+
+// getSystemName returns the name apps show to remotes. It is taken from the
+// -system-name flag or from the config file (server.systemName), so every
+// device can get its own name.
+func getSystemName() string {
+	if *flagSystemName != "" {
+		return *flagSystemName
+	}
+
+	name, err := config.Get().GetString("server.systemName", func() (string, error) {
+		return FRIENDLY_NAME, nil
+	})
+	if err != nil {
+		logger.Warnln("invalid server.systemName in config:", err)
+		return FRIENDLY_NAME
+	}
+	if name == "" {
+		return FRIENDLY_NAME
+	}
+	return name
+}
+
+// getUUID returns the device UUID. It is taken from the -uuid flag or from the
+// config file. If neither is set, it is derived from the first MAC address and
+// stored in the config, so it stays the same when the hardware changes.
 func getUUID() (*uuid.UUID, error) {
+	conf := config.Get()
+
+	if *flagUUID != "" {
+		id, err := uuid.ParseHex(*flagUUID)
+		if err != nil {
+			return nil, err
+		}
+		conf.Set("server.uuid", id.String())
+		return id, nil
+	}
+
+	id, err := conf.GetString("server.uuid", func() (string, error) {
+		id, err := getMACUUID()
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return uuid.ParseHex(id)
+}
+
+// getMACUUID returns a stable UUID based on the first MAC address
+func getMACUUID() (*uuid.UUID, error) {
 	itfs, err := net.Interfaces()
 	if err != nil {
 		return nil, err